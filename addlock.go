@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const (
+	// defaultAddLockTimeout bounds the wait for a concurrent ADD of the
+	// same container unless addLockTimeoutMs is set. It covers the full
+	// metadata polling budget of the other ADD.
+	defaultAddLockTimeout = 150 * time.Second
+	addLockPollInterval   = 50 * time.Millisecond
+)
+
+// cmdAddLocked runs cmdAddWithRetry under addLock: concurrent ADDs of one
+// container, as from a runtime retry, are serialized by a per-container
+// file lock under the cache dir. An ADD that had to wait for another one
+// to succeed returns that ADD's result rather than resolving and
+// assigning again, emitted for its own netconf.
+func cmdAddLocked(args *skel.CmdArgs) error {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if !conf.AddLock {
+		return cmdAddWithRetry(conf, args)
+	}
+	timeout := defaultAddLockTimeout
+	if conf.AddLockTimeoutMs > 0 {
+		timeout = time.Duration(conf.AddLockTimeoutMs) * time.Millisecond
+	}
+	// The start is compared with the modification time of the result
+	// file, so it is read from the system clock.
+	start := time.Now()
+	unlock, err := lockAdd(args.ContainerID, timeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if cached, ok := freshResult(args.ContainerID, start); ok {
+		log.Infof("rancher-calico-ipam: concurrent ADD of %s already succeeded, returning its result", args.ContainerID)
+		return emitResult(conf, args, cached.Result, cached.source())
+	}
+	return cmdAddWithRetry(conf, args)
+}
+
+// addStatePath returns the path of a per-container state file.
+func addStatePath(containerID, suffix string) string {
+	return filepath.Join(cacheDir(), "rancher-calico-ipam-add-"+filepath.Base(containerID)+suffix)
+}
+
+// lockAdd takes the ADD lock of containerID, waiting at most timeout, and
+// returns the function releasing it.
+func lockAdd(containerID string, timeout time.Duration) (func(), error) {
+	path := addStatePath(containerID, ".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := clock.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK || clock.Now().After(deadline) {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, fmt.Errorf("another ADD of %s is still running after %v", containerID, timeout)
+			}
+			return nil, err
+		}
+		clock.Sleep(addLockPollInterval)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// resultCacheVersion is the version of the cachedResult format. It is
+// bumped whenever a field changes meaning, and a cache of another version
+// is ignored.
+const resultCacheVersion = 2
+
+// cachedResult is the format of the result cache file of a container:
+//
+//	{
+//	    "version": 2,
+//	    "containerID": "<CNI_CONTAINERID>",
+//	    "result": <the 0.2.0 result before layout and prevResult merging>,
+//	    "source": <the ipSource of the result, if any>,
+//	    "labels": {<metadata labels of the container, under cacheLabels>}
+//	}
+//
+// The result is kept as resolved rather than as printed, so that an ADD
+// returning it emits it in the layout of its own netconf.
+type cachedResult struct {
+	Version     int               `json:"version"`
+	ContainerID string            `json:"containerID"`
+	Result      *types.Result     `json:"result"`
+	Source      *ipSource         `json:"source,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// source returns the ipSource of the cached result with its labels.
+func (cached *cachedResult) source() *ipSource {
+	if cached.Source == nil {
+		return nil
+	}
+	source := *cached.Source
+	source.labels = cached.Labels
+	return &source
+}
+
+// saveResult keeps the result of a successful ADD, with the container's
+// metadata labels if given, for a concurrent ADD of the same container.
+// Failing to save it is only logged.
+func saveResult(containerID string, r *types.Result, source *ipSource, labels map[string]string) {
+	data, err := json.MarshalIndent(cachedResult{resultCacheVersion, containerID, r, source, labels}, "", "    ")
+	if err == nil {
+		err = ioutil.WriteFile(addStatePath(containerID, ".result"), data, 0644)
+	}
+	if err != nil {
+		log.Warnf("rancher-calico-ipam: cannot save the result of %s: %v", containerID, err)
+	}
+}
+
+// loadResult reads the result cache of containerID.
+func loadResult(containerID string) (*cachedResult, error) {
+	data, err := ioutil.ReadFile(addStatePath(containerID, ".result"))
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedResult{}
+	if err := json.Unmarshal(data, cached); err != nil {
+		return nil, err
+	}
+	if cached.Version != resultCacheVersion {
+		return nil, fmt.Errorf("result cache version %d, expected %d", cached.Version, resultCacheVersion)
+	}
+	return cached, nil
+}
+
+// freshResult returns the result saved for containerID by an ADD that
+// finished after since.
+func freshResult(containerID string, since time.Time) (*cachedResult, bool) {
+	fi, err := os.Stat(addStatePath(containerID, ".result"))
+	if err != nil || fi.ModTime().Before(since) {
+		return nil, false
+	}
+	cached, err := loadResult(containerID)
+	if err != nil {
+		log.Debugf("rancher-calico-ipam: ignoring the result cache of %s: %v", containerID, err)
+		return nil, false
+	}
+	return cached, true
+}
+
+// forgetResult removes the saved result and lock file of containerID on
+// DEL. Runtimes do not DEL a container while its ADD is still running, so
+// the lock is not in use.
+func forgetResult(containerID string) {
+	for _, suffix := range []string{".result", ".lock"} {
+		if err := os.Remove(addStatePath(containerID, suffix)); err != nil && !os.IsNotExist(err) {
+			log.Warnf("rancher-calico-ipam: cannot remove ADD state of %s: %v", containerID, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// useCacheDir points the cache dir at a new temporary directory until
+// the returned function is called.
+func useCacheDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "rancher-calico-ipam-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, had := os.LookupEnv(cacheDirEnv)
+	os.Setenv(cacheDirEnv, dir)
+	return func() {
+		if had {
+			os.Setenv(cacheDirEnv, saved)
+		} else {
+			os.Unsetenv(cacheDirEnv)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCmdAddLocked(t *testing.T) {
+	// Without a netns, an ADD that runs rather than replays returns an
+	// empty result, without needing Calico.
+	netconf := func(version string) []byte {
+		return []byte(`{"name": "test", "type": "rancher-calico-ipam", "cniVersion": "` + version + `", "addLock": true, "addLockTimeoutMs": 5000, "skipNoNetns": true}`)
+	}
+	source := &ipSource{MetadataURL: "http://169.254.169.250/2015-12-19"}
+	tests := []struct {
+		name string
+		// concurrent holds the lock and saves the result while the ADD
+		// waits on it, as a concurrent ADD would; otherwise the result
+		// is saved before the ADD starts.
+		concurrent bool
+		wantIP     string
+	}{
+		{name: "concurrent ADD replays the result", concurrent: true, wantIP: "10.42.0.5"},
+		{name: "earlier result is not replayed"},
+	}
+	for _, tt := range tests {
+		restoreDir := useCacheDir(t)
+		results, restore := captureResults()
+		args := &skel.CmdArgs{ContainerID: "ctr", Netns: "none", IfName: "eth0", StdinData: netconf("0.3.1")}
+		first, err := loadNetConf(netconf("0.2.0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		firstArgs := *args
+		firstArgs.StdinData = netconf("0.2.0")
+
+		if tt.concurrent {
+			unlock, err := lockAdd(args.ContainerID, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error, 1)
+			go func() { done <- cmdAddLocked(args) }()
+			// Let the ADD start waiting on the lock.
+			time.Sleep(200 * time.Millisecond)
+			err = emitResult(first, &firstArgs, testResult("10.42.0.5"), source)
+			unlock()
+			if err == nil {
+				err = <-done
+			}
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		} else {
+			if err := emitResult(first, &firstArgs, testResult("10.42.0.5"), source); err != nil {
+				t.Fatal(err)
+			}
+			if err := cmdAddLocked(args); err != nil {
+				t.Errorf("%s: cmdAddLocked() error = %v", tt.name, err)
+			}
+		}
+		restore()
+		restoreDir()
+
+		if len(*results) != 2 {
+			t.Errorf("%s: %d results, want 2", tt.name, len(*results))
+			continue
+		}
+		// The result is emitted in the layout of the waiting ADD.
+		r, ok := (*results)[1].(*result030)
+		if !ok {
+			t.Errorf("%s: result = %#v, want a 0.3.1 result", tt.name, (*results)[1])
+			continue
+		}
+		ip := ""
+		if len(r.IPs) > 0 {
+			ip = r.IPs[0].Address.IP.String()
+		}
+		if ip != tt.wantIP {
+			t.Errorf("%s: result address %q, want %q", tt.name, ip, tt.wantIP)
+		}
+		if tt.concurrent && (r.Source == nil || r.Source.MetadataURL != source.MetadataURL) {
+			t.Errorf("%s: result source = %v, want %v", tt.name, r.Source, source)
+		}
+	}
+}
+
+func TestLoadResult(t *testing.T) {
+	defer useCacheDir(t)()
+	saveResult("ctr", testResult("10.42.0.5"), nil, map[string]string{"app": "web"})
+	cached, err := loadResult("ctr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.Result.IP4.IP.String() != "10.42.0.5/32" || cached.Labels["app"] != "web" || cached.source() != nil {
+		t.Errorf("cached = %+v, want 10.42.0.5/32 with labels and no source", cached)
+	}
+
+	if err := ioutil.WriteFile(addStatePath("old", ".result"), []byte(`{"version": 1, "containerID": "old", "result": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadResult("old"); err == nil {
+		t.Error("loadResult() accepted a version 1 cache")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// iflaIfAlias is the IFLA_IFALIAS link attribute, which the syscall
+// package does not define.
+const iflaIfAlias = 20
+
+// rancherUUIDLabel is the label Rancher sets to the UUID of a container.
+const rancherUUIDLabel = "io.rancher.container.uuid"
+
+// setInterfaceAlias sets the alias of the container interface, as shown
+// by ip link, to the Rancher UUID of the container, so that interfaces
+// can be told apart when debugging on the host. The interface only
+// exists when this plugin runs after the main plugin in a chain; its
+// absence, the usual case, and a kernel refusing the alias are logged
+// at debug level and otherwise ignored.
+func setInterfaceAlias(args *skel.CmdArgs, ipamArgs *ipamArgs, source *ipSource, logger *log.Entry) {
+	uuid := string(ipamArgs.RancherContainerUUID)
+	if uuid == "" && source != nil {
+		uuid = source.labels[rancherUUIDLabel]
+	}
+	if uuid == "" {
+		logger.Debug("No Rancher UUID known for the container, not setting an interface alias")
+		return
+	}
+	alias := "rancher:" + uuid
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		iface, err := net.InterfaceByName(args.IfName)
+		if err != nil {
+			return errNoInterface
+		}
+		return setLinkAlias(iface.Index, alias)
+	})
+	if err == errNoInterface {
+		logger.Debugf("Not setting alias of %s: %v", args.IfName, err)
+		return
+	}
+	if err != nil {
+		logger.Debugf("Could not set alias of %s: %v", args.IfName, err)
+		return
+	}
+	logger.WithField("alias", alias).Debugf("Set alias of %s", args.IfName)
+}
+
+// setLinkAlias sends an RTM_SETLINK request setting IFLA_IFALIAS of the
+// link with the given index in the current network namespace.
+func setLinkAlias(index int, alias string) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	attrLen := syscall.SizeofRtAttr + len(alias) + 1
+	msgLen := syscall.NLMSG_HDRLEN + syscall.SizeofIfInfomsg + (attrLen+syscall.RTA_ALIGNTO-1)&^(syscall.RTA_ALIGNTO-1)
+	b := make([]byte, msgLen)
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&b[0])) = syscall.NlMsghdr{
+		Len:   uint32(msgLen),
+		Type:  syscall.RTM_SETLINK,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+		Seq:   1,
+	}
+	*(*syscall.IfInfomsg)(unsafe.Pointer(&b[syscall.NLMSG_HDRLEN])) = syscall.IfInfomsg{
+		Family: syscall.AF_UNSPEC,
+		Index:  int32(index),
+	}
+	attr := syscall.NLMSG_HDRLEN + syscall.SizeofIfInfomsg
+	*(*syscall.RtAttr)(unsafe.Pointer(&b[attr])) = syscall.RtAttr{Len: uint16(attrLen), Type: iflaIfAlias}
+	copy(b[attr+syscall.SizeofRtAttr:], alias)
+
+	if err := syscall.Sendto(fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	reply := make([]byte, syscall.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, reply, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(reply[:n])
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.NLMSG_ERROR || len(msg.Data) < 4 {
+			continue
+		}
+		if errno := *(*int32)(unsafe.Pointer(&msg.Data[0])); errno != 0 {
+			return syscall.Errno(-errno)
+		}
+		return nil
+	}
+	return fmt.Errorf("no acknowledgement from netlink")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestSetInterfaceAlias(t *testing.T) {
+	tests := []struct {
+		name      string
+		ifName    string
+		rancherID string
+		labels    map[string]string
+		wantAlias string
+	}{
+		{name: "interface not created yet", rancherID: "uuid-1"},
+		{name: "from CNI_ARGS", ifName: "eth0", rancherID: "uuid-1", wantAlias: "rancher:uuid-1"},
+		{name: "from the labels", ifName: "eth0", labels: map[string]string{rancherUUIDLabel: "uuid-2"}, wantAlias: "rancher:uuid-2"},
+		{name: "no UUID known", ifName: "eth0"},
+	}
+	for _, tt := range tests {
+		netns := testNetns(t, tt.ifName)
+		args := &skel.CmdArgs{ContainerID: "ctr", Netns: netns.Path(), IfName: "eth0"}
+		setInterfaceAlias(args, &ipamArgs{RancherContainerUUID: types.UnmarshallableString(tt.rancherID)}, &ipSource{labels: tt.labels}, testLogger())
+		var out []byte
+		if tt.ifName != "" {
+			err := netns.Do(func(ns.NetNS) error {
+				var err error
+				out, err = exec.Command("ip", "-o", "link", "show", tt.ifName).CombinedOutput()
+				return err
+			})
+			if err != nil {
+				t.Errorf("%s: ip link: %v: %s", tt.name, err, out)
+			}
+		}
+		netns.Close()
+		alias := ""
+		if i := strings.Index(string(out), " alias "); i >= 0 {
+			alias = strings.Fields(string(out)[i:])[1]
+		}
+		if alias != tt.wantAlias {
+			t.Errorf("%s: alias %q, want %q", tt.name, alias, tt.wantAlias)
+		}
+	}
+}
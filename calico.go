@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/client"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+)
+
+// calicoAPI is the part of the Calico client the plugin uses, which
+// *client.Client implements.
+type calicoAPI interface {
+	IPAM() client.IPAMInterface
+	IPPools() client.IPPoolInterface
+	Nodes() client.NodeInterface
+	WorkloadEndpoints() client.WorkloadEndpointInterface
+}
+
+// Calico IPAM block sizes, mirroring the unexported values in libcalico-go.
+const (
+	ipv4BlockPrefixLength = 26
+	ipv6BlockPrefixLength = 122
+)
+
+// findPool returns the configured Calico IP pool containing ip, or nil if
+// there is none.
+func findPool(calicoClient calicoAPI, ip net.IP) (*api.IPPool, error) {
+	pools, err := calicoClient.IPPools().List(api.IPPoolMetadata{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pools.Items {
+		if pools.Items[i].Metadata.CIDR.Contains(ip) {
+			return &pools.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Policies for an address in no Calico pool under poolPrefix.
+const (
+	noPoolReject           = "reject"
+	noPoolAssumeHostPrefix = "assumeHostPrefix"
+	noPoolCreateHostRoute  = "createHostRoute"
+)
+
+// resultConfig returns the result entry for ip, holding ip with the
+// prefix length to report for it. Under poolPrefix that is the prefix of
+// the Calico pool containing ip, so the container's on-link view matches
+// the pool; otherwise it is the hostRoutePrefix of the family.
+//
+// An ip in no pool is handled as noPoolPolicy says: reject fails,
+// assumeHostPrefix (the default) uses the host prefix with a warning, and
+// createHostRoute also adds an on-link route to the address itself.
+func resultConfig(calicoClient calicoAPI, conf NetConf, ip net.IP, logger *log.Entry) (*types.IPConfig, error) {
+	if conf.PoolPrefix {
+		pool, err := findPool(calicoClient, ip)
+		switch {
+		case err != nil:
+			logger.Warnf("Failed to look up the IP pool of %s, using the host prefix: %v", ip.String(), err)
+		case pool == nil:
+			return noPoolConfig(conf, ip, logger)
+		default:
+			ones, bits := pool.Metadata.CIDR.Mask.Size()
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			return &types.IPConfig{IP: net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}}, nil
+		}
+	}
+	return &types.IPConfig{IP: conf.HostRoutePrefix.ipNet(ip)}, nil
+}
+
+// noPoolConfig is resultConfig for an ip in no Calico pool.
+func noPoolConfig(conf NetConf, ip net.IP, logger *log.Entry) (*types.IPConfig, error) {
+	ipc := &types.IPConfig{IP: conf.HostRoutePrefix.ipNet(ip)}
+	switch conf.NoPoolPolicy {
+	case noPoolReject:
+		return nil, fmt.Errorf("IP %s is not in any Calico IP pool", ip.String())
+	case noPoolCreateHostRoute:
+		host := conf.HostRoutePrefix.ipNet(ip)
+		bits := len(host.IP) * 8
+		ipc.Routes = append(ipc.Routes, types.Route{Dst: net.IPNet{IP: host.IP, Mask: net.CIDRMask(bits, bits)}})
+		logger.Warnf("No IP pool contains %s, using the host prefix and a host route", ip.String())
+	default:
+		logger.Warnf("No IP pool contains %s, using the host prefix", ip.String())
+	}
+	return ipc, nil
+}
+
+// checkPoolCIDR rejects ip unless it lies in the pool of CIDR poolCIDR,
+// which must exist.
+func checkPoolCIDR(pools client.IPPoolInterface, poolCIDR string, ip net.IP) error {
+	_, cidr, err := cnet.ParseCIDR(poolCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid poolCIDR %q: %v", poolCIDR, err)
+	}
+	pool, err := pools.Get(api.IPPoolMetadata{CIDR: *cidr})
+	if err != nil {
+		return fmt.Errorf("failed to get IP pool %s: %v", cidr.String(), err)
+	}
+	if !pool.Metadata.CIDR.Contains(ip) {
+		return fmt.Errorf("IP %s is not in IP pool %s", ip.String(), pool.Metadata.CIDR.String())
+	}
+	return nil
+}
+
+// blockCIDR returns the Calico IPAM block that ip belongs to.
+func blockCIDR(ip net.IP) cnet.IPNet {
+	if ip.To4() != nil {
+		mask := net.CIDRMask(ipv4BlockPrefixLength, 32)
+		return cnet.IPNet{IPNet: net.IPNet{IP: ip.To4().Mask(mask), Mask: mask}}
+	}
+	mask := net.CIDRMask(ipv6BlockPrefixLength, 128)
+	return cnet.IPNet{IPNet: net.IPNet{IP: ip.Mask(mask), Mask: mask}}
+}
+
+// prepareAssign runs before a provided IP is handed to AssignIP and
+// reports whether it should be, as Calico IPAM only assigns addresses of
+// its pools. It rejects an IP outside every configured pool with a clear
+// error, unless poolPrefix is set and noPoolPolicy is assumeHostPrefix or
+// createHostRoute: the IP is then used without a Calico assignment and
+// resultConfig applies the policy. With claimAffinity set it claims the
+// IP's block for this host up front rather than leaving AssignIP to claim
+// a new block implicitly.
+func prepareAssign(calicoClient calicoAPI, conf NetConf, ip net.IP, logger *log.Entry) (bool, error) {
+	pool, err := findPool(calicoClient, ip)
+	if err != nil {
+		return false, err
+	}
+	if pool == nil {
+		if conf.PoolPrefix && conf.NoPoolPolicy != noPoolReject {
+			logger.Warnf("No IP pool contains %s, using it without a Calico IPAM assignment", ip.String())
+			return false, nil
+		}
+		return false, fmt.Errorf("IP %s is not in any configured Calico IP pool", ip.String())
+	}
+	if conf.PoolCIDR != "" {
+		if err := checkPoolCIDR(calicoClient.IPPools(), conf.PoolCIDR, ip); err != nil {
+			return false, err
+		}
+	}
+	if !conf.ClaimAffinity {
+		return true, nil
+	}
+
+	block := blockCIDR(ip)
+	claimed, failed, err := calicoClient.IPAM().ClaimAffinity(block, conf.Hostname)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim block %s for IP %s: %v", block.String(), ip.String(), err)
+	}
+	if len(failed) > 0 {
+		logger.Warnf("Block %s is affine to another host", block.String())
+	} else if len(claimed) > 0 {
+		logger.Infof("Claimed block %s for IP %s", block.String(), ip.String())
+	}
+	return true, nil
+}
+
+// localNodeName returns the Calico node name of this host: the netconf
+// hostname, or else the system hostname, as libcalico-go defaults it.
+func localNodeName(conf NetConf) (string, error) {
+	if conf.Hostname != "" {
+		return conf.Hostname, nil
+	}
+	return os.Hostname()
+}
+
+const (
+	// defaultNodeReadyTimeout bounds waitForNode unless
+	// nodeReadyTimeoutMs is set.
+	defaultNodeReadyTimeout = 5 * time.Second
+	nodeReadyPollInterval   = 500 * time.Millisecond
+)
+
+// waitForNode waits until the local Calico node exists and has its BGP
+// spec, which calico/node sets once it has initialized the host, so that
+// no address is assigned on a node Calico is not ready on. It fails once
+// timeout has passed.
+func waitForNode(nodes client.NodeInterface, conf NetConf, timeout time.Duration, logger *log.Entry) error {
+	nodeName, err := localNodeName(conf)
+	if err != nil {
+		return fmt.Errorf("cannot determine the node name: %v", err)
+	}
+	deadline := clock.Now().Add(timeout)
+	for {
+		node, err := nodes.Get(api.NodeMetadata{Name: nodeName})
+		if err == nil && node.Spec.BGP != nil {
+			return nil
+		}
+		if clock.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("calico node %s is not ready after %v: %v", nodeName, timeout, err)
+			}
+			return fmt.Errorf("calico node %s is not ready after %v: no BGP spec", nodeName, timeout)
+		}
+		logger.Debugf("Waiting for calico node %s to be ready", nodeName)
+		clock.Sleep(nodeReadyPollInterval)
+	}
+}
+
+// setNodeGateway makes the BGP IPv4 address of the local Calico node the
+// gateway and default route next-hop of the IPv4 result, as the node is
+// the container's gateway in Calico's routing model. A node without a BGP
+// address falls back to the agent IP of the Rancher host. Any gateway and
+// default route already in the result are replaced, so that the node
+// address wins over one derived elsewhere. Without either address the
+// result is left as it is.
+func setNodeGateway(calicoClient calicoAPI, conf NetConf, r *types.Result, logger *log.Entry) {
+	gw, from := nodeGatewayIP(calicoClient, conf, logger)
+	if gw == nil {
+		logger.Debug("No node address known, leaving the gateway unset")
+		return
+	}
+	_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+	if r.IP4.Gateway != nil && !r.IP4.Gateway.Equal(gw) {
+		logger.Infof("Replacing gateway %s with the node address", r.IP4.Gateway.String())
+	}
+	r.IP4.Gateway = gw
+	routes := []types.Route{}
+	for _, route := range r.IP4.Routes {
+		if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+			routes = append(routes, route)
+		}
+	}
+	r.IP4.Routes = append(routes, types.Route{Dst: *defaultNet, GW: gw})
+	logger.Infof("Using %s %s as gateway", from, gw.String())
+}
+
+// nodeGatewayIP returns the IPv4 address of the local node that
+// setNodeGateway uses, and a description of where it came from.
+func nodeGatewayIP(calicoClient calicoAPI, conf NetConf, logger *log.Entry) (net.IP, string) {
+	nodeName, err := localNodeName(conf)
+	if err != nil {
+		logger.Warnf("Cannot determine the node name for the gateway: %v", err)
+	} else if node, err := calicoClient.Nodes().Get(api.NodeMetadata{Name: nodeName}); err != nil {
+		logger.Warnf("Failed to get node %s for the gateway: %v", nodeName, err)
+	} else if node.Spec.BGP != nil && node.Spec.BGP.IPv4Address != nil {
+		return node.Spec.BGP.IPv4Address.IP, "node " + nodeName + " BGP address"
+	} else {
+		logger.Debugf("Node %s has no BGP IPv4 address", nodeName)
+	}
+	r, err := metadata.NewResolver(conf.finderConfig())
+	if err != nil {
+		logger.Debugf("No self host for the gateway: %v", err)
+		return nil, ""
+	}
+	host, err := r.SelfHost(conf.SelfHostPaths)
+	if err != nil {
+		logger.Debugf("No self host for the gateway: %v", err)
+		return nil, ""
+	}
+	ip, err := metadata.ParseIP(host.AgentIP)
+	if err != nil || ip.To4() == nil {
+		logger.Debugf("Self host %s has no IPv4 agent IP %q", host.UUID, host.AgentIP)
+		return nil, ""
+	}
+	return ip, "rancher host " + host.UUID + " agent IP"
+}
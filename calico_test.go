@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/client"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// fakeCalico is a Calico client over fake stores, for tests that run an
+// ADD end to end. A nil store panics when used.
+type fakeCalico struct {
+	ipam      *fakeIPAM
+	pools     *fakePools
+	nodes     *fakeNodes
+	endpoints *fakeEndpoints
+}
+
+func (f *fakeCalico) IPAM() client.IPAMInterface                          { return f.ipam }
+func (f *fakeCalico) IPPools() client.IPPoolInterface                     { return f.pools }
+func (f *fakeCalico) Nodes() client.NodeInterface                         { return f.nodes }
+func (f *fakeCalico) WorkloadEndpoints() client.WorkloadEndpointInterface { return f.endpoints }
+
+// useFakeCalico makes ADDs use calico until the returned function is
+// called.
+func useFakeCalico(calico *fakeCalico) func() {
+	saved := connectCalico
+	connectCalico = func(NetConf) (calicoAPI, error) { return calico, nil }
+	return func() { connectCalico = saved }
+}
+
+// runAdd runs an ADD with the netconf fields in netconf, a JSON object
+// body without braces, against the metadata service at url. args, if
+// not nil, are the arguments of the ADD, otherwise it is of container
+// ctr-1. It returns the results printed and the error.
+func runAdd(url, netconf string, args *skel.CmdArgs) ([]interface{}, error) {
+	data := fmt.Sprintf(`{"name": "test", "type": "rancher-calico-ipam", "metadataURL": %q`, url)
+	if netconf != "" {
+		data += ", " + netconf
+	}
+	if args == nil {
+		args = &skel.CmdArgs{ContainerID: "ctr-1", Netns: "/var/run/netns/ctr-1", IfName: "eth0"}
+	}
+	args.StdinData = []byte(data + "}")
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return nil, err
+	}
+	results, restore := captureResults()
+	defer restore()
+	err = cmdAdd(conf, args)
+	return *results, err
+}
+
+// fakePools is a Calico pool store holding the pools of the given CIDRs.
+type fakePools struct {
+	client.IPPoolInterface
+	cidrs []string
+}
+
+func (f *fakePools) List(metadata api.IPPoolMetadata) (*api.IPPoolList, error) {
+	list := &api.IPPoolList{}
+	for _, cidr := range f.cidrs {
+		_, n, err := cnet.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, api.IPPool{Metadata: api.IPPoolMetadata{CIDR: *n}})
+	}
+	return list, nil
+}
+
+func (f *fakePools) Get(metadata api.IPPoolMetadata) (*api.IPPool, error) {
+	for _, cidr := range f.cidrs {
+		if cidr == metadata.CIDR.String() {
+			return &api.IPPool{Metadata: metadata}, nil
+		}
+	}
+	return nil, errors.ErrorResourceDoesNotExist{Identifier: metadata}
+}
+
+func TestCheckPoolCIDR(t *testing.T) {
+	pools := &fakePools{cidrs: []string{"10.42.0.0/16", "10.43.0.0/16"}}
+	tests := []struct {
+		name     string
+		poolCIDR string
+		ip       string
+		wantErr  bool
+	}{
+		{name: "in pool", poolCIDR: "10.42.0.0/16", ip: "10.42.0.5"},
+		{name: "in another pool", poolCIDR: "10.43.0.0/16", ip: "10.42.0.5", wantErr: true},
+		{name: "no such pool", poolCIDR: "10.44.0.0/16", ip: "10.44.0.5", wantErr: true},
+		{name: "not a CIDR", poolCIDR: "default-pool", ip: "10.42.0.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := checkPoolCIDR(pools, tt.poolCIDR, calicoIP(tt.ip).IP)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkPoolCIDR() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// fakeNodes is a Calico node store whose node gets its BGP spec once it
+// has been read readyAfter times, or never if readyAfter is negative.
+type fakeNodes struct {
+	client.NodeInterface
+	readyAfter int
+	// bgpIPv4, if set, is the BGP IPv4 address of a ready node.
+	bgpIPv4 string
+	gets    int
+}
+
+func (f *fakeNodes) Get(metadata api.NodeMetadata) (*api.Node, error) {
+	f.gets++
+	node := &api.Node{Metadata: metadata}
+	if f.readyAfter >= 0 && f.gets > f.readyAfter {
+		node.Spec.BGP = &api.NodeBGPSpec{}
+		if f.bgpIPv4 != "" {
+			ip := calicoIP(f.bgpIPv4)
+			node.Spec.BGP.IPv4Address = &ip
+		}
+	}
+	return node, nil
+}
+
+func TestWaitForNode(t *testing.T) {
+	tests := []struct {
+		name       string
+		readyAfter int
+		wantErr    bool
+		wantSleeps int
+	}{
+		{name: "ready", readyAfter: 0},
+		{name: "ready after two polls", readyAfter: 2, wantSleeps: 2},
+		{name: "never ready", readyAfter: -1, wantErr: true, wantSleeps: 5},
+	}
+	for _, tt := range tests {
+		fake, restore := useFakeClock()
+		nodes := &fakeNodes{readyAfter: tt.readyAfter}
+		err := waitForNode(nodes, NetConf{Hostname: "node-1"}, 2*time.Second, testLogger())
+		restore()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: waitForNode() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if n := len(fake.Sleeps()); n != tt.wantSleeps {
+			t.Errorf("%s: %d polls waited, want %d", tt.name, n, tt.wantSleeps)
+		}
+	}
+}
+
+func TestNoPoolPolicy(t *testing.T) {
+	tests := []struct {
+		policy     string
+		wantErr    bool
+		wantRoutes []string
+	}{
+		{policy: noPoolReject, wantErr: true},
+		{policy: ""},
+		{policy: noPoolAssumeHostPrefix},
+		{policy: noPoolCreateHostRoute, wantRoutes: []string{"10.50.0.5/32"}},
+	}
+	for _, tt := range tests {
+		_, ts := newFakeMetadata(metadataContainer("ctr-1", "uuid-1", "10.50.0.5"))
+		ipam := &fakeIPAM{}
+		restore := useFakeCalico(&fakeCalico{ipam: ipam, pools: &fakePools{cidrs: []string{"10.42.0.0/16"}}})
+		results, err := runAdd(ts.URL, fmt.Sprintf(`"poolPrefix": true, "noPoolPolicy": %q`, tt.policy), nil)
+		restore()
+		ts.Close()
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "not in any configured Calico IP pool") {
+				t.Errorf("%q: cmdAdd() error = %v, want the address rejected", tt.policy, err)
+			}
+			continue
+		}
+		if err != nil || len(results) != 1 {
+			t.Errorf("%q: cmdAdd() = %v, %v, want one result", tt.policy, results, err)
+			continue
+		}
+		r := results[0].(*result020)
+		if got := r.IP4.IP.String(); got != "10.50.0.5/32" {
+			t.Errorf("%q: address %s, want 10.50.0.5/32", tt.policy, got)
+		}
+		var routes []string
+		for _, route := range r.IP4.Routes {
+			routes = append(routes, route.Dst.String())
+		}
+		if !reflect.DeepEqual(routes, tt.wantRoutes) {
+			t.Errorf("%q: routes %v, want %v", tt.policy, routes, tt.wantRoutes)
+		}
+		// Calico IPAM cannot hold an address of no pool.
+		if len(ipam.handles) != 0 {
+			t.Errorf("%q: assigned %v in Calico IPAM, want nothing", tt.policy, ipam.handles)
+		}
+	}
+}
+
+func TestPoolPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		ip         string
+		poolPrefix bool
+		want       string
+		wantAssign bool
+	}{
+		{name: "pool prefix", ip: "10.42.0.5", poolPrefix: true, want: "10.42.0.5/16", wantAssign: true},
+		{name: "IPv6 pool prefix", ip: "fd00::5", poolPrefix: true, want: "fd00::5/64", wantAssign: true},
+		{name: "no pool", ip: "10.50.0.5", poolPrefix: true, want: "10.50.0.5/32"},
+		{name: "IPv6 no pool", ip: "fd01::5", poolPrefix: true, want: "fd01::5/128"},
+		{name: "host prefix", ip: "10.42.0.5", want: "10.42.0.5/32", wantAssign: true},
+	}
+	for _, tt := range tests {
+		_, ts := newFakeMetadata(metadataContainer("ctr-1", "uuid-1", tt.ip))
+		ipam := &fakeIPAM{}
+		restore := useFakeCalico(&fakeCalico{ipam: ipam, pools: &fakePools{cidrs: []string{"10.42.0.0/16", "fd00::/64"}}})
+		results, err := runAdd(ts.URL, fmt.Sprintf(`"poolPrefix": %v`, tt.poolPrefix), nil)
+		restore()
+		ts.Close()
+		if err != nil || len(results) != 1 {
+			t.Errorf("%s: cmdAdd() = %v, %v, want one result", tt.name, results, err)
+			continue
+		}
+		r := results[0].(*result020)
+		ipc := r.IP4
+		if ipc == nil {
+			ipc = r.IP6
+		}
+		if ipc == nil || ipc.IP.String() != tt.want {
+			t.Errorf("%s: result %+v, want %s", tt.name, r.Result, tt.want)
+		}
+		if assigned := len(ipam.handles["ctr-1"]) == 1; assigned != tt.wantAssign {
+			t.Errorf("%s: assigned in Calico IPAM %v, want %v", tt.name, assigned, tt.wantAssign)
+		}
+	}
+}
+
+func TestNodeGateway(t *testing.T) {
+	tests := []struct {
+		name     string
+		bgpIPv4  string
+		agentIP  string
+		wantGW   string
+		wantDsts []string
+	}{
+		{name: "node BGP address", bgpIPv4: "192.168.0.10", agentIP: "192.168.0.20", wantGW: "192.168.0.10", wantDsts: []string{"0.0.0.0/0"}},
+		{name: "agent IP", agentIP: "192.168.0.20", wantGW: "192.168.0.20", wantDsts: []string{"0.0.0.0/0"}},
+		{name: "no node address"},
+	}
+	for _, tt := range tests {
+		m, ts := newFakeMetadata(metadataContainer("ctr-1", "uuid-1", "10.42.0.5"))
+		if tt.agentIP != "" {
+			m.selfHost = map[string]string{"uuid": "host-1", "agent_ip": tt.agentIP}
+		}
+		restore := useFakeCalico(&fakeCalico{ipam: &fakeIPAM{}, pools: &fakePools{cidrs: []string{"10.42.0.0/16"}}, nodes: &fakeNodes{bgpIPv4: tt.bgpIPv4}})
+		results, err := runAdd(ts.URL, `"hostname": "node-1", "nodeGateway": true`, nil)
+		restore()
+		ts.Close()
+		if err != nil || len(results) != 1 {
+			t.Errorf("%s: cmdAdd() = %v, %v, want one result", tt.name, results, err)
+			continue
+		}
+		r := results[0].(*result020)
+		gw := ""
+		if r.IP4.Gateway != nil {
+			gw = r.IP4.Gateway.String()
+		}
+		if gw != tt.wantGW {
+			t.Errorf("%s: gateway %q, want %q", tt.name, gw, tt.wantGW)
+		}
+		if dsts := routeDsts(r.Result); !reflect.DeepEqual(dsts, tt.wantDsts) {
+			t.Errorf("%s: routes to %v, want %v", tt.name, dsts, tt.wantDsts)
+		}
+		for _, route := range r.IP4.Routes {
+			if !route.GW.Equal(r.IP4.Gateway) {
+				t.Errorf("%s: route %s via %s, want via the gateway", tt.name, route.Dst.String(), route.GW)
+			}
+		}
+	}
+}
+
+func TestSetNodeGatewayReplaces(t *testing.T) {
+	_, ts := newFakeMetadata()
+	defer ts.Close()
+	tests := []struct {
+		name    string
+		bgpIPv4 string
+		wantGW  string
+	}{
+		{name: "node address", bgpIPv4: "192.168.0.10", wantGW: "192.168.0.10"},
+		{name: "no node address", wantGW: "10.42.0.1"},
+	}
+	for _, tt := range tests {
+		_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+		_, subnet, _ := net.ParseCIDR("10.43.0.0/16")
+		derived := net.ParseIP("10.42.0.1").To4()
+		r := testResult("10.42.0.5")
+		r.IP4.Gateway = derived
+		r.IP4.Routes = []types.Route{{Dst: *defaultNet, GW: derived}, {Dst: *subnet}}
+		conf := NetConf{MetadataURL: ts.URL}
+		conf.Hostname = "node-1"
+		setNodeGateway(&fakeCalico{nodes: &fakeNodes{bgpIPv4: tt.bgpIPv4}}, conf, r, testLogger())
+		if got := r.IP4.Gateway.String(); got != tt.wantGW {
+			t.Errorf("%s: gateway %s, want %s", tt.name, got, tt.wantGW)
+		}
+		var routes []string
+		for _, route := range r.IP4.Routes {
+			routes = append(routes, fmt.Sprintf("%s via %v", route.Dst.String(), route.GW))
+		}
+		want := []string{"10.43.0.0/16 via <nil>", "0.0.0.0/0 via " + tt.wantGW}
+		if tt.bgpIPv4 == "" {
+			want = []string{"0.0.0.0/0 via 10.42.0.1", "10.43.0.0/16 via <nil>"}
+		}
+		if !reflect.DeepEqual(routes, want) {
+			t.Errorf("%s: routes %v, want %v", tt.name, routes, want)
+		}
+	}
+}
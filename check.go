@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/projectcalico/calico-cni/utils"
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+)
+
+// defaultCheckTimeout bounds a CHECK unless checkTimeoutMs is set. A CHECK
+// is meant to be quick, so it does not get the polling budget of an ADD.
+const defaultCheckTimeout = 5 * time.Second
+
+// runCheck reads a CHECK invocation from the environment and stdin, as
+// skel does for ADD and DEL, and runs cmdCheck.
+func runCheck() error {
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	return withSummary("CHECK", cmdCheck)(&skel.CmdArgs{
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Args:        os.Getenv("CNI_ARGS"),
+		Path:        os.Getenv("CNI_PATH"),
+		StdinData:   stdinData,
+	})
+}
+
+// cmdCheck confirms that the addresses Rancher metadata lists for the
+// container are those the ADD returned, as passed back in prevResult. It
+// fails if metadata does not yield them within checkTimeoutMs.
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	utils.ConfigureLogging(conf.LogLevel)
+	configureLogFile()
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("CHECK requires the prevResult of the ADD")
+	}
+	expected, err := prevResultIPs(*conf.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	ipamArgs := ipamArgs{}
+	if err = loadIPAMArgs(conf, args, &ipamArgs); err != nil {
+		return err
+	}
+	if ipamArgs.IP != nil {
+		// An explicit IP was not resolved from metadata, so there is
+		// nothing to confirm there.
+		return checkExpected(expected, []net.IP{ipamArgs.IP})
+	}
+
+	ips, err := resolveWithin(conf, args, string(ipamArgs.RancherContainerUUID))
+	if failedWith(err, ipfinder.ErrAutoAssign) {
+		// The container was assigned from Calico IPAM, so metadata
+		// holds no address to confirm.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return checkExpected(expected, ips)
+}
+
+// resolveWithin resolves the container addresses from metadata, failing
+// once the CHECK timeout has passed. A wedged metadata request may ignore
+// the finder timeouts, so the lookup itself is abandoned on timeout,
+// which is harmless in a process that exits right after.
+func resolveWithin(conf NetConf, args *skel.CmdArgs, rancherid string) ([]net.IP, error) {
+	timeout := defaultCheckTimeout
+	if conf.CheckTimeoutMs > 0 {
+		timeout = time.Duration(conf.CheckTimeoutMs) * time.Millisecond
+	}
+	config := conf.finderConfig()
+	config.ConnectTimeout = timeout
+	config.PollTimeout = timeout
+
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		nets, _, err := resolveContainer(conf, config, "", args.ContainerID, rancherid, false)
+		var ips []net.IP
+		for _, n := range nets {
+			ips = append(ips, n.IP)
+		}
+		if !failedWith(err, ipfinder.ErrAutoAssign) {
+			err = cniError(err)
+		}
+		done <- result{ips, err}
+	}()
+	select {
+	case r := <-done:
+		return r.ips, r.err
+	case <-time.After(timeout):
+		return nil, &types.Error{Code: errCodeTryAgainLater, Msg: fmt.Sprintf("rancher metadata did not confirm the address within %v", timeout)}
+	}
+}
+
+// checkExpected fails unless every address in ips is among expected.
+func checkExpected(expected, ips []net.IP) error {
+	if len(ips) == 0 {
+		return fmt.Errorf("rancher metadata has no address for the container")
+	}
+	for _, ip := range ips {
+		if !containsIP(expected, ip) {
+			return fmt.Errorf("address %s is not in the ADD result", ip.String())
+		}
+	}
+	log.Debugf("rancher-calico-ipam: CHECK confirmed %v", ips)
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// prevResultIPs returns the addresses of a prevResult in either the 0.3.x
+// or the 0.2.0 layout.
+func prevResultIPs(data json.RawMessage) ([]net.IP, error) {
+	var ips []net.IP
+	r030 := &result030{}
+	if err := json.Unmarshal(data, r030); err != nil {
+		return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+	}
+	for _, ip := range r030.IPs {
+		ips = append(ips, ip.Address.IP)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	r020 := &types.Result{}
+	if err := json.Unmarshal(data, r020); err != nil {
+		return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+	}
+	if r020.IP4 != nil {
+		ips = append(ips, r020.IP4.IP.IP)
+	}
+	if r020.IP6 != nil {
+		ips = append(ips, r020.IP6.IP.IP)
+	}
+	return ips, nil
+}
+
+// dieErr prints err as a CNI error and exits, as skel does for ADD and
+// DEL.
+func dieErr(err error) {
+	e, ok := err.(*types.Error)
+	if !ok {
+		e = &types.Error{Code: 100, Msg: err.Error()}
+	}
+	if printErr := e.Print(); printErr != nil {
+		log.Errorf("rancher-calico-ipam: error writing error JSON to stdout: %v", printErr)
+	}
+	os.Exit(1)
+}
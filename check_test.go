@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		prevResult string
+		slow       bool
+		wantErr    string
+		wantCode   uint
+	}{
+		{name: "confirmed", prevResult: `{"cniVersion": "0.3.1", "ips": [{"version": "4", "address": "10.42.0.5/32"}]}`},
+		{name: "confirmed 0.2.0", prevResult: `{"ip4": {"ip": "10.42.0.5/32"}}`},
+		{name: "other address", prevResult: `{"ip4": {"ip": "10.42.0.6/32"}}`, wantErr: "not in the ADD result"},
+		{name: "no prevResult", wantErr: "requires the prevResult"},
+		{name: "slow metadata", prevResult: `{"ip4": {"ip": "10.42.0.5/32"}}`, slow: true, wantCode: errCodeTryAgainLater},
+	}
+	for _, tt := range tests {
+		m, ts := newFakeMetadata(metadataContainer("ctr-1", "uuid-1", "10.42.0.5"))
+		if tt.slow {
+			m.hold = make(chan struct{})
+		}
+		netconf := fmt.Sprintf(`{"name": "test", "type": "rancher-calico-ipam", "metadataURL": %q, "checkTimeoutMs": 100`, ts.URL)
+		if tt.prevResult != "" {
+			netconf += `, "prevResult": ` + tt.prevResult
+		}
+		err := cmdCheck(&skel.CmdArgs{ContainerID: "ctr-1", StdinData: []byte(netconf + "}")})
+		if tt.slow {
+			close(m.hold)
+		}
+		ts.Close()
+
+		switch {
+		case tt.wantCode != 0:
+			if e, ok := err.(*types.Error); !ok || e.Code != tt.wantCode {
+				t.Errorf("%s: cmdCheck() error = %v, want code %d", tt.name, err, tt.wantCode)
+			}
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: cmdCheck() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: cmdCheck() error = %v", tt.name, err)
+		}
+	}
+}
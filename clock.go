@@ -0,0 +1,8 @@
+package main
+
+import "github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+
+// clock is the source of time for the deadlines, polls and backoff of
+// the plugin and of its metadata lookups, so that tests can replace it
+// with a metadata.FakeClock.
+var clock metadata.Clock = metadata.RealClock{}
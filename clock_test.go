@@ -0,0 +1,16 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+)
+
+// useFakeClock makes clock a fake one until the returned function is
+// called.
+func useFakeClock() (*metadata.FakeClock, func()) {
+	fake := metadata.NewFakeClock(time.Unix(0, 0))
+	saved := clock
+	clock = fake
+	return fake, func() { clock = saved }
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/hex"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/calico-cni/utils"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/backend"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/client"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/satori/go.uuid"
+)
+
+// newBackend connects to the Calico datastore for initClusterDefaults.
+var newBackend = func(config api.CalicoAPIConfig) (bapi.Client, error) {
+	return backend.NewClient(config)
+}
+
+// newClusterGUID generates the ClusterGUID initClusterDefaults sets. It
+// is a variable so that tests can make the GUID deterministic.
+var newClusterGUID = func() string {
+	return hex.EncodeToString(uuid.NewV4().Bytes())
+}
+
+// connectCalico returns the Calico client of an ADD, from
+// newCalicoClient. It is a variable so that tests can run an ADD against
+// fakes.
+var connectCalico = func(conf NetConf) (calicoAPI, error) {
+	calicoClient, err := newCalicoClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	return calicoClient, nil
+}
+
+// newCalicoClient returns the Calico client of an ADD. With
+// initClusterDefaults set it also initializes the cluster defaults, whose
+// failure is only logged: the defaults matter to calico-node, not to the
+// assignment.
+func newCalicoClient(conf NetConf) (*client.Client, error) {
+	calicoClient, err := utils.CreateClient(conf.NetConf)
+	if err != nil || !conf.InitClusterDefaults {
+		return calicoClient, err
+	}
+	// CreateClient has exported the datastore settings of conf, which
+	// the config is loaded from.
+	config, err := client.LoadClientConfig("")
+	if err == nil {
+		var b bapi.Client
+		if b, err = newBackend(*config); err == nil {
+			err = initClusterDefaults(b)
+		}
+	}
+	if err != nil {
+		log.Warnf("rancher-calico-ipam: failed to initialize the Calico cluster defaults: %v", err)
+	}
+	return calicoClient, nil
+}
+
+// initClusterDefaults sets the Calico Ready flag and ClusterGUID unless
+// they are already set, as the vendored client does when a node is
+// created, so that a datastore first written by the plugin is complete.
+// Keys that exist, as set by calico-node or a concurrent ADD, are left
+// unchanged and are not an error.
+func initClusterDefaults(b bapi.Client) error {
+	for _, kv := range []*model.KVPair{
+		{Key: model.ReadyFlagKey{}, Value: true},
+		{Key: model.GlobalConfigKey{Name: "ClusterGUID"}, Value: newClusterGUID()},
+	} {
+		if _, err := b.Create(kv); err != nil {
+			if _, ok := err.(errors.ErrorResourceAlreadyExists); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+// fakeBackend is a Calico datastore keeping its keys in memory.
+type fakeBackend struct {
+	bapi.Client
+	mu  sync.Mutex
+	kvs map[model.Key]interface{}
+	// fail, if set, fails every Create.
+	fail error
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{kvs: map[model.Key]interface{}{}}
+}
+
+func (f *fakeBackend) Create(kv *model.KVPair) (*model.KVPair, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail != nil {
+		return nil, f.fail
+	}
+	if _, ok := f.kvs[kv.Key]; ok {
+		return nil, errors.ErrorResourceAlreadyExists{Identifier: kv.Key}
+	}
+	f.kvs[kv.Key] = kv.Value
+	return kv, nil
+}
+
+var clusterGUIDKey = model.GlobalConfigKey{Name: "ClusterGUID"}
+
+// fixedClusterGUID makes newClusterGUID return guid until the returned
+// function is called.
+func fixedClusterGUID(guid string) func() {
+	saved := newClusterGUID
+	newClusterGUID = func() string { return guid }
+	return func() { newClusterGUID = saved }
+}
+
+func TestInitClusterDefaults(t *testing.T) {
+	defer fixedClusterGUID("generated")()
+	tests := []struct {
+		name     string
+		existing map[model.Key]interface{}
+		fail     error
+		wantErr  bool
+		wantGUID interface{}
+	}{
+		{name: "empty datastore", wantGUID: "generated"},
+		{
+			name:     "initialized datastore",
+			existing: map[model.Key]interface{}{model.ReadyFlagKey{}: true, clusterGUIDKey: "existing"},
+			wantGUID: "existing",
+		},
+		{
+			name:     "GUID only",
+			existing: map[model.Key]interface{}{clusterGUIDKey: "existing"},
+			wantGUID: "existing",
+		},
+		{name: "datastore failure", fail: errors.ErrorDatastoreError{Err: fmt.Errorf("etcd unavailable")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		b := newFakeBackend()
+		for k, v := range tt.existing {
+			b.kvs[k] = v
+		}
+		b.fail = tt.fail
+		err := initClusterDefaults(b)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: initClusterDefaults() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if b.kvs[model.ReadyFlagKey{}] != true {
+			t.Errorf("%s: Ready flag = %v, want true", tt.name, b.kvs[model.ReadyFlagKey{}])
+		}
+		if guid := b.kvs[clusterGUIDKey]; guid != tt.wantGUID {
+			t.Errorf("%s: ClusterGUID = %q, want %q", tt.name, guid, tt.wantGUID)
+		}
+	}
+}
+
+func TestNewCalicoClientInitClusterDefaults(t *testing.T) {
+	guids := []string{"first", "second"}
+	saved := newClusterGUID
+	defer func() { newClusterGUID = saved }()
+	newClusterGUID = func() string {
+		guid := guids[0]
+		guids = guids[1:]
+		return guid
+	}
+	b := newFakeBackend()
+	savedBackend := newBackend
+	defer func() { newBackend = savedBackend }()
+	newBackend = func(api.CalicoAPIConfig) (bapi.Client, error) { return b, nil }
+
+	conf := NetConf{InitClusterDefaults: true}
+	conf.Name = "rancher"
+	// The second setup, as of a concurrent or later ADD, must neither
+	// fail nor change what the first one set.
+	for i := 0; i < 2; i++ {
+		if _, err := newCalicoClient(conf); err != nil {
+			t.Fatalf("newCalicoClient() #%d error = %v", i+1, err)
+		}
+		if guid := b.kvs[clusterGUIDKey]; guid != "first" {
+			t.Errorf("ClusterGUID after setup #%d = %v, want first", i+1, guid)
+		}
+	}
+
+	newBackend = func(api.CalicoAPIConfig) (bapi.Client, error) { return nil, fmt.Errorf("no datastore") }
+	if _, err := newCalicoClient(conf); err != nil {
+		t.Errorf("newCalicoClient() without a datastore error = %v, want it only logged", err)
+	}
+}
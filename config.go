@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/projectcalico/calico-cni/utils"
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+)
+
+// NetConf is the Calico network config extended with the settings
+// understood by rancher-calico-ipam.
+type NetConf struct {
+	utils.NetConf
+	// CNIVersion selects the result layout; 0.3.x adds interfaces.
+	CNIVersion string `json:"cniVersion"`
+	// PrevResult is the result of the previous plugin when chained.
+	PrevResult *json.RawMessage `json:"prevResult"`
+	// HostUUID limits the metadata lookup to containers on this Rancher host.
+	HostUUID string `json:"hostUUID"`
+	// AutoAssignLabel names a container label that, set to "auto",
+	// makes the ADD allocate from Calico IPAM instead of reading the
+	// container's IP from metadata.
+	AutoAssignLabel string `json:"autoAssignLabel"`
+	// AllowForeignHost accepts a metadata container scheduled on another
+	// host than this one, which is rejected by default as a likely id
+	// collision.
+	AllowForeignHost bool `json:"allowForeignHost"`
+	// MaxScan caps how many metadata containers are examined per poll.
+	MaxScan int `json:"maxScan"`
+	// TargetedLookupThreshold switches polls from scanning the container
+	// list to fetching the container by its RancherContainerUUID once the
+	// list holds more containers than this.
+	TargetedLookupThreshold int `json:"targetedLookupThreshold"`
+	// ReadyStates lists the container lifecycle and health states in
+	// which its metadata IP is trusted, such as ["running", "healthy"]. A
+	// health state left out, such as "unhealthy", keeps the IP of such a
+	// container from being used.
+	ReadyStates []string `json:"readyStates"`
+	// AddLock serializes concurrent ADDs of one container, waiting at most
+	// AddLockTimeoutMs; an ADD that waited for a successful one returns
+	// its result.
+	AddLock          bool `json:"addLock"`
+	AddLockTimeoutMs int  `json:"addLockTimeoutMs"`
+	// CacheLabels stores the metadata labels of the container alongside
+	// the result cached under AddLock, for label-aware cleanup.
+	CacheLabels bool `json:"cacheLabels"`
+	// AddRetries is how many times an ADD failing with a transient
+	// error is retried, with backoff.
+	AddRetries int `json:"addRetries"`
+	// DefaultArgs is used in place of CNI_ARGS when the runtime passes
+	// none, as in "IgnoreUnknown=1;RancherServiceName=web".
+	DefaultArgs string `json:"defaultArgs"`
+	// FailurePolicy is closed (the default) or open. When metadata is
+	// unreachable, closed fails the ADD while open returns the fallback
+	// IP, if configured, or else an empty result.
+	FailurePolicy string `json:"failurePolicy"`
+	// DeriveFromID assigns an address hashed from the container id into
+	// DeriveRange when metadata and the fallbacks offer none. It is meant
+	// for stateless test setups only.
+	DeriveFromID bool   `json:"deriveFromID"`
+	DeriveRange  string `json:"deriveRange"`
+	// Finder selects where container IPs are looked up: metadata (the
+	// default) or api, the Rancher API configured in RancherAPI, for
+	// hosts that cannot reach the metadata service. Both poll under the
+	// same settings, such as pollStrategy, readyStates and hostUUID.
+	Finder string `json:"finder"`
+	// StrictArgs rejects CNI_ARGS that set both IP and RancherContainerUUID
+	// instead of letting the explicit IP win.
+	StrictArgs bool `json:"strictArgs"`
+	// FallbackIP is assigned when metadata resolves no IP for the container.
+	// It is a single address, so only one container on the network can hold
+	// it at a time: the assignment of any other fails until it is released.
+	// Prefer FallbackRange unless at most one container can fall back.
+	FallbackIP string `json:"fallbackIP"`
+	// FallbackRange is a Calico pool CIDR to allocate from when metadata
+	// resolves no IP for the container. FallbackIP takes precedence.
+	FallbackRange string `json:"fallbackRange"`
+	// ClaimAffinity claims the Calico block of a provided IP for this host
+	// before assigning it.
+	ClaimAffinity bool `json:"claimAffinity"`
+	// InitClusterDefaults sets the Calico Ready flag and ClusterGUID on ADD
+	// if the datastore lacks them, for clusters where the plugin may write
+	// to the datastore before calico-node has started.
+	InitClusterDefaults bool `json:"initClusterDefaults"`
+	// PoolCIDR, when set, is the CIDR of the Calico pool a provided IP must
+	// belong to. Calico v1 pools have no name, so the CIDR identifies one.
+	PoolCIDR string `json:"poolCIDR"`
+	// StrictImmediate fails the ADD after a single metadata refresh if the
+	// container is absent or has no IP, instead of polling.
+	StrictImmediate bool `json:"strictImmediate"`
+	// MetadataRateLimit caps metadata calls per second across all plugin
+	// processes on the node. Zero disables the limit.
+	MetadataRateLimit float64 `json:"metadataRateLimit"`
+	// RancherAPI holds the credentials for features that need the
+	// writable Rancher API rather than read-only metadata.
+	RancherAPI RancherAPIConf `json:"rancherAPI"`
+	// ReportIPLabel, when set, is the container label the assigned IP is
+	// written back to through the Rancher API.
+	ReportIPLabel string `json:"reportIPLabel"`
+	// VerifyAddress enters the container netns after assignment and warns
+	// if the address is not configured on the interface. IPAM normally
+	// runs before the main plugin creates the interface, so this only
+	// checks anything when the interface is already there, as when the
+	// plugin runs after the main plugin in a chain.
+	VerifyAddress bool `json:"verifyAddress"`
+	// SkipConfiguredIP enters the container netns before assignment and,
+	// if the resolved IP is already on the interface, treats the ADD as a
+	// retry and skips the Calico assignment. On a first ADD the main
+	// plugin has not created the interface yet, so the IP is assigned.
+	SkipConfiguredIP bool `json:"skipConfiguredIP"`
+	// TrustExistingIP enters the container netns before the metadata
+	// lookup and, if the interface already has a routable address,
+	// returns it as the result without a metadata lookup or assignment.
+	// IPAM normally runs before the main plugin creates the interface,
+	// so this only applies to a retried ADD or a netns prepared
+	// beforehand; otherwise the lookup proceeds as usual.
+	TrustExistingIP bool `json:"trustExistingIP"`
+	// MetadataURL is the base URL of the metadata service, for one served
+	// elsewhere than at the Rancher link-local address or over https.
+	// MetadataCAFile is the CA bundle verifying an https service, and
+	// MetadataInsecure skips the verification.
+	MetadataURL      string `json:"metadataURL"`
+	MetadataCAFile   string `json:"metadataCAFile"`
+	MetadataInsecure bool   `json:"metadataInsecure"`
+	// MetadataVersion selects the Rancher metadata API version.
+	MetadataVersion string `json:"metadataVersion"`
+	// MetadataVersions lists further metadata API versions whose
+	// containers are looked up too, for mixed-version upgrades.
+	MetadataVersions []string `json:"metadataVersions"`
+	// MetadataRequestRetries is how many times a failed metadata request
+	// is retried within one poll, 2 by default; -1 disables the retries.
+	MetadataRequestRetries int `json:"metadataRequestRetries"`
+	// MetadataMaxStalenessMs rejects metadata responses older than this,
+	// as served by a caching proxy, by their Age or Last-Modified header.
+	// Zero accepts any age.
+	MetadataMaxStalenessMs int `json:"metadataMaxStalenessMs"`
+	// ConnectTimeoutMs bounds the wait for the metadata service to answer
+	// before polling begins.
+	ConnectTimeoutMs int `json:"connectTimeoutMs"`
+	// MetadataRequestTimeoutMs bounds each metadata request. Zero means
+	// 20s.
+	MetadataRequestTimeoutMs int `json:"metadataRequestTimeoutMs"`
+	// PollStrategy sets how the wait between metadata polls grows:
+	// fixed (default), linear or exponential.
+	PollStrategy string `json:"pollStrategy"`
+	// PollIntervalMs is the initial wait between metadata polls.
+	PollIntervalMs int `json:"pollIntervalMs"`
+	// MaxPollIntervalMs caps the wait of a growing poll strategy.
+	MaxPollIntervalMs int `json:"maxPollIntervalMs"`
+	// IPConfirmations is how many consecutive polls must agree on the
+	// container IP before it is used.
+	IPConfirmations int `json:"ipConfirmations"`
+	// PollLogSampleRate logs 1 in this many waiting messages.
+	PollLogSampleRate int `json:"pollLogSampleRate"`
+	// IdentityFields lists the metadata container fields matched against
+	// the container ids, in order.
+	IdentityFields []string `json:"identityFields"`
+	// NormalizeSteps lists the trim, lowercase and stripPrefix steps
+	// applied, in order, to ids before matching; trim by default.
+	// StripPrefixes are the prefixes stripPrefix removes.
+	NormalizeSteps []string `json:"normalizeSteps"`
+	StripPrefixes  []string `json:"stripPrefixes"`
+	// WatchMetadata rescans metadata when it changes instead of at every
+	// poll interval, where the service supports it.
+	WatchMetadata bool `json:"watchMetadata"`
+	// ServiceVIP assigns the VIP of the Rancher service named by the
+	// RancherServiceName CNI_ARGS key instead of a container IP.
+	ServiceVIP bool `json:"serviceVIP"`
+	// SkipUnmanaged returns an empty result, instead of polling, for a
+	// container whose UnmanagedLabel is "true".
+	SkipUnmanaged  bool   `json:"skipUnmanaged"`
+	UnmanagedLabel string `json:"unmanagedLabel"`
+	// NetnsInodeLabel enables the experimental last-resort match of the
+	// netns inode against this container label.
+	NetnsInodeLabel string `json:"netnsInodeLabel"`
+	// SkipNoNetns returns an empty result at once, without a metadata
+	// lookup, when the ADD comes without a real network namespace.
+	SkipNoNetns bool `json:"skipNoNetns"`
+	// HostRoutePrefix sets the prefix length of the result address per
+	// family, /32 and /128 by default.
+	HostRoutePrefix HostRoutePrefixConf `json:"hostRoutePrefix"`
+	// PrefixField names the metadata container field, such as
+	// Labels.<key>, holding the prefix length of the container's subnet.
+	// It takes precedence over PoolPrefix and HostRoutePrefix.
+	PrefixField string `json:"prefixField"`
+	// PoolPrefix reports the result address with the prefix length of
+	// its Calico IP pool instead of HostRoutePrefix.
+	PoolPrefix bool `json:"poolPrefix"`
+	// NoPoolPolicy is reject, assumeHostPrefix (the default) or
+	// createHostRoute and handles, under PoolPrefix, an address in no
+	// Calico pool. Unless it is reject, such an address is used without
+	// a Calico IPAM assignment, which only pools allow.
+	NoPoolPolicy string `json:"noPoolPolicy"`
+	// IPFamilyPreference is ipv4, ipv6 or dual and selects among the
+	// container's metadata addresses; dual assigns one of each family.
+	// Empty keeps the primary IP.
+	IPFamilyPreference string `json:"ipFamilyPreference"`
+	// ExpectedFamily, ipv4 or ipv6, rejects a metadata address of the
+	// other family instead of assigning it.
+	ExpectedFamily string `json:"expectedFamily"`
+	// AddressSelector is primary, first-available, label or family and
+	// sets how the address is picked from the container's metadata.
+	// Empty means family under ipFamilyPreference, else primary.
+	// AddressLabel is the container label read by the label selector.
+	AddressSelector string `json:"addressSelector"`
+	AddressLabel    string `json:"addressLabel"`
+	// NodeGateway routes the container via the BGP IPv4 address of the
+	// local Calico node, or else the agent IP of the Rancher host,
+	// replacing any other gateway.
+	NodeGateway bool `json:"nodeGateway"`
+	// WaitForNode holds the assignment until the local Calico node exists
+	// with its BGP spec, for at most NodeReadyTimeoutMs (5s by default).
+	WaitForNode        bool `json:"waitForNode"`
+	NodeReadyTimeoutMs int  `json:"nodeReadyTimeoutMs"`
+	// OnLinkRoute adds a route without gateway for the subnet of the
+	// result address, as set by HostRoutePrefix.
+	OnLinkRoute bool `json:"onLinkRoute"`
+	// UsableRangeRoutes adds on-link routes covering the usable addresses
+	// of the result subnet, when its prefix is shorter than a host
+	// route. For IPv4 they leave out the network and broadcast addresses.
+	UsableRangeRoutes bool `json:"usableRangeRoutes"`
+	// AllowHostNetwork assigns the metadata IP of a host-networked
+	// container, which is the host IP, instead of failing the ADD.
+	AllowHostNetwork bool `json:"allowHostNetwork"`
+	// NodeNameFromMetadata sets the Calico node name, when Hostname is
+	// unset, to that of the Rancher host in metadata. SelfHostPaths lists
+	// the metadata paths tried for the host record, /self/host by default.
+	NodeNameFromMetadata bool     `json:"nodeNameFromMetadata"`
+	SelfHostPaths        []string `json:"selfHostPaths"`
+	// InterfaceAlias sets the alias of the container interface to the
+	// Rancher UUID of the container, where the interface already exists.
+	// IPAM normally runs before the main plugin creates the interface, so
+	// this only applies to a plugin chained after the main plugin or to a
+	// netns prepared beforehand.
+	InterfaceAlias bool `json:"interfaceAlias"`
+	// PodEvents records the assigned IP as an event on the pod named in
+	// CNI_ARGS, using the in-cluster service account.
+	PodEvents bool `json:"podEvents"`
+	// ResultSocket is the path of a Unix socket to which the result of
+	// every ADD is also sent, for a supervising agent.
+	ResultSocket string `json:"resultSocket"`
+	// PartialResults lets an ADD under ipFamilyPreference dual go on
+	// with a single family resolved from metadata when the prevResult of
+	// the chain supplies the other.
+	PartialResults bool `json:"partialResults"`
+	// MaxResultIPs and MaxResultRoutes cap the addresses and routes of
+	// the result, 16 and 64 by default. The excess is dropped with a
+	// warning.
+	MaxResultIPs    int `json:"maxResultIPs"`
+	MaxResultRoutes int `json:"maxResultRoutes"`
+	// CheckTimeoutMs bounds the metadata lookup of a CHECK, 5s by
+	// default.
+	CheckTimeoutMs int `json:"checkTimeoutMs"`
+	// EndpointListRetries is how many times the release subcommands
+	// retry a failed workload endpoint list, 2 by default; -1 disables
+	// the retries.
+	EndpointListRetries int `json:"endpointListRetries"`
+	// ConfirmRelease makes a DEL wait until Calico no longer lists the
+	// released address, for at most ConfirmReleaseTimeoutMs (2s by
+	// default).
+	ConfirmRelease          bool `json:"confirmRelease"`
+	ConfirmReleaseTimeoutMs int  `json:"confirmReleaseTimeoutMs"`
+}
+
+// RancherAPIConf locates and authenticates against the Rancher API.
+type RancherAPIConf struct {
+	URL       string `json:"url"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+}
+
+// HostRoutePrefixConf holds the result prefix lengths. Zero keeps the
+// host-route default of the family.
+type HostRoutePrefixConf struct {
+	IPv4Prefix int `json:"ipv4Prefix"`
+	IPv6Prefix int `json:"ipv6Prefix"`
+}
+
+// ipNet returns ip with the prefix length configured for its family.
+func (p HostRoutePrefixConf) ipNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(prefixOr(p.IPv4Prefix, 32), 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(prefixOr(p.IPv6Prefix, 128), 128)}
+}
+
+// prefixOr returns prefix, or def if prefix is unset.
+func prefixOr(prefix, def int) int {
+	if prefix > 0 {
+		return prefix
+	}
+	return def
+}
+
+// validate checks that both prefix lengths fit their family.
+func (p HostRoutePrefixConf) validate() error {
+	if p.IPv4Prefix < 0 || p.IPv4Prefix > 32 {
+		return fmt.Errorf("invalid hostRoutePrefix ipv4Prefix %d", p.IPv4Prefix)
+	}
+	if p.IPv6Prefix < 0 || p.IPv6Prefix > 128 {
+		return fmt.Errorf("invalid hostRoutePrefix ipv6Prefix %d", p.IPv6Prefix)
+	}
+	return nil
+}
+
+const (
+	// cacheDirEnv overrides where node-wide plugin state is kept.
+	cacheDirEnv     = "CNI_CACHE_DIR"
+	defaultCacheDir = "/var/lib/cni/cache"
+)
+
+// Finders selectable with the finder setting.
+const (
+	finderMetadata = "metadata"
+	finderAPI      = "api"
+)
+
+// Failure policies for an unreachable metadata service.
+const (
+	failurePolicyClosed = "closed"
+	failurePolicyOpen   = "open"
+)
+
+// defaultUnmanagedLabel marks containers skipped under skipUnmanaged
+// unless another label is configured.
+const defaultUnmanagedLabel = "io.rancher.calico-ipam.unmanaged"
+
+// debugDirEnv names the directory receiving debug artifacts of failed
+// lookups when logging at debug level.
+const debugDirEnv = "CNI_DEBUG_DIR"
+
+// cacheDir returns the directory for node-wide plugin state.
+func cacheDir() string {
+	if dir := os.Getenv(cacheDirEnv); dir != "" {
+		return dir
+	}
+	return defaultCacheDir
+}
+
+// finderConfig returns the metadata finder settings derived from conf.
+func (conf NetConf) finderConfig() metadata.Config {
+	config := metadata.Config{
+		Clock:                   clock,
+		HostUUID:                conf.HostUUID,
+		MaxScan:                 conf.MaxScan,
+		TargetedLookupThreshold: conf.TargetedLookupThreshold,
+		RequestRetries:          conf.MetadataRequestRetries,
+		MaxStaleness:            time.Duration(conf.MetadataMaxStalenessMs) * time.Millisecond,
+		ReadyStates:             conf.ReadyStates,
+		MetadataRoot:            conf.MetadataURL,
+		CAFile:                  conf.MetadataCAFile,
+		Insecure:                conf.MetadataInsecure,
+		MetadataVersion:         conf.MetadataVersion,
+		MetadataVersions:        conf.MetadataVersions,
+		ConnectTimeout:          time.Duration(conf.ConnectTimeoutMs) * time.Millisecond,
+		RequestTimeout:          time.Duration(conf.MetadataRequestTimeoutMs) * time.Millisecond,
+		ReadyFile:               os.Getenv(readyFileEnv),
+		PollStrategy:            conf.PollStrategy,
+		PollInterval:            time.Duration(conf.PollIntervalMs) * time.Millisecond,
+		MaxPollInterval:         time.Duration(conf.MaxPollIntervalMs) * time.Millisecond,
+		Confirmations:           conf.IPConfirmations,
+		PollLogSampleRate:       conf.PollLogSampleRate,
+		IdentityFields:          conf.IdentityFields,
+		NormalizeSteps:          conf.NormalizeSteps,
+		StripPrefixes:           conf.StripPrefixes,
+		WatchChanges:            conf.WatchMetadata,
+		PrefixField:             conf.PrefixField,
+		FamilyPreference:        conf.IPFamilyPreference,
+		AllowHostNetwork:        conf.AllowHostNetwork,
+		CheckHost:               !conf.AllowForeignHost,
+		AutoAssignLabel:         conf.AutoAssignLabel,
+	}
+	if conf.AddressSelector != "" {
+		// validate has already rejected a selector that fails here.
+		config.AddressSelector, _ = metadata.NewAddressSelector(conf.AddressSelector, conf.AddressLabel, conf.IPFamilyPreference)
+	}
+	if strings.EqualFold(conf.LogLevel, "debug") {
+		config.DebugDir = os.Getenv(debugDirEnv)
+	}
+	if conf.SkipUnmanaged {
+		config.UnmanagedLabel = conf.UnmanagedLabel
+		if config.UnmanagedLabel == "" {
+			config.UnmanagedLabel = defaultUnmanagedLabel
+		}
+	}
+	if conf.MetadataRateLimit > 0 {
+		config.RateLimitFile = filepath.Join(cacheDir(), "rancher-calico-ipam-metadata.rate")
+		config.RateLimitInterval = time.Duration(float64(time.Second) / conf.MetadataRateLimit)
+	}
+	return config
+}
+
+// validate checks the plugin settings of conf before any work is done,
+// returning the first problem found.
+func (conf NetConf) validate() error {
+	if problems := conf.problems(); len(problems) > 0 {
+		return problems[0]
+	}
+	return nil
+}
+
+// problems returns everything validate objects to.
+func (conf NetConf) problems() []error {
+	var problems []error
+	if err := metadata.ValidatePollStrategy(conf.PollStrategy); err != nil {
+		problems = append(problems, err)
+	}
+	if err := metadata.ValidateIdentityFields(conf.IdentityFields); err != nil {
+		problems = append(problems, err)
+	}
+	if err := metadata.ValidateNormalizeSteps(conf.NormalizeSteps); err != nil {
+		problems = append(problems, err)
+	}
+	if conf.PrefixField != "" {
+		if err := metadata.ValidateField(conf.PrefixField); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if err := metadata.ValidateFamilyPreference(conf.IPFamilyPreference); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := metadata.NewAddressSelector(conf.AddressSelector, conf.AddressLabel, conf.IPFamilyPreference); err != nil {
+		problems = append(problems, err)
+	}
+	if conf.FallbackIP != "" && net.ParseIP(conf.FallbackIP) == nil {
+		problems = append(problems, fmt.Errorf("invalid fallbackIP %q", conf.FallbackIP))
+	}
+	if conf.FallbackRange != "" {
+		if _, _, err := net.ParseCIDR(conf.FallbackRange); err != nil {
+			problems = append(problems, fmt.Errorf("invalid fallbackRange %q: %v", conf.FallbackRange, err))
+		}
+	}
+	if conf.DeriveFromID {
+		if _, _, err := net.ParseCIDR(conf.DeriveRange); err != nil {
+			problems = append(problems, fmt.Errorf("invalid deriveRange %q: %v", conf.DeriveRange, err))
+		}
+	}
+	if conf.MetadataURL != "" {
+		u, err := url.Parse(conf.MetadataURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, fmt.Errorf("invalid metadataURL %q", conf.MetadataURL))
+		}
+	}
+	switch conf.NoPoolPolicy {
+	case "", noPoolReject, noPoolAssumeHostPrefix, noPoolCreateHostRoute:
+	default:
+		problems = append(problems, fmt.Errorf("invalid noPoolPolicy %q", conf.NoPoolPolicy))
+	}
+	switch conf.Finder {
+	case "", finderMetadata:
+	case finderAPI:
+		if conf.RancherAPI.URL == "" {
+			problems = append(problems, fmt.Errorf("finder api requires rancherAPI.url"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("invalid finder %q", conf.Finder))
+	}
+	switch conf.FailurePolicy {
+	case "", failurePolicyClosed, failurePolicyOpen:
+	default:
+		problems = append(problems, fmt.Errorf("invalid failurePolicy %q", conf.FailurePolicy))
+	}
+	switch conf.ExpectedFamily {
+	case "", metadata.FamilyIPv4, metadata.FamilyIPv6:
+	default:
+		problems = append(problems, fmt.Errorf("invalid expectedFamily %q", conf.ExpectedFamily))
+	}
+	if conf.ExpectedFamily != "" && conf.IPFamilyPreference == metadata.FamilyDual {
+		problems = append(problems, fmt.Errorf("expectedFamily %s conflicts with ipFamilyPreference dual", conf.ExpectedFamily))
+	}
+	if err := conf.HostRoutePrefix.validate(); err != nil {
+		problems = append(problems, err)
+	}
+	return problems
+}
+
+// envRefRegexp matches "$$" and "${VAR}" references in netconf strings.
+var envRefRegexp = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// loadNetConf decodes the netconf passed on stdin with decodeNetConf and
+// validates it.
+func loadNetConf(data []byte) (NetConf, error) {
+	conf, err := decodeNetConf(data)
+	if err != nil {
+		return conf, err
+	}
+	if err := conf.validate(); err != nil {
+		return conf, fmt.Errorf("invalid netconf: %v", err)
+	}
+	return conf, nil
+}
+
+// decodeNetConf decodes a netconf without validating it. Before the
+// config is decoded, every string value in it (at any depth, e.g.
+// hostname or etcd_endpoints) has ${VAR} references replaced from the
+// environment so one template can serve all nodes. "$$" yields a literal
+// "$", any other "$" is left untouched, and a reference to an unset
+// variable is an error.
+func decodeNetConf(data []byte) (NetConf, error) {
+	conf := NetConf{}
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return conf, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	raw, err := substituteEnv(raw)
+	if err != nil {
+		return conf, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if data, err = json.Marshal(raw); err != nil {
+		return conf, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return conf, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	return conf, nil
+}
+
+// substituteEnv expands environment references in all strings of a
+// decoded JSON value.
+func substituteEnv(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case string:
+		var err error
+		expanded := envRefRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+			if ref == "$$" {
+				return "$"
+			}
+			name := ref[2 : len(ref)-1]
+			env, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("undefined environment variable %q in %q", name, value)
+			}
+			return env
+		})
+		return expanded, err
+	case map[string]interface{}:
+		for k, item := range value {
+			expanded, err := substituteEnv(item)
+			if err != nil {
+				return nil, err
+			}
+			value[k] = expanded
+		}
+	case []interface{}:
+		for i, item := range value {
+			expanded, err := substituteEnv(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = expanded
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    NetConf
+		wantErr string
+	}{
+		{name: "no fallback"},
+		{name: "fallbackIP", conf: NetConf{FallbackIP: "10.42.0.5"}},
+		{name: "IPv6 fallbackIP", conf: NetConf{FallbackIP: "fd00::5"}},
+		{name: "fallbackRange", conf: NetConf{FallbackRange: "10.42.128.0/24"}},
+		{name: "bad fallbackIP", conf: NetConf{FallbackIP: "10.42.0"}, wantErr: "invalid fallbackIP"},
+		{name: "fallbackIP with prefix", conf: NetConf{FallbackIP: "10.42.0.5/32"}, wantErr: "invalid fallbackIP"},
+		{name: "bad fallbackRange", conf: NetConf{FallbackRange: "10.42.128.0"}, wantErr: "invalid fallbackRange"},
+	}
+	for _, tt := range tests {
+		err := tt.conf.validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: validate() error = %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: validate() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadNetConfEnv(t *testing.T) {
+	os.Setenv("RANCHER_IPAM_TEST_NODE", "node-1")
+	defer os.Unsetenv("RANCHER_IPAM_TEST_NODE")
+	os.Unsetenv("RANCHER_IPAM_TEST_UNSET")
+	tests := []struct {
+		name         string
+		netconf      string
+		wantHostname string
+		wantEtcd     string
+		wantErr      string
+	}{
+		{
+			name:         "expanded",
+			netconf:      `{"name": "rancher", "hostname": "${RANCHER_IPAM_TEST_NODE}", "etcd_endpoints": "http://${RANCHER_IPAM_TEST_NODE}:2379"}`,
+			wantHostname: "node-1",
+			wantEtcd:     "http://node-1:2379",
+		},
+		{
+			name:         "literal dollars",
+			netconf:      `{"name": "rancher", "hostname": "$$RANCHER_IPAM_TEST_NODE", "etcd_endpoints": "$RANCHER_IPAM_TEST_NODE"}`,
+			wantHostname: "$RANCHER_IPAM_TEST_NODE",
+			wantEtcd:     "$RANCHER_IPAM_TEST_NODE",
+		},
+		{
+			name:    "undefined",
+			netconf: `{"name": "rancher", "ipam": {"hosts": ["${RANCHER_IPAM_TEST_UNSET}"]}}`,
+			wantErr: `undefined environment variable "RANCHER_IPAM_TEST_UNSET"`,
+		},
+	}
+	for _, tt := range tests {
+		conf, err := loadNetConf([]byte(tt.netconf))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: loadNetConf() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: loadNetConf() error = %v", tt.name, err)
+			continue
+		}
+		if conf.Hostname != tt.wantHostname || conf.EtcdEndpoints != tt.wantEtcd {
+			t.Errorf("%s: hostname %q and etcd_endpoints %q, want %q and %q", tt.name, conf.Hostname, conf.EtcdEndpoints, tt.wantHostname, tt.wantEtcd)
+		}
+	}
+}
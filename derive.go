@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// deriveMaxProbes bounds how many addresses deriveIP tries past one taken
+// by the host.
+const deriveMaxProbes = 16
+
+// applyDerived stores in ipamArgs an address derived from the container
+// id within conf.DeriveRange, for test setups whose metadata has no IP.
+func applyDerived(conf NetConf, containerID string, ipamArgs *ipamArgs, logger *logrus.Entry) error {
+	_, cidr, err := net.ParseCIDR(conf.DeriveRange)
+	if err != nil {
+		return fmt.Errorf("invalid deriveRange %q: %v", conf.DeriveRange, err)
+	}
+	ip, err := deriveIP(cidr, containerID, hostAddrs())
+	if err != nil {
+		return err
+	}
+	logger.Warnf("No IP resolved from rancher metadata, using %s derived from the container id; not for production use", ip.String())
+	ipamArgs.IP = ip
+	return nil
+}
+
+// deriveIP hashes id to a host address of cidr, never its network or
+// broadcast address. An address in taken is skipped for the next one, so
+// the result is stable unless the host gains an address in the range.
+func deriveIP(cidr *net.IPNet, id string, taken []net.IP) (net.IP, error) {
+	ones, bits := cidr.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("deriveRange %s has no host addresses", cidr.String())
+	}
+	usable := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	usable.Sub(usable, big.NewInt(2))
+	sum := sha256.Sum256([]byte(id))
+	offset := new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), usable)
+
+	base := cidr.IP.Mask(cidr.Mask)
+	if bits == 32 {
+		base = base.To4()
+	}
+	for i := 0; i < deriveMaxProbes; i++ {
+		host := new(big.Int).Add(offset, big.NewInt(1))
+		ip := addOffset(base, host)
+		if !containsIP(taken, ip) {
+			return ip, nil
+		}
+		offset.Add(offset, big.NewInt(1))
+		offset.Mod(offset, usable)
+	}
+	return nil, fmt.Errorf("no free address for %s in deriveRange %s", id, cidr.String())
+}
+
+// addOffset returns base plus offset.
+func addOffset(base net.IP, offset *big.Int) net.IP {
+	sum := new(big.Int).Add(new(big.Int).SetBytes(base), offset).Bytes()
+	ip := make(net.IP, len(base))
+	copy(ip[len(ip)-len(sum):], sum)
+	return ip
+}
+
+// hostAddrs returns the addresses of the host's interfaces. Failing to
+// list them is treated as having none.
+func hostAddrs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logrus.Warnf("rancher-calico-ipam: cannot list host addresses: %v", err)
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDeriveIP(t *testing.T) {
+	_, range24, _ := net.ParseCIDR("10.99.0.0/24")
+	first, err := deriveIP(range24, "ctr-1", nil)
+	if err != nil || !range24.Contains(first) {
+		t.Fatalf("deriveIP() = %v, %v, want an address of %s", first, err, range24)
+	}
+	if again, err := deriveIP(range24, "ctr-1", nil); err != nil || !again.Equal(first) {
+		t.Errorf("deriveIP() again = %v, %v, want %s", again, err, first)
+	}
+	if next, err := deriveIP(range24, "ctr-1", []net.IP{first}); err != nil || next.Equal(first) || !range24.Contains(next) {
+		t.Errorf("deriveIP() with %s taken = %v, %v, want another address", first, next, err)
+	}
+
+	_, range30, _ := net.ParseCIDR("10.99.0.4/30")
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("ctr-%d", i)
+		ip, err := deriveIP(range30, id, nil)
+		if err != nil || !(ip.Equal(net.ParseIP("10.99.0.5")) || ip.Equal(net.ParseIP("10.99.0.6"))) {
+			t.Errorf("deriveIP(%s) = %v, %v, want a host address of %s", id, ip, err, range30)
+		}
+	}
+	if ip, err := deriveIP(range30, "ctr-1", []net.IP{net.ParseIP("10.99.0.5"), net.ParseIP("10.99.0.6")}); err == nil {
+		t.Errorf("deriveIP() with every address taken = %v, want an error", ip)
+	}
+
+	for _, cidr := range []string{"10.99.0.4/31", "10.99.0.4/32", "fd00::/127", "fd00::/128"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		if ip, err := deriveIP(n, "ctr-1", nil); err == nil {
+			t.Errorf("deriveIP() in %s = %v, want an error", cidr, ip)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const redacted = "<redacted>"
+
+// configEnvVars are the environment variables that affect the plugin,
+// either directly or through the Calico client.
+var configEnvVars = []string{
+	"CNI_ARGS", readyFileEnv, cacheDirEnv, overridesFileEnv,
+	logFileEnv, logMaxSizeEnv, logMaxFilesEnv, debugDirEnv,
+	otlpEndpointEnv, otlpTracesEndpointEnv, metricsDirEnv, validateConfigEnv,
+	"DATASTORE_TYPE", "ETCD_AUTHORITY", "ETCD_ENDPOINTS", "ETCD_SCHEME",
+	"ETCD_KEY_FILE", "ETCD_CERT_FILE", "ETCD_CA_CERT_FILE",
+	"KUBECONFIG", "K8S_API_ENDPOINT", "K8S_API_TOKEN",
+}
+
+// secretEnvVars are never printed verbatim.
+var secretEnvVars = map[string]bool{
+	"K8S_API_TOKEN": true,
+}
+
+// printEffectiveConfig reads the netconf from stdin like an ADD would
+// and prints the configuration the plugin would run with as JSON. Any
+// credentials are redacted.
+func printEffectiveConfig() error {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	conf, err := loadNetConf(data)
+	if err != nil {
+		return err
+	}
+
+	if conf.RancherAPI.AccessKey != "" {
+		conf.RancherAPI.AccessKey = redacted
+	}
+	if conf.RancherAPI.SecretKey != "" {
+		conf.RancherAPI.SecretKey = redacted
+	}
+	if conf.Policy.K8sAuthToken != "" {
+		conf.Policy.K8sAuthToken = redacted
+	}
+
+	nodeName, err := localNodeName(conf)
+	if err != nil {
+		return err
+	}
+
+	env := map[string]string{}
+	for _, name := range configEnvVars {
+		if value, ok := os.LookupEnv(name); ok {
+			if secretEnvVars[name] {
+				value = redacted
+			}
+			env[name] = value
+		}
+	}
+
+	finder := conf.finderConfig()
+	effective := map[string]interface{}{
+		"netconf":     conf,
+		"env":         env,
+		"nodeName":    nodeName,
+		"metadataURL": finder.URL(),
+		"finder": map[string]interface{}{
+			"hostUUID":                finder.HostUUID,
+			"readyStates":             finder.ReadyStates,
+			"maxScan":                 finder.MaxScan,
+			"targetedLookupThreshold": finder.TargetedLookupThreshold,
+			"requestRetries":          finder.RequestRetries,
+			"maxStaleness":            finder.MaxStaleness.String(),
+			"caFile":                  finder.CAFile,
+			"insecure":                finder.Insecure,
+			"metadataVersions":        finder.MetadataVersions,
+			"connectTimeout":          finder.ConnectTimeout.String(),
+			"requestTimeout":          finder.RequestTimeout.String(),
+			"pollStrategy":            finder.PollStrategy,
+			"pollTimeout":             finder.PollTimeout.String(),
+			"pollInterval":            finder.PollInterval.String(),
+			"maxPollInterval":         finder.MaxPollInterval.String(),
+			"rateLimitFile":           finder.RateLimitFile,
+			"rateLimitInterval":       finder.RateLimitInterval.String(),
+			"confirmations":           finder.Confirmations,
+			"pollLogSampleRate":       finder.PollLogSampleRate,
+			"identityFields":          finder.IdentityFields,
+			"normalizeSteps":          finder.NormalizeSteps,
+			"stripPrefixes":           finder.StripPrefixes,
+			"watchChanges":            finder.WatchChanges,
+			"unmanagedLabel":          finder.UnmanagedLabel,
+			"debugDir":                finder.DebugDir,
+			"prefixField":             finder.PrefixField,
+			"familyPreference":        finder.FamilyPreference,
+			"addressSelector":         fmt.Sprintf("%T", finder.AddressSelector),
+			"allowHostNetwork":        finder.AllowHostNetwork,
+			"checkHost":               finder.CheckHost,
+			"autoAssignLabel":         finder.AutoAssignLabel,
+		},
+	}
+	out, err := json.MarshalIndent(effective, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// serviceAccountDir holds the in-cluster credentials of the service
+// account the plugin runs as.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+const eventTimeout = 2 * time.Second
+
+// kubeEvent is the subset of a Kubernetes v1 Event sent by emitPodEvent.
+type kubeEvent struct {
+	APIVersion     string            `json:"apiVersion"`
+	Kind           string            `json:"kind"`
+	Metadata       map[string]string `json:"metadata"`
+	InvolvedObject map[string]string `json:"involvedObject"`
+	Reason         string            `json:"reason"`
+	Message        string            `json:"message"`
+	Type           string            `json:"type"`
+	Source         map[string]string `json:"source"`
+	FirstTimestamp string            `json:"firstTimestamp"`
+	LastTimestamp  string            `json:"lastTimestamp"`
+	Count          int               `json:"count"`
+}
+
+// emitPodEvent records the assigned IP and where it came from as an
+// IPAssigned event on the pod named in CNI_ARGS, so that it shows in
+// kubectl describe pod. It authenticates with the in-cluster service
+// account. Failures are logged and never fail the ADD.
+func emitPodEvent(conf NetConf, ipamArgs *ipamArgs, r *types.Result, source *ipSource, logger *log.Entry) {
+	if !conf.PodEvents {
+		return
+	}
+	name, namespace := string(ipamArgs.K8S_POD_NAME), string(ipamArgs.K8S_POD_NAMESPACE)
+	if name == "" || namespace == "" {
+		logger.Debug("podEvents is set but CNI_ARGS names no pod, not emitting an event")
+		return
+	}
+	var ips []string
+	for _, ipc := range []*types.IPConfig{r.IP4, r.IP6} {
+		if ipc != nil {
+			ips = append(ips, ipc.IP.IP.String())
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+	from := "calico ipam"
+	if source != nil {
+		from = source.MetadataURL
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	event := kubeEvent{
+		APIVersion:     "v1",
+		Kind:           "Event",
+		Metadata:       map[string]string{"generateName": name + ".", "namespace": namespace},
+		InvolvedObject: map[string]string{"apiVersion": "v1", "kind": "Pod", "name": name, "namespace": namespace},
+		Reason:         "IPAssigned",
+		Message:        fmt.Sprintf("Assigned %s from %s", strings.Join(ips, ", "), from),
+		Type:           "Normal",
+		Source:         map[string]string{"component": "rancher-calico-ipam", "host": conf.Hostname},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if err := postEvent(namespace, event); err != nil {
+		logger.Warnf("Failed to emit pod event: %v", err)
+		return
+	}
+	logger.WithField("pod", namespace+"/"+name).Debug("Emitted pod event")
+}
+
+// postEvent creates event through the API server of the cluster the
+// plugin runs in.
+func postEvent(namespace string, event kubeEvent) error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	target := fmt.Sprintf("https://%s/api/v1/namespaces/%s/events", net.JoinHostPort(host, port), namespace)
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	c := &http.Client{
+		Timeout:   eventTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Error %v creating event in namespace %s", resp.StatusCode, namespace)
+	}
+	return nil
+}
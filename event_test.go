@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// fakeAPIServer records the events posted to it and answers with status.
+type fakeAPIServer struct {
+	mu     sync.Mutex
+	status int
+	paths  []string
+	auth   []string
+	events []kubeEvent
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var event kubeEvent
+	json.NewDecoder(r.Body).Decode(&event)
+	f.paths = append(f.paths, r.URL.Path)
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	f.events = append(f.events, event)
+	w.WriteHeader(f.status)
+}
+
+// useFakeAPIServer points the in-cluster configuration at a TLS server
+// for api until the returned function is called.
+func useFakeAPIServer(t *testing.T, api *fakeAPIServer) func() {
+	ts := httptest.NewTLSServer(api)
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	os.Setenv("KUBERNETES_SERVICE_HOST", host)
+	os.Setenv("KUBERNETES_SERVICE_PORT", port)
+	saved := serviceAccountDir
+	serviceAccountDir = dir
+	return func() {
+		serviceAccountDir = saved
+		os.Unsetenv("KUBERNETES_SERVICE_HOST")
+		os.Unsetenv("KUBERNETES_SERVICE_PORT")
+		os.RemoveAll(dir)
+		ts.Close()
+	}
+}
+
+func TestEmitPodEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		conf       NetConf
+		pod        string
+		source     *ipSource
+		status     int
+		wantPosted bool
+		wantFrom   string
+	}{
+		{name: "disabled", pod: "web-0", status: http.StatusCreated},
+		{name: "no pod", conf: NetConf{PodEvents: true}, status: http.StatusCreated},
+		{name: "from metadata", conf: NetConf{PodEvents: true}, pod: "web-0", source: &ipSource{MetadataURL: "http://rancher-metadata"}, status: http.StatusCreated, wantPosted: true, wantFrom: "http://rancher-metadata"},
+		{name: "from Calico IPAM", conf: NetConf{PodEvents: true}, pod: "web-0", status: http.StatusCreated, wantPosted: true, wantFrom: "calico ipam"},
+		{name: "rejected", conf: NetConf{PodEvents: true}, pod: "web-0", status: http.StatusForbidden, wantPosted: true, wantFrom: "calico ipam"},
+	}
+	for _, tt := range tests {
+		api := &fakeAPIServer{status: tt.status}
+		restore := useFakeAPIServer(t, api)
+		tt.conf.Hostname = "node-1"
+		args := &ipamArgs{K8S_POD_NAME: types.UnmarshallableString(tt.pod), K8S_POD_NAMESPACE: "default"}
+		emitPodEvent(tt.conf, args, testResult("10.42.0.5"), tt.source, testLogger())
+		restore()
+		if posted := len(api.events) == 1; posted != tt.wantPosted {
+			t.Errorf("%s: posted %d events, want posted %v", tt.name, len(api.events), tt.wantPosted)
+			continue
+		}
+		if !tt.wantPosted {
+			continue
+		}
+		event := api.events[0]
+		if api.paths[0] != "/api/v1/namespaces/default/events" || api.auth[0] != "Bearer secret-token" {
+			t.Errorf("%s: posted to %s with %q", tt.name, api.paths[0], api.auth[0])
+		}
+		if want := "Assigned 10.42.0.5 from " + tt.wantFrom; event.Reason != "IPAssigned" || event.Message != want {
+			t.Errorf("%s: event %s %q, want IPAssigned %q", tt.name, event.Reason, event.Message, want)
+		}
+		if event.InvolvedObject["name"] != "web-0" || event.InvolvedObject["namespace"] != "default" || event.Source["host"] != "node-1" {
+			t.Errorf("%s: event about %v from %v", tt.name, event.InvolvedObject, event.Source)
+		}
+	}
+}
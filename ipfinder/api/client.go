@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+// Container is the subset of a Rancher API container resource used by
+// the plugin.
+type Container struct {
+	ID               string            `json:"id"`
+	UUID             string            `json:"uuid"`
+	Name             string            `json:"name"`
+	ExternalID       string            `json:"externalId"`
+	PrimaryIPAddress string            `json:"primaryIpAddress"`
+	State            string            `json:"state"`
+	HealthState      string            `json:"healthState"`
+	HostID           string            `json:"hostId"`
+	Labels           map[string]string `json:"labels"`
+	Links            map[string]string `json:"links"`
+}
+
+// Host is the subset of a Rancher API host resource used by the plugin.
+type Host struct {
+	ID   string `json:"id"`
+	UUID string `json:"uuid"`
+}
+
+type containerCollection struct {
+	Data []Container `json:"data"`
+}
+
+// Client is a minimal client for the Rancher API, authenticated with an
+// API key pair.
+type Client struct {
+	url       string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+// NewClient returns a Client for the Rancher API at apiURL, for example
+// http://rancher:8080/v2-beta/projects/1a5.
+func NewClient(apiURL, accessKey, secretKey string) *Client {
+	return &Client{
+		url:       apiURL,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		http:      &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// FindContainers returns the containers matching the given field filters,
+// e.g. {"uuid": "..."} or {"externalId": "..."}.
+func (c *Client) FindContainers(filters map[string]string) ([]Container, error) {
+	query := url.Values{}
+	for k, v := range filters {
+		query.Set(k, v)
+	}
+	var collection containerCollection
+	if err := c.do("GET", c.url+"/containers?"+query.Encode(), nil, &collection); err != nil {
+		return nil, err
+	}
+	return collection.Data, nil
+}
+
+// GetHost returns the host with the given id.
+func (c *Client) GetHost(id string) (Host, error) {
+	var host Host
+	err := c.do("GET", c.url+"/hosts/"+url.PathEscape(id), nil, &host)
+	return host, err
+}
+
+// SetLabel sets a label on the given container, keeping its other labels.
+func (c *Client) SetLabel(container Container, key, value string) error {
+	self := container.Links["self"]
+	if self == "" {
+		self = c.url + "/containers/" + container.ID
+	}
+	labels := map[string]string{}
+	for k, v := range container.Labels {
+		labels[k] = v
+	}
+	labels[key] = value
+	return c.do("PUT", self, map[string]interface{}{"labels": labels}, nil)
+}
+
+func (c *Client) do(method, target string, body, out interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/json")
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	if c.accessKey != "" {
+		req.SetBasicAuth(c.accessKey, c.secretKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Error %v accessing %v", resp.StatusCode, target)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	rancher "github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+)
+
+// NewIPFinderFromAPI returns an ipfinder.IPFinder backed by the Rancher
+// API, for hosts from which the metadata service cannot be reached. It
+// is the metadata finder over a Source, so it polls, matches and filters
+// containers under config as that finder does.
+func NewIPFinderFromAPI(config metadata.Config, apiURL, accessKey, secretKey string) ipfinder.IPFinder {
+	return metadata.NewIPFinderFromSource(config, NewSource(apiURL, accessKey, secretKey))
+}
+
+// Source is a metadata.ContainerSource listing containers from the
+// Rancher API.
+type Source struct {
+	client *Client
+	// hostUUIDs caches the UUID of each host id seen, as the API names
+	// the host of a container by id while metadata uses its UUID.
+	hostUUIDs map[string]string
+}
+
+// NewSource returns a Source querying the Rancher API at apiURL with the
+// given API key pair.
+func NewSource(apiURL, accessKey, secretKey string) *Source {
+	return &Source{client: NewClient(apiURL, accessKey, secretKey), hostUUIDs: map[string]string{}}
+}
+
+// Containers returns the containers with Rancher UUID rancherid or, if
+// that is empty, with Docker id cid. A comma-separated rancherid is
+// looked up one UUID at a time.
+func (s *Source) Containers(cid, rancherid string) ([]metadata.SourceContainer, error) {
+	var filters []map[string]string
+	for _, uuid := range splitIDs(rancherid) {
+		filters = append(filters, map[string]string{"uuid": uuid})
+	}
+	if len(filters) == 0 {
+		filters = append(filters, map[string]string{"externalId": cid})
+	}
+	var listed []metadata.SourceContainer
+	for _, filter := range filters {
+		containers, err := s.client.FindContainers(filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range containers {
+			hostUUID, err := s.hostUUID(c.HostID)
+			if err != nil {
+				return nil, err
+			}
+			listed = append(listed, metadata.SourceContainer{
+				Container: rancher.Container{
+					Name:        c.Name,
+					PrimaryIp:   c.PrimaryIPAddress,
+					Labels:      c.Labels,
+					HostUUID:    hostUUID,
+					UUID:        c.UUID,
+					HealthState: c.HealthState,
+					ExternalId:  c.ExternalID,
+				},
+				State: c.State,
+			})
+		}
+	}
+	return listed, nil
+}
+
+// hostUUID returns the UUID of the host with id hostID, or "" if hostID
+// is empty, as for a container not scheduled yet.
+func (s *Source) hostUUID(hostID string) (string, error) {
+	if hostID == "" {
+		return "", nil
+	}
+	if uuid, ok := s.hostUUIDs[hostID]; ok {
+		return uuid, nil
+	}
+	host, err := s.client.GetHost(hostID)
+	if err != nil {
+		return "", fmt.Errorf("cannot get host %s: %v", hostID, err)
+	}
+	s.hostUUIDs[hostID] = host.UUID
+	return host.UUID, nil
+}
+
+// splitIDs splits a comma-separated list of ids, dropping empty ones.
+func splitIDs(ids string) []string {
+	var split []string
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			split = append(split, id)
+		}
+	}
+	return split
+}
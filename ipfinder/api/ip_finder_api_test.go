@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+)
+
+// fakeAPI is a Rancher API serving containers and hosts from memory.
+type fakeAPI struct {
+	mu         sync.Mutex
+	containers []Container
+	hosts      map[string]string
+	// fail makes every request fail with a server error.
+	fail bool
+	// lists counts the container requests served, and beforeList, if
+	// set, runs under mu before the n-th one, counting from 1.
+	lists      int
+	beforeList func(n int)
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case r.URL.Path == "/containers":
+		f.lists++
+		if f.beforeList != nil {
+			f.beforeList(f.lists)
+		}
+		query := r.URL.Query()
+		var data []Container
+		for _, c := range f.containers {
+			if uuid := query.Get("uuid"); uuid != "" && c.UUID != uuid {
+				continue
+			}
+			if id := query.Get("externalId"); id != "" && c.ExternalID != id {
+				continue
+			}
+			data = append(data, c)
+		}
+		json.NewEncoder(w).Encode(containerCollection{Data: data})
+	case strings.HasPrefix(r.URL.Path, "/hosts/"):
+		id := strings.TrimPrefix(r.URL.Path, "/hosts/")
+		uuid, ok := f.hosts[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(Host{ID: id, UUID: uuid})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestIPFinderFromAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api-finder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	readyFile := filepath.Join(dir, "ready")
+	web := Container{ID: "1i1", UUID: "uuid-web", ExternalID: "ctr-web", PrimaryIPAddress: "10.42.0.5", State: "running", HostID: "1h1"}
+	pending := Container{ID: "1i2", UUID: "uuid-pending", ExternalID: "ctr-pending", State: "running", HostID: "1h1"}
+	tests := []struct {
+		name       string
+		cid        string
+		rancherid  string
+		hostUUID   string
+		fail       bool
+		beforeList func(f *fakeAPI, n int)
+		wantIP     string
+		wantKind   error
+		wantLists  int
+	}{
+		{name: "by container id", cid: "ctr-web", wantIP: "10.42.0.5", wantLists: 1},
+		{name: "by rancher id", cid: "other", rancherid: "uuid-web", wantIP: "10.42.0.5", wantLists: 1},
+		{
+			name: "IP after the first poll",
+			cid:  "ctr-pending",
+			beforeList: func(f *fakeAPI, n int) {
+				if n == 2 {
+					f.containers[1].PrimaryIPAddress = "10.42.0.6"
+				}
+			},
+			wantIP:    "10.42.0.6",
+			wantLists: 2,
+		},
+		{name: "IP pending for the whole budget", cid: "ctr-pending", wantKind: ipfinder.ErrIPPending, wantLists: 11},
+		{name: "on another host", cid: "ctr-web", hostUUID: "host-2", wantKind: ipfinder.ErrContainerNotFound, wantLists: 11},
+		{name: "on this host", cid: "ctr-web", hostUUID: "host-1", wantIP: "10.42.0.5", wantLists: 1},
+		{name: "API failing", cid: "ctr-web", fail: true, wantKind: ipfinder.ErrMetadataUnreachable},
+	}
+	for _, tt := range tests {
+		f := &fakeAPI{containers: []Container{web, pending}, hosts: map[string]string{"1h1": "host-1"}, fail: tt.fail}
+		if tt.beforeList != nil {
+			f.beforeList = func(n int) { tt.beforeList(f, n) }
+		}
+		server := httptest.NewServer(f)
+		config := metadata.Config{
+			Clock:        metadata.NewFakeClock(time.Unix(0, 0)),
+			PollTimeout:  10 * time.Second,
+			PollInterval: time.Second,
+			HostUUID:     tt.hostUUID,
+			// The metadata service is never contacted, and its ready
+			// file is left alone.
+			MetadataRoot: "http://127.0.0.1:1",
+			ReadyFile:    readyFile,
+		}
+		ip, err := NewIPFinderFromAPI(config, server.URL, "access", "secret").GetIP(tt.cid, tt.rancherid)
+		server.Close()
+		if ip != tt.wantIP {
+			t.Errorf("%s: GetIP() = %q, want %q", tt.name, ip, tt.wantIP)
+		}
+		if tt.wantKind != nil && !errors.Is(err, tt.wantKind) {
+			t.Errorf("%s: GetIP() error = %v, want %v", tt.name, err, tt.wantKind)
+		}
+		if tt.wantKind == nil && err != nil {
+			t.Errorf("%s: GetIP() error = %v", tt.name, err)
+		}
+		if _, err := os.Stat(readyFile); !os.IsNotExist(err) {
+			t.Errorf("%s: the API finder touched the ready file", tt.name)
+		}
+		if f.lists != tt.wantLists {
+			t.Errorf("%s: %d container requests, want %d", tt.name, f.lists, tt.wantLists)
+		}
+	}
+}
@@ -1,6 +1,47 @@
 package ipfinder
 
+import (
+	"errors"
+	"fmt"
+)
+
 //IPFinder is used to get IP address given a container ID.
 type IPFinder interface {
-	GetIP(cid, rancherid string) string
+	GetIP(cid, rancherid string) (string, error)
+}
+
+// Causes of a failed lookup. Errors returned by an IPFinder are of type
+// *Error and unwrap to one of these, or are one of these when a finder is
+// configured to return bare sentinels.
+var (
+	ErrMetadataUnreachable = errors.New("metadata unreachable")
+	ErrContainerNotFound   = errors.New("container not found")
+	ErrIPPending           = errors.New("container has no IP yet")
+	ErrUnmanaged           = errors.New("container is not managed by this IPAM")
+	ErrHostNetwork         = errors.New("container uses host networking")
+	ErrForeignHost         = errors.New("container runs on another host")
+	ErrAutoAssign          = errors.New("container defers to Calico IPAM")
+)
+
+// Error describes why no IP was found for a container.
+type Error struct {
+	// Kind is one of the Err* causes above.
+	Kind      error
+	CID       string
+	RancherID string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%v for container %s (rancherid %q)", e.Kind, e.CID, e.RancherID)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the cause of the error.
+func (e *Error) Unwrap() error {
+	return e.Kind
 }
@@ -0,0 +1,294 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// StatusError is returned for a metadata response other than 200 OK. It
+// lets callers tell a service that is up but has no data yet (404) from
+// one that cannot be reached at all.
+type StatusError struct {
+	Code int
+	Path string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Error %v accessing %v path", e.Code, e.Path)
+}
+
+// StaleError is returned for a metadata response older than the
+// configured staleness threshold, as served by a caching proxy, or of
+// unknown age.
+type StaleError struct {
+	Path string
+	Age  time.Duration
+	// Unknown is set when the response carries no headers telling its
+	// age, and Age is then zero.
+	Unknown bool
+}
+
+func (e *StaleError) Error() string {
+	if e.Unknown {
+		return fmt.Sprintf("response for %v path is of unknown age", e.Path)
+	}
+	return fmt.Sprintf("response for %v path is %v old", e.Path, e.Age)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*StatusError)
+	return ok && e.Code == http.StatusNotFound
+}
+
+// client is a minimal Rancher metadata client. It speaks the same API as
+// the vendored go-rancher-metadata client and reuses its types, but
+// reports HTTP failures as *StatusError.
+type client struct {
+	url  string
+	http *http.Client
+	// clock times the connect backoff.
+	clock Clock
+	// schema decodes container lists. Nil means decodeContainers.
+	schema containerSchema
+	// maxAge, if set, rejects responses older than this.
+	maxAge time.Duration
+}
+
+func newClient(url string, httpClient *http.Client) *client {
+	return &client{url: url, http: httpClient, clock: RealClock{}}
+}
+
+// newClientAndWait returns a client for the endpoint of config once the
+// metadata service answers, retrying with the same backoff as
+// metadata.NewClientAndWait. A request to a wedged service can block
+// indefinitely, so the whole wait is bounded by the connect timeout. On
+// timeout the waiting goroutine is abandoned, which is harmless in a
+// process that exits after one lookup. The outcome is recorded in
+// config.ReadyFile.
+func newClientAndWait(config Config) (*client, error) {
+	httpClient, err := config.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.connectTimeout()
+	type result struct {
+		c   *client
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := waitForClient(config.URL(), httpClient, config.clock())
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		updateReadyFile(config.ReadyFile, r.err == nil)
+		return r.c, r.err
+	case <-time.After(timeout):
+		updateReadyFile(config.ReadyFile, false)
+		return nil, fmt.Errorf("metadata client did not become ready within %v", timeout)
+	}
+}
+
+// waitForClient is newClientAndWait without the timeout.
+func waitForClient(url string, httpClient *http.Client, clock Clock) (*client, error) {
+	c := newClient(url, httpClient)
+	c.clock = clock
+	var err error
+	for i := 1 * time.Second; i < 20*time.Second; i *= time.Duration(2) {
+		if _, err = c.getVersion(); err == nil {
+			return c, nil
+		}
+		clock.Sleep(i)
+	}
+	return nil, err
+}
+
+// recoverPanic turns a panic in a metadata call into an error in *err,
+// so that a malformed response cannot crash the plugin midway through a
+// CNI call. It must be deferred directly by the call it protects.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		log.Errorf("rancher-cni-ipam: recovered from panic in metadata client: %v\n%s", r, debug.Stack())
+		*err = fmt.Errorf("metadata client panicked: %v", r)
+	}
+}
+
+// sendRequest fetches path. A response older than c.maxAge, or of
+// unknown age, is fetched again bypassing caches, and if that is older
+// than c.maxAge too a *StaleError is returned. The response to the
+// uncached request is trusted when it does not tell its age.
+func (c *client) sendRequest(path string) (body []byte, err error) {
+	defer recoverPanic(&err)
+	body, err = c.fetch(path, false)
+	if stale, ok := err.(*StaleError); ok {
+		log.Debugf("rancher-cni-ipam: %v, fetching it again", stale)
+		body, err = c.fetch(path, true)
+	}
+	return body, err
+}
+
+func (c *client) fetch(path string, noCache bool) ([]byte, error) {
+	req, err := http.NewRequest("GET", c.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	if noCache {
+		req.Header.Add("Cache-Control", "no-cache")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Code: resp.StatusCode, Path: path}
+	}
+	if c.maxAge > 0 {
+		age, known := responseAge(resp)
+		if age > c.maxAge || !known && !noCache {
+			return nil, &StaleError{Path: path, Age: age, Unknown: !known}
+		}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// responseAge returns how old the content of resp is, by its Age header
+// as set by caching proxies, or else by how long before its Date it was
+// last modified. known is false when resp has neither, as the age cannot
+// be told from the local clock, which need not agree with the server.
+func responseAge(resp *http.Response) (age time.Duration, known bool) {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Age")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0, false
+	}
+	if age = date.Sub(modified); age < 0 {
+		age = 0
+	}
+	return age, true
+}
+
+func (c *client) get(path string, out interface{}) (err error) {
+	defer recoverPanic(&err)
+	body, err := c.sendRequest(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (c *client) getVersion() (string, error) {
+	body, err := c.sendRequest("/version")
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// getVersions lists the API versions offered at the service root, which
+// answers with a JSON list or, from older services, one version per line.
+func (c *client) getVersions() ([]string, error) {
+	body, err := c.sendRequest("/")
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	if json.Unmarshal(body, &versions) == nil {
+		return versions, nil
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.Trim(strings.TrimSpace(line), "/"); line != "" {
+			versions = append(versions, line)
+		}
+	}
+	return versions, nil
+}
+
+// waitVersion long-polls the metadata version until it differs from
+// version or maxWait passes, and returns the version then current. A
+// service without long-poll support answers at once.
+func (c *client) waitVersion(version string, maxWait time.Duration) (string, error) {
+	seconds := int(maxWait / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	body, err := c.sendRequest(fmt.Sprintf("/version?wait=true&value=%s&maxWait=%d", url.QueryEscape(version), seconds))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// rancherContainer is a metadata container with the fields newer metadata
+// versions add on top of the vendored type.
+type rancherContainer struct {
+	metadata.Container
+	Hostname    string `json:"hostname"`
+	State       string `json:"state"`
+	NetworkMode string `json:"network_mode"`
+}
+
+func (c *client) getContainers() (containers []rancherContainer, err error) {
+	defer recoverPanic(&err)
+	body, err := c.sendRequest("/containers")
+	if err != nil {
+		return nil, err
+	}
+	if c.schema == nil {
+		return decodeContainers(body)
+	}
+	return c.schema(body)
+}
+
+// getContainer fetches the single container key names, a UUID or name.
+// It is decoded as a one-element list so that c.schema applies.
+func (c *client) getContainer(key string) (container rancherContainer, err error) {
+	defer recoverPanic(&err)
+	body, err := c.sendRequest("/containers/" + url.QueryEscape(key))
+	if err != nil {
+		return container, err
+	}
+	decode := c.schema
+	if decode == nil {
+		decode = decodeContainers
+	}
+	containers, err := decode(append(append([]byte("["), body...), ']'))
+	if err != nil {
+		return container, err
+	}
+	if len(containers) != 1 {
+		return container, fmt.Errorf("%d containers returned for %s", len(containers), key)
+	}
+	return containers[0], nil
+}
+
+func (c *client) getHost(path string) (metadata.Host, error) {
+	var host metadata.Host
+	err := c.get(path, &host)
+	return host, err
+}
+
+func (c *client) getServices() ([]metadata.Service, error) {
+	var services []metadata.Service
+	err := c.get("/services", &services)
+	return services, err
+}
@@ -0,0 +1,135 @@
+package metadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hanging.Close()
+	defer close(release)
+	_, up := newFakeMetadata()
+	defer up.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{name: "answering", url: up.URL},
+		{name: "hanging", url: hanging.URL, wantErr: true},
+	}
+	for _, tt := range tests {
+		config := testConfig(tt.url)
+		config.RequestTimeout = 100 * time.Millisecond
+		httpClient, err := config.httpClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		_, err = newClient(config.URL(), httpClient).getVersion()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: getVersion() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s: getVersion() took %v", tt.name, d)
+		}
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	_, server := newFakeMetadata(testContainer("web", "uuid-web", "10.42.0.5"))
+	defer server.Close()
+	c := newClient(testConfig(server.URL).URL(), http.DefaultClient)
+	c.schema = func([]byte) ([]rancherContainer, error) {
+		panic("malformed container")
+	}
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"getContainers", func() error { _, err := c.getContainers(); return err }},
+		{"getContainer", func() error { _, err := c.getContainer("uuid-web"); return err }},
+	}
+	for _, tt := range tests {
+		err := tt.call()
+		if err == nil || !strings.Contains(err.Error(), "panicked: malformed container") {
+			t.Errorf("%s() error = %v, want the recovered panic", tt.name, err)
+		}
+	}
+
+	ipf, err := NewIPFinderFromMetadata(testConfig(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipf.m.schema = c.schema
+	if _, err := ipf.GetIP("web", ""); !isKind(err, ipfinder.ErrMetadataUnreachable) {
+		t.Errorf("GetIP() error = %v, want %v", err, ipfinder.ErrMetadataUnreachable)
+	}
+}
+
+func TestMaxStaleness(t *testing.T) {
+	modified := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		maxAge  time.Duration
+		cached  map[string]string // headers of a cached response
+		fresh   map[string]string // headers of a response with no-cache
+		want    int               // requests made
+		wantErr bool
+	}{
+		{name: "no threshold", cached: map[string]string{"Age": "600"}, want: 1},
+		{name: "fresh by age", maxAge: 10 * time.Second, cached: map[string]string{"Age": "5"}, want: 1},
+		{name: "stale by age", maxAge: 10 * time.Second, cached: map[string]string{"Age": "30"}, fresh: map[string]string{"Age": "0"}, want: 2},
+		{name: "stale uncached", maxAge: 10 * time.Second, cached: map[string]string{"Age": "30"}, fresh: map[string]string{"Age": "30"}, want: 2, wantErr: true},
+		{
+			name:   "fresh by last modified",
+			maxAge: 10 * time.Second,
+			cached: map[string]string{"Date": modified.Add(time.Second).Format(http.TimeFormat), "Last-Modified": modified.Format(http.TimeFormat)},
+			want:   1,
+		},
+		{
+			name:   "stale by last modified",
+			maxAge: 10 * time.Second,
+			cached: map[string]string{"Date": modified.Add(time.Minute).Format(http.TimeFormat), "Last-Modified": modified.Format(http.TimeFormat)},
+			want:   2,
+		},
+		{name: "unknown age", maxAge: 10 * time.Second, want: 2},
+		{name: "date alone", maxAge: 10 * time.Second, cached: map[string]string{"Date": modified.Format(http.TimeFormat)}, want: 2},
+	}
+	for _, tt := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			headers := tt.cached
+			if r.Header.Get("Cache-Control") == "no-cache" {
+				headers = tt.fresh
+			}
+			// The server would otherwise set a Date of its own.
+			w.Header()["Date"] = nil
+			for k, v := range headers {
+				w.Header().Set(k, v)
+			}
+			w.Write([]byte(`"1"`))
+		}))
+		c := newClient(server.URL, http.DefaultClient)
+		c.maxAge = tt.maxAge
+		_, err := c.getVersion()
+		server.Close()
+		if _, stale := err.(*StaleError); stale != tt.wantErr || err != nil && !tt.wantErr {
+			t.Errorf("%s: getVersion() error = %v, want stale %v", tt.name, err, tt.wantErr)
+		}
+		if requests != tt.want {
+			t.Errorf("%s: %d requests, want %d", tt.name, requests, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package metadata
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the finder's deadlines, poll waits and
+// rate limiting, so that they can be driven without real sleeps.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// RealClock is the Clock of the time package.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time        { return time.Now() }
+func (RealClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// FakeClock is a Clock for tests whose Sleep advances Now at once, so
+// that polling and backoff do not wait. It is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+// NewFakeClock returns a FakeClock reading now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.sleeps = append(c.sleeps, d)
+}
+
+// Sleeps returns the durations slept so far, in order.
+func (c *FakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+// clock returns Config.Clock, or the real clock if none is set.
+func (c Config) clock() Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return RealClock{}
+}
@@ -0,0 +1,95 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// sensitiveLabelWords mark label keys whose values are redacted from
+// debug artifacts.
+var sensitiveLabelWords = []string{"secret", "password", "token", "key", "credential"}
+
+// debugArtifact is the content of a debug artifact file.
+type debugArtifact struct {
+	CID        string             `json:"cid"`
+	RancherID  string             `json:"rancherid"`
+	Error      string             `json:"error"`
+	Containers []rancherContainer `json:"containers"`
+}
+
+// writeDebugArtifact saves the containers seen by a failed lookup to a
+// file in Config.DebugDir, for support to see exactly what the finder
+// saw. It saves the matched container, or else the near misses: those
+// whose ids share a prefix with cid or rancherid. Failing to write is
+// only logged.
+func (ipf *IPFinderFromMetadata) writeDebugArtifact(containers []rancherContainer, cid, rancherid string, lookupErr error) {
+	if ipf.config.DebugDir == "" {
+		return
+	}
+	artifact := debugArtifact{CID: cid, RancherID: rancherid, Error: lookupErr.Error()}
+	if container, ok := ipf.findContainer(containers, cid, rancherid); ok {
+		artifact.Containers = []rancherContainer{container}
+	} else {
+		artifact.Containers = nearMisses(containers, cid, rancherid)
+	}
+	for i := range artifact.Containers {
+		artifact.Containers[i].Labels = redactLabels(artifact.Containers[i].Labels)
+	}
+
+	data, err := json.MarshalIndent(artifact, "", "    ")
+	if err == nil {
+		err = os.MkdirAll(ipf.config.DebugDir, 0700)
+	}
+	path := filepath.Join(ipf.config.DebugDir, fmt.Sprintf("rancher-cni-ipam-%s-%d.json", filepath.Base(cid), ipf.config.clock().Now().UnixNano()))
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		log.Warnf("rancher-cni-ipam: failed to write debug artifact: %v", err)
+		return
+	}
+	log.Debugf("rancher-cni-ipam: wrote debug artifact %s", path)
+}
+
+// nearMisses returns the containers whose external id or UUID starts
+// with the first minShortUUIDLength characters of cid or rancherid.
+func nearMisses(containers []rancherContainer, cid, rancherid string) []rancherContainer {
+	var prefixes []string
+	for _, id := range append(strings.Split(rancherid, ","), cid) {
+		if id = strings.TrimSpace(id); len(id) >= minShortUUIDLength {
+			prefixes = append(prefixes, id[:minShortUUIDLength])
+		}
+	}
+	var misses []rancherContainer
+	for _, container := range containers {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(container.ExternalId, prefix) || strings.HasPrefix(container.UUID, prefix) {
+				misses = append(misses, container)
+				break
+			}
+		}
+	}
+	return misses
+}
+
+// redactLabels returns a copy of labels with the values of sensitive
+// looking keys replaced.
+func redactLabels(labels map[string]string) map[string]string {
+	redacted := make(map[string]string, len(labels))
+	for k, v := range labels {
+		for _, word := range sensitiveLabelWords {
+			if strings.Contains(strings.ToLower(k), word) {
+				v = "<redacted>"
+				break
+			}
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
@@ -0,0 +1,67 @@
+package metadata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteDebugArtifact(t *testing.T) {
+	near := testContainer("abcdefgh-other", "uuid-near", "10.42.0.5")
+	near.Labels = map[string]string{"app": "web", "db.password": "hunter2"}
+	_, server := newFakeMetadata(near)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		cid      string
+		wantFile string
+		wantNear int
+	}{
+		{name: "plain id", cid: "abcdefgh-ctr", wantFile: "rancher-cni-ipam-abcdefgh-ctr-0.json", wantNear: 1},
+		{name: "path traversal", cid: "../../abcdefgh-ctr", wantFile: "rancher-cni-ipam-abcdefgh-ctr-0.json"},
+		{name: "nested path", cid: "abcdefgh/ctr", wantFile: "rancher-cni-ipam-ctr-0.json", wantNear: 1},
+	}
+	for _, tt := range tests {
+		root, err := ioutil.TempDir("", "debug-artifact")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		dir := filepath.Join(root, "a", "b")
+		config := testConfig(server.URL)
+		config.DebugDir = dir
+		if _, _, err := ResolveContainer(config, tt.cid, "", true); err == nil {
+			t.Errorf("%s: ResolveContainer() found %s", tt.name, tt.cid)
+		}
+		var files []string
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		want := filepath.Join(dir, tt.wantFile)
+		if len(files) != 1 || files[0] != want {
+			t.Errorf("%s: wrote %v, want only %s", tt.name, files, want)
+			continue
+		}
+		data, err := ioutil.ReadFile(want)
+		var artifact debugArtifact
+		if err == nil {
+			err = json.Unmarshal(data, &artifact)
+		}
+		if err != nil || artifact.CID != tt.cid || len(artifact.Containers) != tt.wantNear {
+			t.Errorf("%s: artifact %+v, %v, want %d near misses of %s", tt.name, artifact, err, tt.wantNear, tt.cid)
+			continue
+		}
+		if tt.wantNear == 0 {
+			continue
+		}
+		if labels := artifact.Containers[0].Labels; labels["app"] != "web" || labels["db.password"] != "<redacted>" {
+			t.Errorf("%s: labels %v, want the password redacted", tt.name, labels)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package metadata
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IP family preferences, selecting which of a container's addresses a
+// lookup resolves to.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+	FamilyDual = "dual"
+)
+
+// ValidateFamilyPreference returns an error for an unknown preference. An
+// empty preference keeps the container's primary IP.
+func ValidateFamilyPreference(name string) error {
+	switch name {
+	case "", FamilyIPv4, FamilyIPv6, FamilyDual:
+		return nil
+	}
+	return fmt.Errorf("unknown ip family preference %q", name)
+}
+
+// containerIP returns the address container resolves to under the
+// configured AddressSelector, or "" if it has none yet or is not in a
+// ready state.
+//
+// With Config.PrefixField set, the address carries the prefix length
+// read from that field, as in "10.42.0.5/24". The field holds a single
+// prefix, for the family of the container's primary IP, so under
+// FamilyDual the address of the other family is left without one and
+// gets its host prefix.
+func (c Config) containerIP(container rancherContainer) string {
+	if !readyForIP(c.ReadyStates, container.State, container.HealthState) {
+		return ""
+	}
+	ip := c.selector().SelectAddress(container.Container)
+	if ip == "" || c.PrefixField == "" {
+		return ip
+	}
+	value, err := identityField(c.PrefixField)
+	if err != nil {
+		return ip
+	}
+	prefix := strings.TrimPrefix(strings.TrimSpace(value(container)), "/")
+	if prefix == "" {
+		return ip
+	}
+	addrs := strings.Split(ip, ",")
+	family := addressFamily(strings.Split(container.PrimaryIp, ",")[0])
+	if family == "" {
+		family = addressFamily(addrs[0])
+	}
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+		if addressFamily(addrs[i]) == family {
+			addrs[i] += "/" + prefix
+		}
+	}
+	return strings.Join(addrs, ",")
+}
+
+// addressFamily returns FamilyIPv4 or FamilyIPv6 for addr, or "" if addr
+// is not an IP address.
+func addressFamily(addr string) string {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
@@ -0,0 +1,103 @@
+package metadata
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFamilyPreference(t *testing.T) {
+	dual := testContainer("dual", "uuid-dual", "10.42.0.5")
+	dual.Ips = []string{"10.42.0.5", "fd00::5"}
+	v6primary := testContainer("v6-primary", "uuid-v6-primary", "fd00::6")
+	v6primary.Ips = []string{"fd00::6", "10.42.0.6"}
+	_, server := newFakeMetadata(dual, v6primary, testContainer("v4", "uuid-v4", "10.42.0.7"))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		cid    string
+		family string
+		want   string
+	}{
+		{name: "no preference", cid: "dual", want: "10.42.0.5"},
+		{name: "ipv4", cid: "dual", family: FamilyIPv4, want: "10.42.0.5"},
+		{name: "ipv6", cid: "dual", family: FamilyIPv6, want: "fd00::5"},
+		{name: "dual", cid: "dual", family: FamilyDual, want: "10.42.0.5,fd00::5"},
+		{name: "ipv4 of an IPv6 primary", cid: "v6-primary", family: FamilyIPv4, want: "10.42.0.6"},
+		{name: "dual of an IPv6 primary", cid: "v6-primary", family: FamilyDual, want: "10.42.0.6,fd00::6"},
+		{name: "ipv6 without one", cid: "v4", family: FamilyIPv6, want: "10.42.0.7"},
+		{name: "dual without IPv6", cid: "v4", family: FamilyDual, want: "10.42.0.7"},
+	}
+	for _, tt := range tests {
+		config := testConfig(server.URL)
+		config.FamilyPreference = tt.family
+		nets, _, err := ResolveContainer(config, tt.cid, "", true)
+		if err != nil {
+			t.Errorf("%s: ResolveContainer() error = %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, n := range nets {
+			got = append(got, n.IP.String())
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%s: addresses = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixField(t *testing.T) {
+	labeled := func(id, ip, prefix string, ips ...string) rancherContainer {
+		c := testContainer(id, "uuid-"+id, ip)
+		c.Ips = ips
+		c.Labels = map[string]string{"io.rancher.subnet.prefix": prefix}
+		return c
+	}
+	_, server := newFakeMetadata(
+		labeled("v4", "10.42.0.5", "24"),
+		labeled("slash", "10.42.0.6", "/20"),
+		labeled("unlabeled", "10.42.0.7", ""),
+		labeled("v6", "fd00::8", "64"),
+		labeled("dual", "10.42.0.9", "24", "10.42.0.9", "fd00::9"),
+		labeled("dual-v6", "fd00::a", "64", "fd00::a", "10.42.0.10"),
+		labeled("too-long", "10.42.0.11", "33"),
+	)
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		cid     string
+		family  string
+		want    string
+		wantErr bool
+	}{
+		{name: "label", cid: "v4", want: "10.42.0.5/24"},
+		{name: "leading slash", cid: "slash", want: "10.42.0.6/20"},
+		{name: "no label", cid: "unlabeled", want: "10.42.0.7"},
+		{name: "IPv6", cid: "v6", want: "fd00::8/64"},
+		{name: "dual", cid: "dual", family: FamilyDual, want: "10.42.0.9/24,fd00::9"},
+		{name: "dual of an IPv6 primary", cid: "dual-v6", family: FamilyDual, want: "10.42.0.10,fd00::a/64"},
+		{name: "too long for IPv4", cid: "too-long", wantErr: true},
+	}
+	for _, tt := range tests {
+		config := testConfig(server.URL)
+		config.PrefixField = "Labels.io.rancher.subnet.prefix"
+		config.FamilyPreference = tt.family
+		nets, _, err := ResolveContainer(config, tt.cid, "", true)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ResolveContainer() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, n := range nets {
+			if n.Mask == nil {
+				got = append(got, n.IP.String())
+			} else {
+				got = append(got, n.String())
+			}
+		}
+		if !tt.wantErr && strings.Join(got, ",") != tt.want {
+			t.Errorf("%s: addresses = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
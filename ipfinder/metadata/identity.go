@@ -0,0 +1,58 @@
+package metadata
+
+import (
+	"fmt"
+	"strings"
+)
+
+// labelFieldPrefix selects a container label as an identity field, as in
+// "Labels.io.rancher.container.uuid".
+const labelFieldPrefix = "Labels."
+
+// defaultIdentityFields is the match order used when none is configured.
+var defaultIdentityFields = []string{"ExternalId", "UUID"}
+
+// identityFields maps a field name to the container value it selects.
+var identityAccessors = map[string]func(c rancherContainer) string{
+	"ExternalId": func(c rancherContainer) string { return c.ExternalId },
+	"UUID":       func(c rancherContainer) string { return c.UUID },
+	"Name":       func(c rancherContainer) string { return c.Name },
+	"Hostname":   func(c rancherContainer) string { return c.Hostname },
+}
+
+// ValidateIdentityFields returns an error for a field name that is not
+// one of ExternalId, UUID, Name, Hostname or Labels.<key>.
+func ValidateIdentityFields(fields []string) error {
+	for _, field := range fields {
+		if err := ValidateField(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateField is ValidateIdentityFields for a single field, such as
+// Config.PrefixField.
+func ValidateField(field string) error {
+	_, err := identityField(field)
+	return err
+}
+
+// identityField returns the accessor for the named field.
+func identityField(field string) (func(c rancherContainer) string, error) {
+	if f, ok := identityAccessors[field]; ok {
+		return f, nil
+	}
+	if key := strings.TrimPrefix(field, labelFieldPrefix); key != field && key != "" {
+		return func(c rancherContainer) string { return c.Labels[key] }, nil
+	}
+	return nil, fmt.Errorf("unknown identity field %q", field)
+}
+
+// identityFields returns the configured match order, or the default.
+func (c Config) identityFields() []string {
+	if len(c.IdentityFields) > 0 {
+		return c.IdentityFields
+	}
+	return defaultIdentityFields
+}
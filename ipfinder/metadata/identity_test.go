@@ -0,0 +1,70 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+)
+
+func TestIdentityFields(t *testing.T) {
+	web := testContainer("ext-web", "uuid-web", "10.42.0.5")
+	web.Hostname = "web-1"
+	web.Labels = map[string]string{"io.example.id": "label-web"}
+	db := testContainer("ext-db", "uuid-db", "10.42.0.6")
+	db.Hostname = "ext-web"
+
+	tests := []struct {
+		name     string
+		fields   []string
+		cid      string
+		wantIP   string
+		wantKind error
+	}{
+		{name: "default by ExternalId", cid: "ext-web", wantIP: "10.42.0.5"},
+		{name: "default ignores Hostname", cid: "web-1", wantKind: ipfinder.ErrContainerNotFound},
+		{name: "Hostname only", fields: []string{"Hostname"}, cid: "web-1", wantIP: "10.42.0.5"},
+		{name: "Hostname only ignores ExternalId", fields: []string{"Hostname"}, cid: "ext-db", wantKind: ipfinder.ErrContainerNotFound},
+		// db's hostname is web's external id, so the order decides.
+		{name: "Hostname before ExternalId", fields: []string{"Hostname", "ExternalId"}, cid: "ext-web", wantIP: "10.42.0.6"},
+		{name: "ExternalId before Hostname", fields: []string{"ExternalId", "Hostname"}, cid: "ext-web", wantIP: "10.42.0.5"},
+		{name: "label", fields: []string{"Labels.io.example.id"}, cid: "label-web", wantIP: "10.42.0.5"},
+	}
+	for _, tt := range tests {
+		_, server := newFakeMetadata(web, db)
+		config := testConfig(server.URL)
+		config.IdentityFields = tt.fields
+		ipf, err := NewIPFinderFromMetadata(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		ip, err := ipf.GetIPImmediate(tt.cid, "")
+		server.Close()
+		if tt.wantKind != nil {
+			if !isKind(err, tt.wantKind) {
+				t.Errorf("%s: GetIPImmediate() = %q, %v, want %v", tt.name, ip, err, tt.wantKind)
+			}
+			continue
+		}
+		if ip != tt.wantIP || err != nil {
+			t.Errorf("%s: GetIPImmediate() = %q, %v, want %q", tt.name, ip, err, tt.wantIP)
+		}
+	}
+}
+
+func TestValidateIdentityFields(t *testing.T) {
+	tests := []struct {
+		fields  []string
+		wantErr bool
+	}{
+		{fields: nil},
+		{fields: []string{"ExternalId", "UUID", "Name", "Hostname", "Labels.app"}},
+		{fields: []string{"Hostname", "IP"}, wantErr: true},
+		{fields: []string{"Labels."}, wantErr: true},
+		{fields: []string{"hostname"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := ValidateIdentityFields(tt.fields); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateIdentityFields(%q) error = %v, want error %v", tt.fields, err, tt.wantErr)
+		}
+	}
+}
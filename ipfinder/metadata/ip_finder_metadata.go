@@ -1,56 +1,825 @@
 package metadata
 
 import (
+	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+)
+
+// The Rancher metadata service and the API version the finder queries
+// unless Config.MetadataVersion says otherwise.
+const (
+	metadataRoot   = "http://169.254.169.250"
+	DefaultVersion = "2015-12-19"
+	DefaultURL     = metadataRoot + "/" + DefaultVersion
 )
 
 const (
-	metadataURL         = "http://169.254.169.250/2015-12-19"
 	multiplierForTwoMin = 240
 	emptyIPAddress      = ""
+
+	// minShortUUIDLength guards short rancherid matching against
+	// prefixes too short to be reasonably unique.
+	minShortUUIDLength = 8
+
+	defaultPollInterval = 500 * time.Millisecond
+	pollTimeout         = multiplierForTwoMin * defaultPollInterval
+
+	// defaultConnectTimeout bounds waiting for the metadata service to
+	// answer at all, allowing for the full retry backoff.
+	defaultConnectTimeout = 45 * time.Second
+
+	// waitLogEvery is how many polls pass between "still waiting" lines.
+	waitLogEvery = 10
+
+	// defaultRequestRetries and requestRetryWait set the quick retries of
+	// a failed container list request.
+	defaultRequestRetries = 2
+	requestRetryWait      = 100 * time.Millisecond
+
+	// maxWatchWait bounds a single metadata long-poll so that the loop
+	// still rescans, and confirms IPs, while nothing changes.
+	maxWatchWait = 10 * time.Second
+
+	// defaultRequestTimeout bounds a single metadata request, leaving a
+	// long-poll of maxWatchWait the time to answer.
+	defaultRequestTimeout = 2 * maxWatchWait
 )
 
+// Config holds the optional settings of an IPFinderFromMetadata.
+// The zero value keeps the default behavior.
+type Config struct {
+	// Clock provides the time for polling and rate limiting. Nil means
+	// the real clock.
+	Clock Clock
+	// MetadataRoot is the base URL of the metadata service, which may be
+	// https. Empty means the Rancher link-local address.
+	MetadataRoot string
+	// CAFile is a PEM bundle of the CAs trusted for an https MetadataRoot,
+	// instead of the system pool. Insecure skips verifying the server
+	// certificate altogether.
+	CAFile   string
+	Insecure bool
+	// MetadataVersion is the metadata API version to query. When set it is
+	// checked against the versions the service offers. Empty means
+	// DefaultVersion.
+	MetadataVersion string
+	// MetadataVersions lists further API versions whose container lists
+	// are merged with that of MetadataVersion, for clusters whose agents
+	// report to different versions mid-upgrade. A container listed by
+	// several versions is taken from the first.
+	MetadataVersions []string
+	// ConnectTimeout bounds how long NewIPFinderFromMetadata waits for
+	// the metadata service to answer. Zero means 45s.
+	ConnectTimeout time.Duration
+	// RequestTimeout bounds each metadata request, so that a service that
+	// accepts connections but never answers fails the request instead of
+	// hanging it. A WatchChanges long-poll waits at most half of it. Zero
+	// means 20s.
+	RequestTimeout time.Duration
+	// ReadyFile, if set, is touched once the metadata service answers and
+	// removed when it cannot be reached, so that readiness probes can
+	// check for its existence.
+	ReadyFile string
+	// HostUUID restricts matching to containers scheduled on the
+	// given Rancher host. Empty means all containers are considered.
+	HostUUID string
+	// ReadyStates lists the lifecycle and health states, such as "running"
+	// and "healthy", in which a container's IP is trusted. A container in
+	// another state is treated as having no IP yet. Empty trusts any
+	// state.
+	ReadyStates []string
+	// RequestRetries is how many times a failed container list request is
+	// retried at once, within the same poll. Zero means 2, and a negative
+	// value disables the retries.
+	RequestRetries int
+	// MaxStaleness, if set, rejects metadata responses older than this
+	// by their Age header, or their Date and Last-Modified headers,
+	// fetching them again with caches bypassed first. A response with
+	// none of these is of unknown age and is fetched again too.
+	MaxStaleness time.Duration
+	// MaxScan caps how many candidate containers are examined per
+	// poll. Zero means no cap.
+	MaxScan int
+	// TargetedLookupThreshold, if set, makes GetIP fetch only the
+	// container named by a single rancherid once a full list held more
+	// containers than this. Zero always scans the full list.
+	TargetedLookupThreshold int
+	// RateLimitFile and RateLimitInterval, when both set, space metadata
+	// calls from all processes sharing the file at least one interval
+	// apart.
+	RateLimitFile     string
+	RateLimitInterval time.Duration
+	// PollStrategy is one of PollFixed (the default), PollLinear or
+	// PollExponential and sets how the wait between polls grows.
+	PollStrategy string
+	// PollTimeout bounds how long GetIP polls for the IP. Zero means 2m.
+	PollTimeout time.Duration
+	// PollInterval is the wait between the first polls. Zero means 500ms.
+	PollInterval time.Duration
+	// MaxPollInterval caps the wait of a growing poll strategy. Zero
+	// means no cap; the wait never exceeds the remaining budget anyway.
+	MaxPollInterval time.Duration
+	// Confirmations is how many consecutive polls must report the same IP
+	// before GetIP returns it. Zero means 1, i.e. no confirmation.
+	Confirmations int
+	// PollLogSampleRate, when set, logs 1 in this many waiting messages
+	// instead of the first and then every tenth.
+	PollLogSampleRate int
+	// IdentityFields lists, in match order, the container fields compared
+	// against the container and rancher ids: ExternalId, UUID, Name,
+	// Hostname or Labels.<key>. Empty means ExternalId then UUID.
+	IdentityFields []string
+	// NormalizeSteps lists, in order, the NormalizeTrim,
+	// NormalizeLowercase and NormalizeStripPrefix steps applied to ids and
+	// identity fields before they are compared. Empty means trim only.
+	// StripPrefixes are the prefixes NormalizeStripPrefix removes.
+	NormalizeSteps []string
+	StripPrefixes  []string
+	// WatchChanges makes GetIP long-poll the metadata version between
+	// polls and rescan as soon as it changes. It falls back to interval
+	// polling if the service does not support long polling.
+	WatchChanges bool
+	// UnmanagedLabel names a container label that, set to "true", marks
+	// the container as managed elsewhere. A lookup of such a container
+	// fails at once with ipfinder.ErrUnmanaged. Empty disables the check.
+	UnmanagedLabel string
+	// NetnsInode and NetnsInodeLabel enable an experimental last-resort
+	// match: when no id matches, a container whose NetnsInodeLabel equals
+	// NetnsInode, the inode of the network namespace being set up, is
+	// used. Metadata has no namespace info of its own, so this relies on
+	// the label being published by other means.
+	NetnsInode      string
+	NetnsInodeLabel string
+	// PodName and PodNamespace, as passed by kubelet, match a container by
+	// the Kubernetes pod labels when no id matches. PodNamespace is
+	// optional and narrows the match to one namespace.
+	PodName      string
+	PodNamespace string
+	// PrefixField names the container field, typically Labels.<key>,
+	// holding the prefix length of the container's subnet. The address is
+	// then returned as a CIDR. Empty means plain addresses.
+	PrefixField string
+	// FamilyPreference is FamilyIPv4, FamilyIPv6 or FamilyDual and picks
+	// among the container's addresses. Empty means its primary IP.
+	FamilyPreference string
+	// AddressSelector picks the container address to resolve to. Nil
+	// means a FamilySelector for FamilyPreference.
+	AddressSelector AddressSelector
+	// DebugDir, when set, receives a JSON dump of the matched or near-miss
+	// containers of every failed lookup.
+	DebugDir string
+	// AllowHostNetwork lets a lookup match a container whose network mode
+	// is host. Otherwise such a container, which shares the host IP, fails
+	// the lookup at once with ipfinder.ErrHostNetwork.
+	AllowHostNetwork bool
+	// AutoAssignLabel, if set, names a label with which a container
+	// defers to Calico: a matched container setting it to "auto" fails
+	// the lookup at once with ipfinder.ErrAutoAssign, whatever its IP.
+	AutoAssignLabel string
+	// CheckHost fails a lookup with ipfinder.ErrForeignHost when the
+	// matched container is scheduled on another host than the one
+	// metadata serves as /self/host, which betrays an id collision.
+	CheckHost bool
+	// SentinelNotFound makes a lookup that finds no container return the
+	// bare ipfinder.ErrContainerNotFound and log it at debug level only,
+	// for callers that treat a missing container as a normal outcome.
+	SentinelNotFound bool
+}
+
 // IPFinderFromMetadata is used to hold information related to
 // Metadata client and other stuff.
 type IPFinderFromMetadata struct {
-	m *metadata.Client
+	m      *client
+	config Config
+	// source, if set, lists the containers in place of m, which is nil.
+	source  ContainerSource
+	limiter *fileRateLimiter
+	// others are the clients of Config.MetadataVersions, and servedBy
+	// maps container UUIDs to the version they were last listed by.
+	others   []*client
+	servedBy map[string]string
+	// matched is the container of the last successful lookup.
+	matched rancherContainer
+	// targeted is set once polls look the container up directly, and
+	// untargeted once the service failed to serve such a lookup.
+	targeted, untargeted bool
+	// selfHost is the UUID of /self/host, once looked up for CheckHost.
+	selfHost *string
 }
 
 // NewIPFinderFromMetadata returns a new instance of the IPFinderFromMetadata
-func NewIPFinderFromMetadata() (*IPFinderFromMetadata, error) {
-	m, err := metadata.NewClientAndWait(metadataURL)
+func NewIPFinderFromMetadata(config Config) (*IPFinderFromMetadata, error) {
+	m, err := newClientAndWait(config)
 	if err != nil {
 		return nil, err
 	}
-	return &IPFinderFromMetadata{m}, nil
+	if config.MetadataVersion != "" {
+		if err := checkVersion(newClient(config.root(), m.http), config.MetadataVersion); err != nil {
+			return nil, err
+		}
+	}
+	m.schema = schemaFor(config.version())
+	m.maxAge = config.MaxStaleness
+	ipf := &IPFinderFromMetadata{m: m, config: config}
+	for _, version := range config.MetadataVersions {
+		if err := checkVersion(newClient(config.root(), m.http), version); err != nil {
+			return nil, err
+		}
+		other := newClient(config.root()+"/"+version, m.http)
+		other.clock = m.clock
+		other.schema = schemaFor(version)
+		other.maxAge = config.MaxStaleness
+		ipf.others = append(ipf.others, other)
+	}
+	if config.RateLimitFile != "" && config.RateLimitInterval > 0 {
+		ipf.limiter = &fileRateLimiter{config.RateLimitFile, config.RateLimitInterval, config.clock()}
+	}
+	return ipf, nil
+}
+
+// connectTimeout returns Config.ConnectTimeout or its default.
+func (c Config) connectTimeout() time.Duration {
+	if c.ConnectTimeout > 0 {
+		return c.ConnectTimeout
+	}
+	return defaultConnectTimeout
+}
+
+// requestTimeout returns Config.RequestTimeout or its default.
+func (c Config) requestTimeout() time.Duration {
+	if c.RequestTimeout > 0 {
+		return c.RequestTimeout
+	}
+	return defaultRequestTimeout
 }
 
-// GetIP returns the IP address for the given container id, return an empty string
-// if not found
-func (ipf *IPFinderFromMetadata) GetIP(cid, rancherid string) string {
-	for i := 0; i < multiplierForTwoMin; i++ {
-		containers, err := ipf.m.GetContainers()
+// URL returns the metadata endpoint for the configured version.
+func (c Config) URL() string {
+	return c.root() + "/" + c.version()
+}
+
+// root returns Config.MetadataRoot or the Rancher metadata service.
+func (c Config) root() string {
+	if c.MetadataRoot != "" {
+		return strings.TrimSuffix(c.MetadataRoot, "/")
+	}
+	return metadataRoot
+}
+
+// version returns Config.MetadataVersion or DefaultVersion.
+func (c Config) version() string {
+	if c.MetadataVersion != "" {
+		return c.MetadataVersion
+	}
+	return DefaultVersion
+}
+
+// checkVersion returns an error listing the offered versions if version is
+// not among them, which would otherwise surface as a bare 404 later.
+func checkVersion(root *client, version string) error {
+	versions, err := root.getVersions()
+	if err != nil {
+		return fmt.Errorf("cannot list metadata versions: %v", err)
+	}
+	for _, v := range versions {
+		if v == version {
+			return nil
+		}
+	}
+	return fmt.Errorf("metadata version %q is not offered, available versions: %s", version, strings.Join(versions, ", "))
+}
+
+// GetIP returns the IP address for the given container id. If none is
+// found within the polling budget it returns an empty string and an
+// *ipfinder.Error whose Kind says why.
+//
+// Each poll fetches the full container list and scans it linearly, so a
+// lookup costs O(n) per poll and O(n * polls) in the worst case. Setting
+// Config.HostUUID shrinks n to the containers of one host, and
+// Config.MaxScan bounds it outright, and Config.TargetedLookupThreshold
+// replaces the scan of a large list with a direct lookup.
+func (ipf *IPFinderFromMetadata) GetIP(cid, rancherid string) (string, error) {
+	kind := ipfinder.ErrContainerNotFound
+	clock := ipf.config.clock()
+	deadline := clock.Now().Add(ipf.config.pollTimeout())
+	interval := ipf.config.pollInterval()
+	// A restarting container may briefly show a transient IP, so the same
+	// IP must be seen in Config.Confirmations consecutive polls.
+	lastIP, seen := "", 0
+	waits := 0
+	watch, version := ipf.config.WatchChanges, ""
+	var containers []rancherContainer
+	for {
+		if watch && version == "" {
+			var err error
+			if version, err = ipf.m.getVersion(); err != nil {
+				log.Debugf("rancher-cni-ipam: cannot watch metadata, polling instead: %v", err)
+				watch = false
+			}
+		}
+		var err error
+		containers, err = ipf.pollContainers(cid, rancherid)
+		if isNotFound(err) {
+			// The service is up but has no container data yet.
+			log.Debugf("rancher-cni-ipam: metadata has no containers yet: %v", err)
+			containers, err = nil, nil
+		}
 		if err != nil {
 			log.Errorf("rancher-cni-ipam: Error getting metadata containers: %v", err)
-			return emptyIPAddress
+			return emptyIPAddress, &ipfinder.Error{Kind: ipfinder.ErrMetadataUnreachable, CID: cid, RancherID: rancherid, Err: err}
+		}
+
+		container, ok := ipf.findContainer(containers, cid, rancherid)
+		if ok && ipf.unmanaged(container) {
+			return emptyIPAddress, &ipfinder.Error{Kind: ipfinder.ErrUnmanaged, CID: cid, RancherID: rancherid}
+		}
+		if ok && ipf.hostNetwork(container) {
+			return emptyIPAddress, &ipfinder.Error{Kind: ipfinder.ErrHostNetwork, CID: cid, RancherID: rancherid}
+		}
+		if ok {
+			if err := ipf.checkHost(container, cid, rancherid); err != nil {
+				return emptyIPAddress, err
+			}
+		}
+		if ok && ipf.autoAssign(container) {
+			ipf.matched = container
+			return emptyIPAddress, &ipfinder.Error{Kind: ipfinder.ErrAutoAssign, CID: cid, RancherID: rancherid}
+		}
+		if ip := ipf.config.containerIP(container); ok && ip != "" {
+			if ip == lastIP {
+				seen++
+			} else {
+				lastIP, seen = ip, 1
+			}
+			if seen >= ipf.config.confirmations() {
+				ipf.logServedBy(container)
+				ipf.matched = container
+				return ip, nil
+			}
+			log.Infof("rancher-cni-ipam: confirming ip %s (%d/%d)", lastIP, seen, ipf.config.confirmations())
+		} else {
+			lastIP, seen = "", 0
+		}
+		if ok {
+			kind = ipfinder.ErrIPPending
+		}
+		remaining := deadline.Sub(clock.Now())
+		if remaining <= 0 {
+			break
+		}
+		waits++
+		if ipf.config.logsWait(waits) {
+			if waits == 1 {
+				log.Infof("Waiting to find IP for container: %s, %s", cid, rancherid)
+			} else {
+				log.Infof("Still waiting to find IP for container: %s, %s (%d polls)", cid, rancherid, waits)
+			}
+		}
+		if watch {
+			if ipf.waitForChange(&version, remaining, interval) {
+				continue
+			}
+			watch = false
+		}
+		// Never sleep past the deadline, however large the interval grew.
+		if interval > remaining {
+			interval = remaining
+		}
+		clock.Sleep(interval)
+		interval = ipf.config.nextPollInterval(interval)
+	}
+	if ipf.config.SentinelNotFound && kind == ipfinder.ErrContainerNotFound {
+		log.Debugf("ip not found for cid: %v after %d polls", cid, waits+1)
+	} else {
+		log.Infof("ip not found for cid: %v after %d polls", cid, waits+1)
+	}
+	err := ipf.notFound(kind, cid, rancherid, nil)
+	ipf.writeDebugArtifact(containers, cid, rancherid, err)
+	return emptyIPAddress, err
+}
+
+// waitForChange long-polls until the metadata version moves past
+// *version, at most remaining, and updates *version. It returns false
+// if change detection turned out to be unavailable: the long-poll failed
+// or returned the same version quicker than a poll interval.
+func (ipf *IPFinderFromMetadata) waitForChange(version *string, remaining, interval time.Duration) bool {
+	wait := remaining
+	if wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+	if limit := ipf.config.requestTimeout() / 2; wait > limit {
+		wait = limit
+	}
+	clock := ipf.config.clock()
+	start := clock.Now()
+	newVersion, err := ipf.m.waitVersion(*version, wait)
+	if err != nil {
+		log.Debugf("rancher-cni-ipam: cannot watch metadata, polling instead: %v", err)
+		return false
+	}
+	if newVersion == *version && clock.Now().Sub(start) < interval && wait >= interval {
+		log.Debugf("rancher-cni-ipam: metadata does not support long polling, polling instead")
+		return false
+	}
+	*version = newVersion
+	return true
+}
+
+// notFound returns the error for a lookup that ended without an IP. Under
+// Config.SentinelNotFound an absent container yields the bare sentinel.
+func (ipf *IPFinderFromMetadata) notFound(kind error, cid, rancherid string, err error) error {
+	if ipf.config.SentinelNotFound && kind == ipfinder.ErrContainerNotFound {
+		return kind
+	}
+	return &ipfinder.Error{Kind: kind, CID: cid, RancherID: rancherid, Err: err}
+}
+
+// GetIPImmediate does a single metadata refresh and, unlike GetIP, does not
+// wait for the container to appear or to get an IP. The returned error
+// says whether the container was absent or present without an IP.
+func (ipf *IPFinderFromMetadata) GetIPImmediate(cid, rancherid string) (string, error) {
+	containers, err := ipf.getContainers(cid, rancherid)
+	if isNotFound(err) {
+		return emptyIPAddress, ipf.notFound(ipfinder.ErrContainerNotFound, cid, rancherid, err)
+	}
+	if err != nil {
+		return emptyIPAddress, &ipfinder.Error{Kind: ipfinder.ErrMetadataUnreachable, CID: cid, RancherID: rancherid, Err: err}
+	}
+	container, ok := ipf.findContainer(containers, cid, rancherid)
+	if !ok {
+		err := ipf.notFound(ipfinder.ErrContainerNotFound, cid, rancherid, nil)
+		ipf.writeDebugArtifact(containers, cid, rancherid, err)
+		return emptyIPAddress, err
+	}
+	if ipf.unmanaged(container) {
+		return emptyIPAddress, &ipfinder.Error{Kind: ipfinder.ErrUnmanaged, CID: cid, RancherID: rancherid}
+	}
+	if ipf.hostNetwork(container) {
+		return emptyIPAddress, &ipfinder.Error{Kind: ipfinder.ErrHostNetwork, CID: cid, RancherID: rancherid}
+	}
+	if err := ipf.checkHost(container, cid, rancherid); err != nil {
+		return emptyIPAddress, err
+	}
+	if ipf.autoAssign(container) {
+		ipf.matched = container
+		return emptyIPAddress, &ipfinder.Error{Kind: ipfinder.ErrAutoAssign, CID: cid, RancherID: rancherid}
+	}
+	ip := ipf.config.containerIP(container)
+	if ip == "" {
+		err := &ipfinder.Error{Kind: ipfinder.ErrIPPending, CID: cid, RancherID: rancherid}
+		ipf.writeDebugArtifact(containers, cid, rancherid, err)
+		return emptyIPAddress, err
+	}
+	ipf.logServedBy(container)
+	ipf.matched = container
+	return ip, nil
+}
+
+// GetContainerByIP is the inverse of GetIP: it returns the containers
+// whose primary IP or other addresses include ip, without polling. More
+// than one container is returned when several claim the address, as
+// while one replaces another.
+func (ipf *IPFinderFromMetadata) GetContainerByIP(ip string) ([]metadata.Container, error) {
+	want := net.ParseIP(strings.TrimSpace(ip))
+	if want == nil {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+	containers, err := ipf.getContainers("", "")
+	if err != nil {
+		return nil, err
+	}
+	var owners []metadata.Container
+	for _, container := range ipf.candidates(containers) {
+		for _, addr := range addresses(container.Container) {
+			if have := net.ParseIP(strings.SplitN(addr, "/", 2)[0]); have != nil && have.Equal(want) {
+				owners = append(owners, container.Container)
+				break
+			}
+		}
+	}
+	if len(owners) > 1 {
+		log.Warnf("rancher-cni-ipam: %d containers claim ip %s", len(owners), want.String())
+	}
+	return owners, nil
+}
+
+// readyForIP reports whether a container in lifecycle state and health
+// state has a trustworthy IP under readyStates. Either state may be
+// empty, as when metadata does not report it or the container has no
+// health check, and is then not held against the container.
+func readyForIP(readyStates []string, state, health string) bool {
+	if len(readyStates) == 0 {
+		return true
+	}
+	return (state == "" || contains(readyStates, state)) && (health == "" || contains(readyStates, health))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
 		}
+	}
+	return false
+}
+
+// unmanaged reports whether container carries Config.UnmanagedLabel.
+func (ipf *IPFinderFromMetadata) unmanaged(container rancherContainer) bool {
+	return ipf.config.UnmanagedLabel != "" && container.Labels[ipf.config.UnmanagedLabel] == "true"
+}
+
+// autoAssign reports whether container sets Config.AutoAssignLabel to
+// "auto".
+func (ipf *IPFinderFromMetadata) autoAssign(container rancherContainer) bool {
+	return ipf.config.AutoAssignLabel != "" && container.Labels[ipf.config.AutoAssignLabel] == "auto"
+}
 
+// hostNetwork reports whether container shares the host network, unless
+// Config.AllowHostNetwork is set.
+func (ipf *IPFinderFromMetadata) hostNetwork(container rancherContainer) bool {
+	return !ipf.config.AllowHostNetwork && container.NetworkMode == "host"
+}
+
+// checkHost returns an ipfinder.ErrForeignHost error under
+// Config.CheckHost if container runs on another host than /self/host.
+// The check is skipped when either host is unknown, and with
+// Config.HostUUID, which only matches containers of that host anyway.
+func (ipf *IPFinderFromMetadata) checkHost(container rancherContainer, cid, rancherid string) error {
+	if !ipf.config.CheckHost || ipf.config.HostUUID != "" || container.HostUUID == "" {
+		return nil
+	}
+	if ipf.selfHost == nil {
+		host, err := ipf.m.getHost("/self/host")
+		if err != nil {
+			log.Debugf("rancher-cni-ipam: cannot check the host of the container: %v", err)
+		}
+		ipf.selfHost = &host.UUID
+	}
+	if *ipf.selfHost == "" || container.HostUUID == *ipf.selfHost {
+		return nil
+	}
+	return &ipfinder.Error{Kind: ipfinder.ErrForeignHost, CID: cid, RancherID: rancherid,
+		Err: fmt.Errorf("container %s is on host %s, this is %s", container.UUID, container.HostUUID, *ipf.selfHost)}
+}
+
+// getContainers fetches the container list, honoring the rate limit.
+// A failing limiter is logged and otherwise ignored. With
+// Config.MetadataVersions the lists of all versions are merged; a version
+// failing to answer is skipped as long as another one does. Only a
+// ContainerSource uses cid and rancherid, to narrow its list.
+func (ipf *IPFinderFromMetadata) getContainers(cid, rancherid string) ([]rancherContainer, error) {
+	if ipf.source != nil {
+		return ipf.sourceContainers(cid, rancherid)
+	}
+	if ipf.limiter != nil {
+		if err := ipf.limiter.Wait(); err != nil {
+			log.Warnf("rancher-cni-ipam: metadata rate limit unavailable: %v", err)
+		}
+	}
+	containers, err := ipf.listContainers(ipf.m)
+	if len(ipf.others) == 0 {
+		return containers, err
+	}
+	ipf.servedBy = map[string]string{}
+	var merged []rancherContainer
+	answered := false
+	add := func(version string, containers []rancherContainer) {
 		for _, container := range containers {
-			if container.ExternalId == cid && container.PrimaryIp != "" {
-				log.Infof("rancher-cni-ipam: got ip: %v", container.PrimaryIp)
-				return container.PrimaryIp
+			if _, ok := ipf.servedBy[container.UUID]; ok && container.UUID != "" {
+				continue
 			}
-			if rancherid != "" && container.UUID == rancherid && container.PrimaryIp != "" {
-				log.Infof("rancher-cni-ipam: got ip from rancherid: %v", container.PrimaryIp)
-				return container.PrimaryIp
+			ipf.servedBy[container.UUID] = version
+			merged = append(merged, container)
+		}
+	}
+	if err == nil {
+		answered = true
+		add(ipf.config.URL(), containers)
+	} else {
+		log.Warnf("rancher-cni-ipam: cannot list containers at %s: %v", ipf.config.URL(), err)
+	}
+	for _, other := range ipf.others {
+		containers, otherErr := ipf.listContainers(other)
+		if otherErr != nil {
+			log.Warnf("rancher-cni-ipam: cannot list containers at %s: %v", other.url, otherErr)
+			continue
+		}
+		answered = true
+		add(other.url, containers)
+	}
+	if !answered {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// pollContainers returns the containers one GetIP poll searches for
+// rancherid: the full list, or once that exceeded
+// Config.TargetedLookupThreshold, only the container fetched by its UUID.
+// A targeted lookup that fails or returns another container means the
+// service cannot serve it, and the full list is used from then on.
+func (ipf *IPFinderFromMetadata) pollContainers(cid, rancherid string) ([]rancherContainer, error) {
+	if ipf.targeted {
+		container, err := ipf.m.getContainer(rancherid)
+		if err == nil && container.UUID == rancherid {
+			return []rancherContainer{container}, nil
+		}
+		log.Debugf("rancher-cni-ipam: targeted lookup of %s unavailable, scanning all containers: %v", rancherid, err)
+		ipf.targeted, ipf.untargeted = false, true
+	}
+	containers, err := ipf.getContainers(cid, rancherid)
+	threshold := ipf.config.TargetedLookupThreshold
+	if threshold > 0 && len(containers) > threshold && !ipf.untargeted && len(ipf.others) == 0 &&
+		rancherid != "" && !strings.Contains(rancherid, ",") {
+		log.Debugf("rancher-cni-ipam: %d containers listed, looking %s up directly", len(containers), rancherid)
+		ipf.targeted = true
+	}
+	return containers, err
+}
+
+// listContainers fetches the container list from m, retrying a failed
+// request up to Config.RequestRetries times so that a single blip does
+// not cost a whole poll. A 404 is an answer and is not retried.
+func (ipf *IPFinderFromMetadata) listContainers(m *client) ([]rancherContainer, error) {
+	retries := ipf.config.RequestRetries
+	if retries == 0 {
+		retries = defaultRequestRetries
+	}
+	for attempt := 0; ; attempt++ {
+		containers, err := m.getContainers()
+		if err == nil || isNotFound(err) || attempt >= retries {
+			return containers, err
+		}
+		log.Debugf("rancher-cni-ipam: retrying container list (%d/%d): %v", attempt+1, retries, err)
+		ipf.config.clock().Sleep(requestRetryWait)
+	}
+}
+
+// logServedBy logs which metadata version listed container, when several
+// are merged.
+func (ipf *IPFinderFromMetadata) logServedBy(container rancherContainer) {
+	if len(ipf.others) > 0 {
+		log.Infof("rancher-cni-ipam: container %s was listed by %s", container.UUID, ipf.servedBy[container.UUID])
+	}
+}
+
+// findContainer returns the container matching cid or rancherid on one
+// of the Config.IdentityFields. rancherid may be a comma-separated list, as when
+// sidecars share the network namespace, and its entries are tried in
+// order. A match with an IP is preferred over one without, and ok is
+// false only when nothing matched.
+func (ipf *IPFinderFromMetadata) findContainer(containers []rancherContainer, cid, rancherid string) (rancherContainer, bool) {
+	var found rancherContainer
+	ok := false
+	candidates := ipf.candidates(containers)
+	cid = ipf.config.normalize(cid)
+	for _, id := range strings.Split(rancherid, ",") {
+		container, matched := ipf.findOne(candidates, cid, ipf.config.normalize(id))
+		if matched && ipf.config.containerIP(container) != "" {
+			return container, true
+		}
+		if matched && !ok {
+			found, ok = container, true
+		}
+	}
+	if !ok {
+		found, ok = ipf.findByPod(candidates)
+	}
+	if !ok {
+		return ipf.findByNetnsInode(candidates)
+	}
+	return found, ok
+}
+
+// Labels the kubelet sets on the containers of a pod.
+const (
+	podNameLabel      = "io.kubernetes.pod.name"
+	podNamespaceLabel = "io.kubernetes.pod.namespace"
+)
+
+// findByPod matches Config.PodName and Config.PodNamespace against the pod
+// labels, if configured. Every container of a pod carries them, so one
+// with an IP is preferred.
+func (ipf *IPFinderFromMetadata) findByPod(candidates []rancherContainer) (rancherContainer, bool) {
+	if ipf.config.PodName == "" {
+		return rancherContainer{}, false
+	}
+	var found rancherContainer
+	ok := false
+	for _, container := range candidates {
+		if container.Labels[podNameLabel] != ipf.config.PodName {
+			continue
+		}
+		if ipf.config.PodNamespace != "" && container.Labels[podNamespaceLabel] != ipf.config.PodNamespace {
+			continue
+		}
+		if ipf.config.containerIP(container) != "" {
+			log.Infof("rancher-cni-ipam: matched container %s by pod %s/%s", container.UUID, ipf.config.PodNamespace, ipf.config.PodName)
+			return container, true
+		}
+		if !ok {
+			found, ok = container, true
+		}
+	}
+	return found, ok
+}
+
+// findByNetnsInode matches Config.NetnsInode against the label of the
+// same name, if configured.
+func (ipf *IPFinderFromMetadata) findByNetnsInode(candidates []rancherContainer) (rancherContainer, bool) {
+	if ipf.config.NetnsInode == "" || ipf.config.NetnsInodeLabel == "" {
+		return rancherContainer{}, false
+	}
+	for _, container := range candidates {
+		if container.Labels[ipf.config.NetnsInodeLabel] == ipf.config.NetnsInode {
+			log.Infof("rancher-cni-ipam: matched container %s by netns inode %s", container.UUID, ipf.config.NetnsInode)
+			return container, true
+		}
+	}
+	return rancherContainer{}, false
+}
+
+// findOne is findContainer for a single rancherid. The identity fields
+// are consulted in order, a field matching if its normalized value is cid
+// or rancherid, which are already normalized.
+func (ipf *IPFinderFromMetadata) findOne(candidates []rancherContainer, cid, rancherid string) (rancherContainer, bool) {
+	var found rancherContainer
+	ok := false
+	fields := ipf.config.identityFields()
+	for _, field := range fields {
+		value, err := identityField(field)
+		if err != nil {
+			continue
+		}
+		for _, container := range candidates {
+			v := ipf.config.normalize(value(container))
+			if v == "" || (v != cid && v != rancherid) {
+				continue
+			}
+			if ip := ipf.config.containerIP(container); ip != "" {
+				log.Infof("rancher-cni-ipam: got ip by %s: %v", field, ip)
+				return container, true
+			}
+			if !ok {
+				found, ok = container, true
+			}
+		}
+	}
+	if !ok && len(rancherid) >= minShortUUIDLength && hasUUIDField(fields) {
+		return findByShortUUID(candidates, rancherid, ipf.config.normalize)
+	}
+	return found, ok
+}
+
+// hasUUIDField reports whether UUID is among fields, which enables short
+// rancherid matching.
+func hasUUIDField(fields []string) bool {
+	return contains(fields, "UUID")
+}
+
+// findByShortUUID matches a truncated rancherid against the start of the
+// normalized container UUIDs. A prefix shared by several containers
+// matches none.
+func findByShortUUID(containers []rancherContainer, rancherid string, normalize func(string) string) (rancherContainer, bool) {
+	var matches []rancherContainer
+	for _, container := range containers {
+		if strings.HasPrefix(normalize(container.UUID), rancherid) {
+			matches = append(matches, container)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return rancherContainer{}, false
+	case 1:
+		log.Infof("rancher-cni-ipam: matched short rancherid %s to %s", rancherid, matches[0].UUID)
+		return matches[0], true
+	default:
+		log.Warnf("rancher-cni-ipam: short rancherid %s is ambiguous, it matches %d containers", rancherid, len(matches))
+		return rancherContainer{}, false
+	}
+}
+
+// candidates applies the host scope and scan cap to the container list
+// before it is searched.
+func (ipf *IPFinderFromMetadata) candidates(containers []rancherContainer) []rancherContainer {
+	if ipf.config.HostUUID != "" {
+		var scoped []rancherContainer
+		for _, container := range containers {
+			if container.HostUUID == ipf.config.HostUUID {
+				scoped = append(scoped, container)
 			}
 		}
-		log.Infof("Waiting to find IP for container: %s, %s", cid, rancherid)
-		time.Sleep(500 * time.Millisecond)
+		containers = scoped
+	}
+	if ipf.config.MaxScan > 0 && len(containers) > ipf.config.MaxScan {
+		log.Warnf("rancher-cni-ipam: scanning only %d of %d containers", ipf.config.MaxScan, len(containers))
+		containers = containers[:ipf.config.MaxScan]
 	}
-	log.Infof("ip not found for cid: %v", cid)
-	return emptyIPAddress
+	return containers
 }
@@ -0,0 +1,630 @@
+package metadata
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+)
+
+func TestGetIPScope(t *testing.T) {
+	other := testContainer("other", "uuid-other", "10.42.0.9")
+	other.HostUUID = "host-2"
+	target := testContainer("target", "uuid-target", "10.42.0.5")
+	tests := []struct {
+		name     string
+		hostUUID string
+		maxScan  int
+		wantIP   string
+		wantKind error
+	}{
+		{name: "all hosts", wantIP: "10.42.0.5"},
+		{name: "host of the container", hostUUID: "host-1", wantIP: "10.42.0.5"},
+		{name: "other host", hostUUID: "host-2", wantKind: ipfinder.ErrContainerNotFound},
+		{name: "scan cap above the container", maxScan: 2, wantIP: "10.42.0.5"},
+		{name: "scan cap below the container", maxScan: 1, wantKind: ipfinder.ErrContainerNotFound},
+	}
+	for _, tt := range tests {
+		_, server := newFakeMetadata(other, target)
+		config := testConfig(server.URL)
+		config.HostUUID = tt.hostUUID
+		config.MaxScan = tt.maxScan
+		ipf, err := NewIPFinderFromMetadata(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		ip, err := ipf.GetIP("target", "")
+		server.Close()
+		if ip != tt.wantIP {
+			t.Errorf("%s: GetIP() = %q, want %q", tt.name, ip, tt.wantIP)
+		}
+		if tt.wantKind != nil && !isKind(err, tt.wantKind) {
+			t.Errorf("%s: GetIP() error = %v, want %v", tt.name, err, tt.wantKind)
+		}
+	}
+}
+
+// isKind reports whether err is an *ipfinder.Error of the given kind.
+func isKind(err, kind error) bool {
+	e, ok := err.(*ipfinder.Error)
+	return ok && e.Kind == kind
+}
+
+// benchmarkContainers is the size of the BenchmarkGetIP fixture, that of
+// a large environment.
+const benchmarkContainers = 5000
+
+// BenchmarkGetIP measures a lookup of the last container of a large list,
+// the worst case of the linear scan, unscoped, scoped to the host of a
+// tenth of the containers, and looked up directly.
+func BenchmarkGetIP(b *testing.B) {
+	var containers []rancherContainer
+	for i := 0; i < benchmarkContainers; i++ {
+		c := testContainer(fmt.Sprintf("ext-%d", i), fmt.Sprintf("uuid-%d", i), fmt.Sprintf("10.42.%d.%d", i/250, i%250+1))
+		c.HostUUID = fmt.Sprintf("host-%d", i%10)
+		containers = append(containers, c)
+	}
+	last := containers[len(containers)-1]
+	_, server := newFakeMetadata(containers...)
+	defer server.Close()
+
+	for _, bb := range []struct {
+		name   string
+		config func(*Config)
+	}{
+		{"Scan", func(*Config) {}},
+		{"HostUUID", func(c *Config) { c.HostUUID = last.HostUUID }},
+		{"Targeted", func(c *Config) { c.TargetedLookupThreshold = 1 }},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			config := testConfig(server.URL)
+			bb.config(&config)
+			ipf, err := NewIPFinderFromMetadata(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if ip, err := ipf.GetIP(last.ExternalId, last.UUID); ip != last.PrimaryIp {
+					b.Fatalf("GetIP() = %q, %v", ip, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetIPImmediate(t *testing.T) {
+	ready := testContainer("ready", "uuid-ready", "10.42.0.5")
+	pending := testContainer("pending", "uuid-pending", "")
+	tests := []struct {
+		name     string
+		cid      string
+		wantIP   string
+		wantKind error
+	}{
+		{name: "with IP", cid: "ready", wantIP: "10.42.0.5"},
+		{name: "present without IP", cid: "pending", wantKind: ipfinder.ErrIPPending},
+		{name: "absent", cid: "absent", wantKind: ipfinder.ErrContainerNotFound},
+	}
+	for _, tt := range tests {
+		m, server := newFakeMetadata(ready, pending)
+		ipf, err := NewIPFinderFromMetadata(testConfig(server.URL))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		before := m.listCount()
+		ip, err := ipf.GetIPImmediate(tt.cid, "")
+		server.Close()
+		if ip != tt.wantIP {
+			t.Errorf("%s: GetIPImmediate() = %q, want %q", tt.name, ip, tt.wantIP)
+		}
+		if tt.wantKind != nil && !isKind(err, tt.wantKind) {
+			t.Errorf("%s: GetIPImmediate() error = %v, want %v", tt.name, err, tt.wantKind)
+		}
+		if n := m.listCount() - before; n != 1 {
+			t.Errorf("%s: %d container lists, want a single refresh", tt.name, n)
+		}
+	}
+}
+
+func TestGetIPNoContainersYet(t *testing.T) {
+	tests := []struct {
+		name      string
+		immediate bool
+		wantIP    string
+		wantKind  error
+		wantLists int
+	}{
+		{name: "polling", wantIP: "10.42.0.5", wantLists: 2},
+		{name: "immediate", immediate: true, wantKind: ipfinder.ErrContainerNotFound, wantLists: 1},
+	}
+	for _, tt := range tests {
+		m, server := newFakeMetadata(testContainer("web", "uuid-web", "10.42.0.5"))
+		ipf, err := NewIPFinderFromMetadata(testConfig(server.URL))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// The next list answers 404, the one after lists the container.
+		m.mu.Lock()
+		before := m.lists
+		m.notFound = before + 1
+		m.mu.Unlock()
+		var ip string
+		if tt.immediate {
+			ip, err = ipf.GetIPImmediate("web", "")
+		} else {
+			ip, err = ipf.GetIP("web", "")
+		}
+		server.Close()
+		if ip != tt.wantIP {
+			t.Errorf("%s: got IP %q, %v, want %q", tt.name, ip, err, tt.wantIP)
+		}
+		if tt.wantKind != nil && !isKind(err, tt.wantKind) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantKind)
+		}
+		if tt.wantKind == nil && err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+		if n := m.listCount() - before; n != tt.wantLists {
+			t.Errorf("%s: %d container lists, want %d", tt.name, n, tt.wantLists)
+		}
+	}
+}
+
+func TestGetIPConfirmations(t *testing.T) {
+	// seq returns the IP of the n-th list, counting from 1, repeating
+	// the last entry.
+	seq := func(ips ...string) func(n int) string {
+		return func(n int) string {
+			if n > len(ips) {
+				n = len(ips)
+			}
+			return ips[n-1]
+		}
+	}
+	tests := []struct {
+		name          string
+		confirmations int
+		ip            func(n int) string
+		wantIP        string
+		wantKind      error
+		wantLists     int
+	}{
+		{name: "no confirmation", ip: seq("10.42.0.7", "10.42.0.5"), wantIP: "10.42.0.7", wantLists: 1},
+		{name: "stable", confirmations: 3, ip: seq("10.42.0.5"), wantIP: "10.42.0.5", wantLists: 3},
+		{name: "flap then settle", confirmations: 3, ip: seq("10.42.0.5", "10.42.0.7", "10.42.0.5"), wantIP: "10.42.0.5", wantLists: 5},
+		{name: "gap resets", confirmations: 2, ip: seq("10.42.0.5", "", "10.42.0.5"), wantIP: "10.42.0.5", wantLists: 4},
+		{
+			name:          "never settles",
+			confirmations: 2,
+			ip: func(n int) string {
+				if n%2 == 0 {
+					return "10.42.0.7"
+				}
+				return "10.42.0.5"
+			},
+			wantKind: ipfinder.ErrIPPending,
+		},
+	}
+	for _, tt := range tests {
+		m, server := newFakeMetadata(testContainer("web", "uuid-web", ""))
+		config := testConfig(server.URL)
+		config.Confirmations = tt.confirmations
+		ipf, err := NewIPFinderFromMetadata(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		m.mu.Lock()
+		before := m.lists
+		m.beforeList = func(n int) { m.containers[0].PrimaryIp = tt.ip(n - before) }
+		m.mu.Unlock()
+		ip, err := ipf.GetIP("web", "")
+		server.Close()
+		if tt.wantKind != nil {
+			if !isKind(err, tt.wantKind) {
+				t.Errorf("%s: GetIP() = %q, %v, want %v", tt.name, ip, err, tt.wantKind)
+			}
+			continue
+		}
+		if ip != tt.wantIP || err != nil {
+			t.Errorf("%s: GetIP() = %q, %v, want %q", tt.name, ip, err, tt.wantIP)
+		}
+		if n := m.listCount() - before; n != tt.wantLists {
+			t.Errorf("%s: %d container lists, want %d", tt.name, n, tt.wantLists)
+		}
+	}
+}
+
+func TestGetIPWatchChanges(t *testing.T) {
+	tests := []struct {
+		name       string
+		watch      bool
+		longPoll   bool
+		wantSleeps int
+	}{
+		{name: "polling", wantSleeps: 2},
+		{name: "watching", watch: true, longPoll: true},
+		{name: "watching without long polling", watch: true, wantSleeps: 2},
+	}
+	for _, tt := range tests {
+		m, server := newFakeMetadata(testContainer("web", "uuid-web", ""))
+		config := testConfig(server.URL)
+		config.WatchChanges = tt.watch
+		ipf, err := NewIPFinderFromMetadata(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		m.mu.Lock()
+		before := m.lists
+		// The IP shows up in the third list, or with the first change.
+		m.beforeList = func(n int) {
+			if n-before == 3 {
+				m.containers[0].PrimaryIp = "10.42.0.5"
+			}
+		}
+		if tt.longPoll {
+			m.onWatch = func() { m.containers[0].PrimaryIp = "10.42.0.5" }
+		}
+		m.mu.Unlock()
+		ip, err := ipf.GetIP("web", "")
+		server.Close()
+		if ip != "10.42.0.5" || err != nil {
+			t.Errorf("%s: GetIP() = %q, %v", tt.name, ip, err)
+		}
+		if sleeps := config.Clock.(*FakeClock).Sleeps(); len(sleeps) != tt.wantSleeps {
+			t.Errorf("%s: slept %v, want %d interval waits", tt.name, sleeps, tt.wantSleeps)
+		}
+	}
+}
+
+func TestGetContainerByIP(t *testing.T) {
+	old := testContainer("old", "uuid-old", "10.42.0.5")
+	replacement := testContainer("new", "uuid-new", "10.42.0.5")
+	multi := testContainer("multi", "uuid-multi", "10.42.0.6")
+	multi.Ips = []string{"10.42.0.6", "fd00::7/64"}
+	tests := []struct {
+		name    string
+		ip      string
+		want    []string
+		wantErr bool
+	}{
+		{name: "two owners", ip: "10.42.0.5", want: []string{"uuid-old", "uuid-new"}},
+		{name: "secondary address", ip: "fd00::7", want: []string{"uuid-multi"}},
+		{name: "non-canonical spelling", ip: "fd00:0::7", want: []string{"uuid-multi"}},
+		{name: "no owner", ip: "10.42.0.9"},
+		{name: "invalid", ip: "10.42.0", wantErr: true},
+	}
+	m, server := newFakeMetadata(old, replacement, multi)
+	defer server.Close()
+	ipf, err := NewIPFinderFromMetadata(testConfig(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		before := m.listCount()
+		owners, err := ipf.GetContainerByIP(tt.ip)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: GetContainerByIP() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		var got []string
+		for _, owner := range owners {
+			got = append(got, owner.UUID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: GetContainerByIP() = %v, want %v", tt.name, got, tt.want)
+		}
+		if n := m.listCount() - before; !tt.wantErr && n != 1 {
+			t.Errorf("%s: %d container lists, want one without polling", tt.name, n)
+		}
+	}
+}
+
+func TestGetIPShortUUID(t *testing.T) {
+	containers := []rancherContainer{
+		testContainer("a", "1a2b3c4d-5e6f-aaaa", "10.42.0.1"),
+		testContainer("b", "1a2b3c4d-5e6f-bbbb", "10.42.0.2"),
+		testContainer("c", "9f8e7d6c-5b4a-cccc", "10.42.0.3"),
+	}
+	tests := []struct {
+		name      string
+		rancherid string
+		wantIP    string
+	}{
+		{name: "exact", rancherid: "1a2b3c4d-5e6f-bbbb", wantIP: "10.42.0.2"},
+		{name: "unique prefix", rancherid: "9f8e7d6c", wantIP: "10.42.0.3"},
+		{name: "ambiguous prefix", rancherid: "1a2b3c4d-5e6f"},
+		{name: "prefix too short", rancherid: "9f8e7d6"},
+		{name: "no match", rancherid: "00000000"},
+	}
+	_, server := newFakeMetadata(containers...)
+	defer server.Close()
+	for _, tt := range tests {
+		ipf, err := NewIPFinderFromMetadata(testConfig(server.URL))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		ip, err := ipf.GetIPImmediate("unknown", tt.rancherid)
+		if ip != tt.wantIP {
+			t.Errorf("%s: GetIPImmediate() = %q, want %q", tt.name, ip, tt.wantIP)
+		}
+		if tt.wantIP == "" && !isKind(err, ipfinder.ErrContainerNotFound) {
+			t.Errorf("%s: GetIPImmediate() error = %v, want %v", tt.name, err, ipfinder.ErrContainerNotFound)
+		}
+	}
+}
+
+func TestGetIPWaitLogging(t *testing.T) {
+	tests := []struct {
+		name        string
+		pollTimeout time.Duration
+		sampleRate  int
+		wantLines   int
+	}{
+		// 5 polls log the first wait only.
+		{name: "short lookup", pollTimeout: 450 * time.Millisecond, wantLines: 1},
+		// 50 polls log the first wait and every tenth.
+		{name: "long lookup", pollTimeout: 5 * time.Second, wantLines: 6},
+		// 50 polls log waits 1, 5, 9, ... 49.
+		{name: "sampled 1 in 4", pollTimeout: 5 * time.Second, sampleRate: 4, wantLines: 13},
+		{name: "sampled 1 in 1", pollTimeout: 5 * time.Second, sampleRate: 1, wantLines: 50},
+	}
+	for _, tt := range tests {
+		_, server := newFakeMetadata()
+		config := testConfig(server.URL)
+		config.PollInterval = 100 * time.Millisecond
+		config.PollTimeout = tt.pollTimeout
+		config.PollLogSampleRate = tt.sampleRate
+		ipf, err := NewIPFinderFromMetadata(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		buf, restore := captureLog()
+		ipf.GetIP("absent", "")
+		restore()
+		server.Close()
+		if n := strings.Count(buf.String(), "aiting to find IP"); n != tt.wantLines {
+			t.Errorf("%s: %d waiting lines, want %d:\n%s", tt.name, n, tt.wantLines, buf.String())
+		}
+	}
+}
+
+func TestReadyForIP(t *testing.T) {
+	runningHealthy := []string{"running", "healthy"}
+	tests := []struct {
+		name        string
+		readyStates []string
+		state       string
+		health      string
+		want        bool
+	}{
+		{name: "any state", state: "starting", health: "unhealthy", want: true},
+		{name: "running and healthy", readyStates: runningHealthy, state: "running", health: "healthy", want: true},
+		{name: "no health check", readyStates: runningHealthy, state: "running", want: true},
+		{name: "no state reported", readyStates: runningHealthy, want: true},
+		{name: "unhealthy", readyStates: runningHealthy, state: "running", health: "unhealthy"},
+		{name: "initializing", readyStates: runningHealthy, state: "running", health: "initializing"},
+		{name: "starting", readyStates: runningHealthy, state: "starting", health: "healthy"},
+		{name: "initializing accepted", readyStates: []string{"running", "healthy", "initializing"}, state: "running", health: "initializing", want: true},
+	}
+	for _, tt := range tests {
+		if got := readyForIP(tt.readyStates, tt.state, tt.health); got != tt.want {
+			t.Errorf("%s: readyForIP(%v, %q, %q) = %v, want %v", tt.name, tt.readyStates, tt.state, tt.health, got, tt.want)
+		}
+	}
+}
+
+func TestGetIPByPod(t *testing.T) {
+	pod := func(id, name, namespace, ip string) rancherContainer {
+		c := testContainer(id, "uuid-"+id, ip)
+		c.Labels = map[string]string{podNameLabel: name, podNamespaceLabel: namespace}
+		return c
+	}
+	_, server := newFakeMetadata(
+		pod("pause-default", "web-0", "default", ""),
+		pod("app-default", "web-0", "default", "10.42.0.5"),
+		pod("app-other", "web-0", "other", "10.42.0.9"),
+		pod("pause-db", "db-0", "default", ""),
+	)
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		cid       string
+		pod       string
+		namespace string
+		wantIP    string
+		wantKind  error
+	}{
+		{name: "pod in namespace", cid: "sandbox", pod: "web-0", namespace: "default", wantIP: "10.42.0.5"},
+		{name: "pod in other namespace", cid: "sandbox", pod: "web-0", namespace: "other", wantIP: "10.42.0.9"},
+		{name: "pod name only", cid: "sandbox", pod: "web-0", wantIP: "10.42.0.5"},
+		{name: "id before pod", cid: "app-other", pod: "web-0", namespace: "default", wantIP: "10.42.0.9"},
+		{name: "pod without IP", cid: "sandbox", pod: "db-0", wantKind: ipfinder.ErrIPPending},
+		{name: "wrong namespace", cid: "sandbox", pod: "db-0", namespace: "other", wantKind: ipfinder.ErrContainerNotFound},
+		{name: "no pod", cid: "sandbox", wantKind: ipfinder.ErrContainerNotFound},
+	}
+	for _, tt := range tests {
+		config := testConfig(server.URL)
+		config.PodName = tt.pod
+		config.PodNamespace = tt.namespace
+		ipf, err := NewIPFinderFromMetadata(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		ip, err := ipf.GetIPImmediate(tt.cid, "")
+		if ip != tt.wantIP {
+			t.Errorf("%s: GetIPImmediate() = %q, %v, want %q", tt.name, ip, err, tt.wantIP)
+		}
+		if tt.wantKind != nil && !isKind(err, tt.wantKind) {
+			t.Errorf("%s: GetIPImmediate() error = %v, want %v", tt.name, err, tt.wantKind)
+		}
+	}
+}
+
+func TestMetadataVersions(t *testing.T) {
+	m, server := newFakeMetadata(testContainer("web", "uuid-web", "10.42.0.5"))
+	defer server.Close()
+	m.mu.Lock()
+	m.versions = map[string][]rancherContainer{"2016-07-29": {
+		testContainer("web", "uuid-web", "10.42.9.5"),
+		testContainer("db", "uuid-db", "10.42.0.6"),
+	}}
+	m.mu.Unlock()
+
+	tests := []struct {
+		name     string
+		versions []string
+		cid      string
+		wantIP   string
+		wantErr  bool
+	}{
+		{name: "listed by both", versions: []string{"2016-07-29"}, cid: "web", wantIP: "10.42.0.5"},
+		{name: "listed by the other", versions: []string{"2016-07-29"}, cid: "db", wantIP: "10.42.0.6"},
+		{name: "listed by neither", versions: []string{"2016-07-29"}, cid: "cache", wantErr: true},
+		{name: "default version only", cid: "db", wantErr: true},
+		{name: "version not offered", versions: []string{"2099-01-01"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		config := testConfig(server.URL)
+		config.MetadataVersions = tt.versions
+		ipf, err := NewIPFinderFromMetadata(config)
+		var ip string
+		if err == nil {
+			ip, err = ipf.GetIPImmediate(tt.cid, "")
+		}
+		if (err != nil) != tt.wantErr || ip != tt.wantIP {
+			t.Errorf("%s: GetIPImmediate() = %q, %v, want %q", tt.name, ip, err, tt.wantIP)
+		}
+	}
+}
+
+func TestRequestRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		retries   int
+		failures  int
+		wantIP    string
+		wantLists int
+	}{
+		{name: "fails twice then succeeds", failures: 2, wantIP: "10.42.0.5", wantLists: 3},
+		{name: "fails past the retries", failures: 3, wantLists: 3},
+		{name: "more retries", retries: 3, failures: 3, wantIP: "10.42.0.5", wantLists: 4},
+		{name: "retries disabled", retries: -1, failures: 1, wantLists: 1},
+	}
+	for _, tt := range tests {
+		m, server := newFakeMetadata(testContainer("web", "uuid-web", "10.42.0.5"))
+		config := testConfig(server.URL)
+		config.RequestRetries = tt.retries
+		ipf, err := NewIPFinderFromMetadata(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		m.mu.Lock()
+		m.failures = m.lists + tt.failures
+		before := m.lists
+		m.mu.Unlock()
+		sleeps := len(config.Clock.(*FakeClock).Sleeps())
+		ip, err := ipf.GetIPImmediate("web", "")
+		server.Close()
+		if ip != tt.wantIP || (err != nil) != (tt.wantIP == "") {
+			t.Errorf("%s: GetIPImmediate() = %q, %v, want %q", tt.name, ip, err, tt.wantIP)
+		}
+		if n := m.listCount() - before; n != tt.wantLists {
+			t.Errorf("%s: %d container lists, want %d", tt.name, n, tt.wantLists)
+		}
+		if n := len(config.Clock.(*FakeClock).Sleeps()) - sleeps; n != tt.wantLists-1 {
+			t.Errorf("%s: %d waits between %d lists", tt.name, n, tt.wantLists)
+		}
+	}
+}
+
+func TestTargetedLookupThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		rancherid string
+		wantLists int
+		wantGets  int
+	}{
+		{name: "over the threshold", threshold: 2, rancherid: "uuid-web", wantLists: 1, wantGets: 1},
+		{name: "disabled", rancherid: "uuid-web", wantLists: 2},
+		{name: "under the threshold", threshold: 3, rancherid: "uuid-web", wantLists: 2},
+		{name: "several rancherids", threshold: 2, rancherid: "uuid-sidecar,uuid-web", wantLists: 2},
+		{name: "no rancherid", threshold: 2, wantLists: 2},
+	}
+	for _, tt := range tests {
+		m, server := newFakeMetadata(
+			testContainer("web", "uuid-web", "10.42.0.5"),
+			testContainer("db", "uuid-db", "10.42.0.6"),
+			testContainer("cache", "uuid-cache", "10.42.0.7"),
+		)
+		config := testConfig(server.URL)
+		config.TargetedLookupThreshold = tt.threshold
+		// A second poll confirms the IP, the first targeted one when
+		// the list is over the threshold.
+		config.Confirmations = 2
+		ipf, err := NewIPFinderFromMetadata(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		m.mu.Lock()
+		lists, gets := m.lists, m.gets
+		m.mu.Unlock()
+		ip, err := ipf.GetIP("web", tt.rancherid)
+		server.Close()
+		if ip != "10.42.0.5" {
+			t.Errorf("%s: GetIP() = %q, %v, want 10.42.0.5", tt.name, ip, err)
+		}
+		m.mu.Lock()
+		if m.lists-lists != tt.wantLists || m.gets-gets != tt.wantGets {
+			t.Errorf("%s: %d lists and %d single lookups, want %d and %d", tt.name, m.lists-lists, m.gets-gets, tt.wantLists, tt.wantGets)
+		}
+		m.mu.Unlock()
+	}
+}
+
+func TestGetIPAutoAssign(t *testing.T) {
+	auto := testContainer("auto", "uuid-auto", "10.42.0.5")
+	auto.Labels = map[string]string{"io.rancher.ipam": "auto"}
+	pending := testContainer("auto-pending", "uuid-auto-pending", "")
+	pending.Labels = map[string]string{"io.rancher.ipam": "auto"}
+	other := testContainer("other", "uuid-other", "10.42.0.6")
+	other.Labels = map[string]string{"io.rancher.ipam": "static"}
+	_, server := newFakeMetadata(auto, pending, other)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		label    string
+		cid      string
+		wantIP   string
+		wantKind error
+	}{
+		{name: "auto", label: "io.rancher.ipam", cid: "auto", wantKind: ipfinder.ErrAutoAssign},
+		{name: "auto without IP", label: "io.rancher.ipam", cid: "auto-pending", wantKind: ipfinder.ErrAutoAssign},
+		{name: "other value", label: "io.rancher.ipam", cid: "other", wantIP: "10.42.0.6"},
+		{name: "label not configured", cid: "auto", wantIP: "10.42.0.5"},
+	}
+	for _, tt := range tests {
+		config := testConfig(server.URL)
+		config.AutoAssignLabel = tt.label
+		for _, immediate := range []bool{false, true} {
+			ipf, err := NewIPFinderFromMetadata(config)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			var ip string
+			if immediate {
+				ip, err = ipf.GetIPImmediate(tt.cid, "")
+			} else {
+				ip, err = ipf.GetIP(tt.cid, "")
+			}
+			if ip != tt.wantIP || (tt.wantKind != nil && !isKind(err, tt.wantKind)) {
+				t.Errorf("%s: immediate %v: lookup = %q, %v, want %q, %v", tt.name, immediate, ip, err, tt.wantIP, tt.wantKind)
+			}
+		}
+	}
+}
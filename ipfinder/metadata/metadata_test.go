@@ -0,0 +1,146 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// fakeMetadata is a Rancher metadata service serving DefaultVersion from
+// memory. Its fields may be changed between requests under mu.
+type fakeMetadata struct {
+	mu         sync.Mutex
+	containers []rancherContainer
+	selfHost   metadata.Host
+	services   []metadata.Service
+	// lists counts the container list requests served, and gets those
+	// of a single container.
+	lists int
+	gets  int
+	// beforeList, if set, runs under mu before the n-th container list,
+	// counting from 1, is served, and may change the containers.
+	beforeList func(n int)
+	// notFound answers that many container lists with 404, as a
+	// service without container data yet does.
+	notFound int
+	// failures answers the container lists after those with a server
+	// error, up to that count, as a service blip does.
+	failures int
+	// onWatch, if set, makes the service support long polling: a
+	// version wait runs it under mu, as the change being waited for,
+	// and returns the next version.
+	onWatch func()
+	changes int
+	// versions maps further API versions to the containers they list.
+	versions map[string][]rancherContainer
+}
+
+// newFakeMetadata starts a metadata service listing containers. The
+// caller closes the returned server.
+func newFakeMetadata(containers ...rancherContainer) (*fakeMetadata, *httptest.Server) {
+	m := &fakeMetadata{containers: containers}
+	return m, httptest.NewServer(m)
+}
+
+func (m *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/"+DefaultVersion)
+	containers := m.containers
+	versions := []string{DefaultVersion}
+	for version, listed := range m.versions {
+		versions = append(versions, version)
+		if strings.HasPrefix(r.URL.Path, "/"+version+"/") {
+			path, containers = strings.TrimPrefix(r.URL.Path, "/"+version), listed
+		}
+	}
+	switch {
+	case r.URL.Path == "/":
+		m.reply(w, versions)
+	case path == "/version":
+		if r.URL.Query().Get("wait") == "true" && m.onWatch != nil {
+			m.onWatch()
+			m.changes++
+		}
+		fmt.Fprint(w, 1+m.changes)
+	case path == "/containers":
+		m.lists++
+		if m.beforeList != nil {
+			m.beforeList(m.lists)
+		}
+		if m.lists <= m.notFound {
+			http.NotFound(w, r)
+			return
+		}
+		if m.lists <= m.failures {
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		m.reply(w, containers)
+	case strings.HasPrefix(path, "/containers/"):
+		m.gets++
+		key := strings.TrimPrefix(path, "/containers/")
+		for _, container := range containers {
+			if container.UUID == key || container.Name == key {
+				m.reply(w, container)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	case path == "/self/host":
+		if m.selfHost.UUID == "" {
+			http.NotFound(w, r)
+			return
+		}
+		m.reply(w, m.selfHost)
+	case path == "/services":
+		m.reply(w, m.services)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listCount returns how many container lists have been served.
+func (m *fakeMetadata) listCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lists
+}
+
+func (m *fakeMetadata) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// testContainer returns a running container with the given ids and IP.
+func testContainer(externalID, uuid, ip string) rancherContainer {
+	c := rancherContainer{State: "running"}
+	c.ExternalId = externalID
+	c.UUID = uuid
+	c.PrimaryIp = ip
+	c.HostUUID = "host-1"
+	return c
+}
+
+// testConfig returns a Config for the fake service at url that polls on
+// a fake clock.
+func testConfig(url string) Config {
+	return Config{MetadataRoot: url, Clock: NewFakeClock(time.Unix(0, 0))}
+}
+
+// captureLog sends the standard logger to a buffer until the returned
+// function is called.
+func captureLog() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	saved := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	return &buf, func() { log.SetOutput(saved) }
+}
@@ -0,0 +1,56 @@
+package metadata
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Identifier normalization steps, applied in the configured order to the
+// looked-up ids and to the metadata identity fields before they are
+// compared.
+const (
+	NormalizeTrim        = "trim"
+	NormalizeLowercase   = "lowercase"
+	NormalizeStripPrefix = "stripPrefix"
+)
+
+// defaultNormalizeSteps is the pipeline used when none is configured.
+var defaultNormalizeSteps = []string{NormalizeTrim}
+
+// ValidateNormalizeSteps returns an error for an unknown step name.
+func ValidateNormalizeSteps(steps []string) error {
+	for _, step := range steps {
+		switch step {
+		case NormalizeTrim, NormalizeLowercase, NormalizeStripPrefix:
+		default:
+			return fmt.Errorf("unknown normalize step %q", step)
+		}
+	}
+	return nil
+}
+
+// normalize runs id through Config.NormalizeSteps, or the default
+// pipeline. The stripPrefix step removes the first of
+// Config.StripPrefixes that id starts with, such as "docker://".
+func (c Config) normalize(id string) string {
+	steps := c.NormalizeSteps
+	if len(steps) == 0 {
+		steps = defaultNormalizeSteps
+	}
+	for _, step := range steps {
+		switch step {
+		case NormalizeTrim:
+			id = strings.TrimSpace(id)
+		case NormalizeLowercase:
+			id = strings.ToLower(id)
+		case NormalizeStripPrefix:
+			for _, prefix := range c.StripPrefixes {
+				if strings.HasPrefix(id, prefix) {
+					id = strings.TrimPrefix(id, prefix)
+					break
+				}
+			}
+		}
+	}
+	return id
+}
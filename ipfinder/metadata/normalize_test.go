@@ -0,0 +1,68 @@
+package metadata
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	prefixes := []string{"docker://", "containerd://"}
+	tests := []struct {
+		name  string
+		steps []string
+		id    string
+		want  string
+	}{
+		{name: "default trim", id: "  abc123\n", want: "abc123"},
+		{name: "default keeps case", id: "ABC123", want: "ABC123"},
+		{name: "lowercase", steps: []string{NormalizeLowercase}, id: "ABC123", want: "abc123"},
+		{name: "lowercase keeps padding", steps: []string{NormalizeLowercase}, id: " ABC123 ", want: " abc123 "},
+		{name: "decorated", steps: []string{NormalizeTrim, NormalizeStripPrefix, NormalizeLowercase}, id: " docker://ABC123 ", want: "abc123"},
+		{name: "first prefix only", steps: []string{NormalizeStripPrefix}, id: "containerd://docker://abc123", want: "docker://abc123"},
+		{name: "padding hides the prefix", steps: []string{NormalizeStripPrefix, NormalizeTrim}, id: " docker://abc123", want: "docker://abc123"},
+		{name: "case hides the prefix", steps: []string{NormalizeStripPrefix, NormalizeLowercase}, id: "DOCKER://ABC123", want: "docker://abc123"},
+		{name: "lowercase reveals the prefix", steps: []string{NormalizeLowercase, NormalizeStripPrefix}, id: "DOCKER://ABC123", want: "abc123"},
+	}
+	for _, tt := range tests {
+		config := Config{NormalizeSteps: tt.steps, StripPrefixes: prefixes}
+		if got := config.normalize(tt.id); got != tt.want {
+			t.Errorf("%s: normalize(%q) = %q, want %q", tt.name, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestGetIPNormalized(t *testing.T) {
+	decorated := testContainer("docker://DEF456", "uuid-def", "10.42.0.6")
+	_, server := newFakeMetadata(testContainer("abc123", "uuid-abc", "10.42.0.5"), decorated)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		steps  []string
+		cid    string
+		wantIP string
+	}{
+		{name: "decorated id", steps: []string{NormalizeTrim, NormalizeStripPrefix, NormalizeLowercase}, cid: " docker://ABC123 ", wantIP: "10.42.0.5"},
+		{name: "decorated metadata", steps: []string{NormalizeTrim, NormalizeStripPrefix, NormalizeLowercase}, cid: "def456", wantIP: "10.42.0.6"},
+		{name: "padded id", cid: "\tabc123 ", wantIP: "10.42.0.5"},
+		{name: "uppercased id unnormalized", cid: "ABC123"},
+	}
+	for _, tt := range tests {
+		config := testConfig(server.URL)
+		config.NormalizeSteps = tt.steps
+		config.StripPrefixes = []string{"docker://"}
+		ipf, err := NewIPFinderFromMetadata(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ip, err := ipf.GetIPImmediate(tt.cid, ""); ip != tt.wantIP {
+			t.Errorf("%s: GetIPImmediate(%q) = %q, %v, want %q", tt.name, tt.cid, ip, err, tt.wantIP)
+		}
+	}
+}
+
+func TestValidateNormalizeSteps(t *testing.T) {
+	if err := ValidateNormalizeSteps([]string{NormalizeTrim, NormalizeLowercase, NormalizeStripPrefix}); err != nil {
+		t.Errorf("ValidateNormalizeSteps() of the known steps = %v", err)
+	}
+	if err := ValidateNormalizeSteps([]string{NormalizeTrim, "uppercase"}); err == nil {
+		t.Errorf("ValidateNormalizeSteps() accepted an unknown step")
+	}
+}
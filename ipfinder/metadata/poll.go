@@ -0,0 +1,84 @@
+package metadata
+
+import (
+	"fmt"
+	"time"
+)
+
+// Poll strategies select how the wait between metadata polls grows.
+const (
+	PollFixed       = "fixed"
+	PollLinear      = "linear"
+	PollExponential = "exponential"
+)
+
+// pollStrategies compute the next wait from the initial and current ones.
+var pollStrategies = map[string]func(initial, current time.Duration) time.Duration{
+	PollFixed: func(initial, current time.Duration) time.Duration {
+		return current
+	},
+	PollLinear: func(initial, current time.Duration) time.Duration {
+		return current + initial
+	},
+	PollExponential: func(initial, current time.Duration) time.Duration {
+		return current * 2
+	},
+}
+
+// ValidatePollStrategy returns an error for an unknown strategy name. An
+// empty name selects PollFixed.
+func ValidatePollStrategy(name string) error {
+	if _, ok := pollStrategies[name]; !ok && name != "" {
+		return fmt.Errorf("unknown poll strategy %q", name)
+	}
+	return nil
+}
+
+// pollTimeout returns Config.PollTimeout or its default.
+func (c Config) pollTimeout() time.Duration {
+	if c.PollTimeout > 0 {
+		return c.PollTimeout
+	}
+	return pollTimeout
+}
+
+// pollInterval returns the wait before the second poll.
+func (c Config) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return c.PollInterval
+	}
+	return defaultPollInterval
+}
+
+// nextPollInterval returns the wait that follows one of interval under
+// the configured strategy, capped at MaxPollInterval.
+func (c Config) nextPollInterval(interval time.Duration) time.Duration {
+	strategy, ok := pollStrategies[c.PollStrategy]
+	if !ok {
+		strategy = pollStrategies[PollFixed]
+	}
+	next := strategy(c.pollInterval(), interval)
+	if c.MaxPollInterval > 0 && next > c.MaxPollInterval && next > interval {
+		next = c.MaxPollInterval
+	}
+	return next
+}
+
+// logsWait reports whether the waits-th waiting message of a lookup is
+// logged. Rather than one line per poll, the first wait is logged and
+// then a summary every waitLogEvery polls, or every PollLogSampleRate-th
+// wait when set.
+func (c Config) logsWait(waits int) bool {
+	if c.PollLogSampleRate > 0 {
+		return (waits-1)%c.PollLogSampleRate == 0
+	}
+	return waits == 1 || waits%waitLogEvery == 0
+}
+
+// confirmations returns how many consecutive polls must agree on an IP.
+func (c Config) confirmations() int {
+	if c.Confirmations > 1 {
+		return c.Confirmations
+	}
+	return 1
+}
@@ -0,0 +1,42 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNextPollInterval(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name   string
+		config Config
+		want   []time.Duration
+	}{
+		{name: "default", want: []time.Duration{500 * ms, 500 * ms, 500 * ms, 500 * ms}},
+		{name: "fixed", config: Config{PollStrategy: PollFixed, PollInterval: 100 * ms}, want: []time.Duration{100 * ms, 100 * ms, 100 * ms, 100 * ms}},
+		{name: "linear", config: Config{PollStrategy: PollLinear, PollInterval: 100 * ms}, want: []time.Duration{100 * ms, 200 * ms, 300 * ms, 400 * ms}},
+		{name: "exponential", config: Config{PollStrategy: PollExponential, PollInterval: 100 * ms}, want: []time.Duration{100 * ms, 200 * ms, 400 * ms, 800 * ms}},
+		{name: "capped", config: Config{PollStrategy: PollExponential, PollInterval: 100 * ms, MaxPollInterval: 300 * ms}, want: []time.Duration{100 * ms, 200 * ms, 300 * ms, 300 * ms}},
+	}
+	for _, tt := range tests {
+		got := []time.Duration{tt.config.pollInterval()}
+		for len(got) < len(tt.want) {
+			got = append(got, tt.config.nextPollInterval(got[len(got)-1]))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: waits = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePollStrategy(t *testing.T) {
+	for _, name := range []string{"", PollFixed, PollLinear, PollExponential} {
+		if err := ValidatePollStrategy(name); err != nil {
+			t.Errorf("ValidatePollStrategy(%q) = %v", name, err)
+		}
+	}
+	if err := ValidatePollStrategy("random"); err == nil {
+		t.Errorf("ValidatePollStrategy(%q) = nil, want an error", "random")
+	}
+}
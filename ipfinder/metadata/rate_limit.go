@@ -0,0 +1,54 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fileRateLimiter spaces metadata calls made by concurrent plugin
+// processes on a node. The time of the last call is kept in a file that
+// is held under an exclusive flock while a caller waits for its turn, so
+// callers are served one interval apart.
+type fileRateLimiter struct {
+	path     string
+	interval time.Duration
+	clock    Clock
+}
+
+// Wait blocks until the next metadata call is allowed.
+func (l *fileRateLimiter) Wait() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if last, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil {
+		if wait := time.Unix(0, last).Add(l.interval).Sub(l.clock.Now()); wait > 0 {
+			l.clock.Sleep(wait)
+		}
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt([]byte(strconv.FormatInt(l.clock.Now().UnixNano(), 10)), 0)
+	return err
+}
@@ -0,0 +1,31 @@
+package metadata
+
+import (
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// updateReadyFile creates or removes the readiness file at path, if set.
+// O_CREATE without O_EXCL lets concurrent invocations touch the same
+// file without failing, and a missing file on removal is not an error.
+func updateReadyFile(path string, ready bool) {
+	if path == "" {
+		return
+	}
+	if !ready {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("rancher-cni-ipam: failed to remove ready file %s: %v", path, err)
+		}
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Warnf("rancher-cni-ipam: failed to create ready file %s: %v", path, err)
+		return
+	}
+	f.Close()
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
@@ -0,0 +1,51 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewClientAndWaitReadyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, up := newFakeMetadata()
+	defer up.Close()
+	_, down := newFakeMetadata()
+	down.Close()
+
+	tests := []struct {
+		name      string
+		url       string
+		existing  bool
+		wantReady bool
+	}{
+		{name: "reachable", url: up.URL, wantReady: true},
+		{name: "reachable again", url: up.URL, existing: true, wantReady: true},
+		{name: "unreachable", url: down.URL, existing: true},
+		{name: "unreachable without file", url: down.URL},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if tt.existing {
+			if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		config := testConfig(tt.url)
+		config.ConnectTimeout = 100 * time.Millisecond
+		config.ReadyFile = path
+		_, err := newClientAndWait(config)
+		if (err == nil) != tt.wantReady {
+			t.Errorf("%s: newClientAndWait() error = %v", tt.name, err)
+		}
+		if _, err := os.Stat(path); (err == nil) != tt.wantReady {
+			t.Errorf("%s: ready file exists = %v, want %v", tt.name, err == nil, tt.wantReady)
+		}
+	}
+}
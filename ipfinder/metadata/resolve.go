@@ -0,0 +1,264 @@
+package metadata
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+)
+
+// ResolveContainer returns the addresses that Rancher metadata assigns to
+// a container and the labels of the container. It is the lookup the CNI
+// plugin does on ADD, usable without the CNI machinery.
+//
+// cid is the container id as known to the container runtime, and
+// rancherid is the Rancher container UUID, a comma-separated list of
+// candidate UUIDs or empty. Unless immediate is set, the lookup polls
+// metadata as configured by config until the container has an IP.
+//
+// Addresses are returned in canonical form, IPv4 addresses as 4 bytes,
+// with the prefix length read from Config.PrefixField or a nil Mask.
+// There are several under FamilyDual. A failed lookup returns an
+// *ipfinder.Error, or the bare sentinel under Config.SentinelNotFound; a
+// malformed address in metadata returns a plain error.
+func ResolveContainer(config Config, cid, rancherid string, immediate bool) ([]net.IPNet, map[string]string, error) {
+	r, err := NewResolver(config)
+	if err != nil {
+		return nil, nil, &ipfinder.Error{Kind: ipfinder.ErrMetadataUnreachable, CID: cid, RancherID: rancherid, Err: err}
+	}
+	return r.ResolveContainer(cid, rancherid, immediate)
+}
+
+// Resolver resolves containers over a metadata connection established
+// and validated once, by NewResolver, for callers such as a daemon that
+// would otherwise reconnect on every lookup. Each lookup uses the
+// Config given to NewResolver. A Resolver is safe for concurrent use.
+type Resolver struct {
+	base *IPFinderFromMetadata
+}
+
+// NewResolver waits for the metadata service as NewIPFinderFromMetadata
+// does and returns a Resolver holding the connection.
+func NewResolver(config Config) (*Resolver, error) {
+	ipf, err := NewIPFinderFromMetadata(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{base: ipf}, nil
+}
+
+// finder returns a finder for one lookup that shares the clients of r.
+func (r *Resolver) finder() *IPFinderFromMetadata {
+	return &IPFinderFromMetadata{m: r.base.m, config: r.base.config, source: r.base.source, limiter: r.base.limiter, others: r.base.others}
+}
+
+// ResolveContainer is the package level ResolveContainer over r.
+func (r *Resolver) ResolveContainer(cid, rancherid string, immediate bool) ([]net.IPNet, map[string]string, error) {
+	return resolveWith(r.finder(), cid, rancherid, immediate)
+}
+
+// ResolveContainerAfter is ResolveContainer waiting first for the
+// container with id depID, such as a network sidecar, to have an IP. The
+// wait for the dependency counts against the polling budget of r,
+// and the container itself is looked up in what remains. A dependency
+// that gets no IP fails the lookup with ipfinder.ErrIPPending, or
+// ipfinder.ErrMetadataUnreachable.
+func (r *Resolver) ResolveContainerAfter(depID, cid, rancherid string, immediate bool) ([]net.IPNet, map[string]string, error) {
+	config := r.base.config
+	clock := config.clock()
+	start := clock.Now()
+	dep := r.finder()
+	var err error
+	if immediate {
+		_, err = dep.GetIPImmediate(depID, "")
+	} else {
+		_, err = dep.GetIP(depID, "")
+	}
+	if err != nil {
+		kind := ipfinder.ErrIPPending
+		if e, ok := err.(*ipfinder.Error); ok && e.Kind == ipfinder.ErrMetadataUnreachable {
+			kind = e.Kind
+		}
+		return nil, nil, &ipfinder.Error{Kind: kind, CID: cid, RancherID: rancherid, Err: fmt.Errorf("dependency %s: %v", depID, err)}
+	}
+	log.Infof("rancher-cni-ipam: dependency %s has an IP, resolving %s", depID, cid)
+	ipf := r.finder()
+	// A zero PollTimeout would restore the default, so an exhausted
+	// budget leaves a single poll.
+	ipf.config.PollTimeout = config.pollTimeout() - clock.Now().Sub(start)
+	if ipf.config.PollTimeout <= 0 {
+		ipf.config.PollTimeout = time.Nanosecond
+	}
+	return resolveWith(ipf, cid, rancherid, immediate)
+}
+
+// resolveWith looks cid or rancherid up with ipf.
+func resolveWith(ipf *IPFinderFromMetadata, cid, rancherid string, immediate bool) ([]net.IPNet, map[string]string, error) {
+	var ipString string
+	var err error
+	if immediate {
+		ipString, err = ipf.GetIPImmediate(cid, rancherid)
+	} else {
+		ipString, err = ipf.GetIP(cid, rancherid)
+	}
+	if err != nil || ipString == emptyIPAddress {
+		return nil, nil, err
+	}
+	nets, err := parseNets(ipString)
+	return nets, ipf.matched.Labels, err
+}
+
+// ServiceVIP returns the VIP of a Rancher service, for headless services
+// whose address is the service's rather than a container's. service is
+// the service UUID or "<stack>/<service>". The lookup does not poll, as
+// the VIP is set when the service is created.
+func (r *Resolver) ServiceVIP(service string) (net.IP, error) {
+	m, err := r.metadataClient()
+	if err != nil {
+		return nil, err
+	}
+	services, err := m.getServices()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range services {
+		if s.UUID != service && s.StackName+"/"+s.Name != service {
+			continue
+		}
+		if s.Vip == "" {
+			return nil, fmt.Errorf("service %s has no VIP in rancher metadata", service)
+		}
+		return ParseIP(s.Vip)
+	}
+	return nil, fmt.Errorf("service %s not found in rancher metadata", service)
+}
+
+// defaultSelfHostPaths lists the metadata paths of the host record of the
+// host the caller runs on.
+var defaultSelfHostPaths = []string{"/self/host"}
+
+// NodeName returns the hostname of the Rancher host the caller runs on,
+// trying each of paths, or the default self-host path if none are given,
+// until one yields a host record with a name. The path has moved between
+// metadata versions, hence the list.
+func (r *Resolver) NodeName(paths []string) (string, error) {
+	m, err := r.metadataClient()
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		paths = defaultSelfHostPaths
+	}
+	for _, path := range paths {
+		host, err := m.getHost(path)
+		if err != nil {
+			log.Debugf("rancher-cni-ipam: no self host at %s: %v", path, err)
+			continue
+		}
+		name := host.Hostname
+		if name == "" {
+			name = host.Name
+		}
+		if name == "" {
+			log.Debugf("rancher-cni-ipam: self host at %s has no name", path)
+			continue
+		}
+		log.Infof("rancher-cni-ipam: got node name %s from %s", name, path)
+		return name, nil
+	}
+	return "", fmt.Errorf("no self host record in rancher metadata at %s", strings.Join(paths, ", "))
+}
+
+// SelfHost returns the first host record found at paths, by default
+// /self/host.
+func (r *Resolver) SelfHost(paths []string) (metadata.Host, error) {
+	m, err := r.metadataClient()
+	if err != nil {
+		return metadata.Host{}, err
+	}
+	if len(paths) == 0 {
+		paths = defaultSelfHostPaths
+	}
+	for _, path := range paths {
+		host, err := m.getHost(path)
+		if err == nil {
+			return host, nil
+		}
+		log.Debugf("rancher-cni-ipam: no self host at %s: %v", path, err)
+	}
+	return metadata.Host{}, fmt.Errorf("no self host record in rancher metadata at %s", strings.Join(paths, ", "))
+}
+
+// metadataClient returns the metadata client of r, which a Resolver from
+// NewResolverFromSource does not have.
+func (r *Resolver) metadataClient() (*client, error) {
+	if r.base.m == nil {
+		return nil, fmt.Errorf("no rancher metadata service with a container source")
+	}
+	return r.base.m, nil
+}
+
+// ParseIP parses an address as reported by metadata. IPv4 addresses are
+// returned in their 4-byte form; callers should use ip.String() so that
+// non-canonical IPv6 spellings never leak into logs or results.
+func ParseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q in rancher metadata", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// parseNets parses a metadata address field, tolerating several
+// comma-separated addresses in the one field. Invalid addresses are
+// logged and skipped.
+func parseNets(s string) ([]net.IPNet, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) == 1 {
+		n, err := parseNet(s)
+		if err != nil {
+			return nil, err
+		}
+		return []net.IPNet{n}, nil
+	}
+	var nets []net.IPNet
+	for _, field := range fields {
+		n, err := parseNet(strings.TrimSpace(field))
+		if err != nil {
+			log.Warnf("rancher-cni-ipam: ignoring %v", err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("no valid IP address in %q in rancher metadata", s)
+	}
+	return nets, nil
+}
+
+// parseNet parses an address with an optional "/<prefix length>" that
+// must fit the address family.
+func parseNet(s string) (net.IPNet, error) {
+	addr, prefix := s, ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		addr, prefix = s[:i], s[i+1:]
+	}
+	ip, err := ParseIP(addr)
+	if err != nil || prefix == "" {
+		return net.IPNet{IP: ip}, err
+	}
+	bits := 8 * len(ip)
+	ones, err := strconv.Atoi(prefix)
+	if err != nil || ones < 1 || ones > bits {
+		return net.IPNet{}, fmt.Errorf("invalid prefix length %q for %s in rancher metadata", prefix, ip.String())
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, nil
+}
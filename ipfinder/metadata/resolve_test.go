@@ -0,0 +1,203 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+)
+
+func TestResolveContainer(t *testing.T) {
+	web := testContainer("web", "uuid-web", "10.42.0.5/16")
+	web.Labels = map[string]string{"app": "web"}
+	_, server := newFakeMetadata(web)
+	defer server.Close()
+	_, down := newFakeMetadata()
+	down.Close()
+
+	tests := []struct {
+		name      string
+		url       string
+		cid       string
+		wantIP    string
+		wantLabel string
+		wantKind  error
+	}{
+		{name: "found", url: server.URL, cid: "web", wantIP: "10.42.0.5/16", wantLabel: "web"},
+		{name: "absent", url: server.URL, cid: "db", wantKind: ipfinder.ErrContainerNotFound},
+		{name: "unreachable", url: down.URL, cid: "web", wantKind: ipfinder.ErrMetadataUnreachable},
+	}
+	for _, tt := range tests {
+		config := testConfig(tt.url)
+		config.ConnectTimeout = 100 * time.Millisecond
+		nets, labels, err := ResolveContainer(config, tt.cid, "", true)
+		if tt.wantKind != nil {
+			if !isKind(err, tt.wantKind) {
+				t.Errorf("%s: ResolveContainer() error = %v, want %v", tt.name, err, tt.wantKind)
+			}
+			continue
+		}
+		if err != nil || len(nets) != 1 {
+			t.Errorf("%s: ResolveContainer() = %v, %v, want one address", tt.name, nets, err)
+			continue
+		}
+		if got := nets[0].String(); got != tt.wantIP {
+			t.Errorf("%s: address = %s, want %s", tt.name, got, tt.wantIP)
+		}
+		if labels["app"] != tt.wantLabel {
+			t.Errorf("%s: labels = %v, want app=%s", tt.name, labels, tt.wantLabel)
+		}
+	}
+}
+
+func TestResolverLookups(t *testing.T) {
+	m, server := newFakeMetadata(testContainer("web", "uuid-web", "10.42.0.5"))
+	defer server.Close()
+	m.mu.Lock()
+	m.selfHost.UUID = "host-1"
+	m.selfHost.Hostname = "node-1"
+	m.selfHost.AgentIP = "192.168.0.10"
+	m.mu.Unlock()
+	r, err := NewResolver(testConfig(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		nets, _, err := r.ResolveContainer("web", "", true)
+		if err != nil || len(nets) != 1 || nets[0].IP.String() != "10.42.0.5" {
+			t.Errorf("ResolveContainer() #%d = %v, %v", i+1, nets, err)
+		}
+	}
+	if name, err := r.NodeName(nil); name != "node-1" {
+		t.Errorf("NodeName() = %q, %v, want node-1", name, err)
+	}
+	if _, err := r.NodeName([]string{"/self/none"}); err == nil {
+		t.Errorf("NodeName() of a missing path succeeded")
+	}
+	if host, err := r.SelfHost(nil); host.AgentIP != "192.168.0.10" {
+		t.Errorf("SelfHost() = %+v, %v", host, err)
+	}
+}
+
+func TestServiceVIP(t *testing.T) {
+	m, server := newFakeMetadata()
+	defer server.Close()
+	m.mu.Lock()
+	m.services = []metadata.Service{
+		{UUID: "uuid-web", Name: "web", StackName: "app", Vip: "10.43.0.10"},
+		{UUID: "uuid-db", Name: "db", StackName: "app"},
+		{UUID: "uuid-v6", Name: "v6", StackName: "app", Vip: "fd00:43::10"},
+	}
+	m.mu.Unlock()
+	r, err := NewResolver(testConfig(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		service string
+		want    string
+		wantErr bool
+	}{
+		{name: "by UUID", service: "uuid-web", want: "10.43.0.10"},
+		{name: "by stack and name", service: "app/web", want: "10.43.0.10"},
+		{name: "IPv6", service: "app/v6", want: "fd00:43::10"},
+		{name: "no VIP", service: "app/db", wantErr: true},
+		{name: "other stack", service: "other/web", wantErr: true},
+		{name: "name alone", service: "web", wantErr: true},
+	}
+	for _, tt := range tests {
+		ip, err := r.ServiceVIP(tt.service)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ServiceVIP(%q) error = %v, want error %v", tt.name, tt.service, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && ip.String() != tt.want {
+			t.Errorf("%s: ServiceVIP(%q) = %s, want %s", tt.name, tt.service, ip, tt.want)
+		}
+	}
+}
+
+func TestResolveContainerAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers []rancherContainer
+		// beforeList changes the containers before the n-th list, at the
+		// time of clock.
+		beforeList func(m *fakeMetadata, clock Clock, n int)
+		immediate  bool
+		wantIP     string
+		wantKind   error
+	}{
+		{
+			name:       "dependency ready",
+			containers: []rancherContainer{testContainer("sidecar", "uuid-sidecar", "10.42.0.4"), testContainer("web", "uuid-web", "10.42.0.5")},
+			wantIP:     "10.42.0.5",
+		},
+		{
+			// The primary only shows up once the dependency has its IP,
+			// so it must be looked up after the dependency resolves.
+			name:       "dependency resolved before the primary",
+			containers: []rancherContainer{testContainer("sidecar", "uuid-sidecar", "")},
+			beforeList: func(m *fakeMetadata, clock Clock, n int) {
+				if n == 3 {
+					m.containers = []rancherContainer{testContainer("sidecar", "uuid-sidecar", "10.42.0.4")}
+				}
+				if n == 4 {
+					m.containers = append(m.containers, testContainer("web", "uuid-web", "10.42.0.5"))
+				}
+			},
+			wantIP: "10.42.0.5",
+		},
+		{
+			name:       "dependency without an IP",
+			containers: []rancherContainer{testContainer("sidecar", "uuid-sidecar", ""), testContainer("web", "uuid-web", "10.42.0.5")},
+			wantKind:   ipfinder.ErrIPPending,
+		},
+		{
+			name:       "dependency absent",
+			containers: []rancherContainer{testContainer("web", "uuid-web", "10.42.0.5")},
+			immediate:  true,
+			wantKind:   ipfinder.ErrIPPending,
+		},
+		{
+			// The primary is looked up in what the dependency left of
+			// the budget rather than in a fresh timeout.
+			name:       "budget shared with the dependency",
+			containers: []rancherContainer{testContainer("sidecar", "uuid-sidecar", "")},
+			beforeList: func(m *fakeMetadata, clock Clock, n int) {
+				if clock.Now().After(time.Unix(0, 0).Add(pollTimeout / 2)) {
+					m.containers[0].PrimaryIp = "10.42.0.4"
+				}
+			},
+			wantKind: ipfinder.ErrContainerNotFound,
+		},
+	}
+	for _, tt := range tests {
+		m, server := newFakeMetadata(tt.containers...)
+		config := testConfig(server.URL)
+		if tt.beforeList != nil {
+			m.beforeList = func(n int) { tt.beforeList(m, config.Clock, n) }
+		}
+		r, err := NewResolver(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets, _, err := r.ResolveContainerAfter("sidecar", "web", "", tt.immediate)
+		server.Close()
+		if spent := config.Clock.Now().Sub(time.Unix(0, 0)); spent > pollTimeout+defaultPollInterval {
+			t.Errorf("%s: ResolveContainerAfter() polled for %v, over the budget of %v", tt.name, spent, pollTimeout)
+		}
+		if tt.wantKind != nil {
+			if !isKind(err, tt.wantKind) {
+				t.Errorf("%s: ResolveContainerAfter() error = %v, want %v", tt.name, err, tt.wantKind)
+			}
+			continue
+		}
+		if err != nil || len(nets) != 1 || nets[0].IP.String() != tt.wantIP {
+			t.Errorf("%s: ResolveContainerAfter() = %v, %v, want %s", tt.name, nets, err, tt.wantIP)
+		}
+	}
+}
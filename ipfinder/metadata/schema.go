@@ -0,0 +1,76 @@
+package metadata
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// A containerSchema decodes the /containers response of one metadata API
+// version into the finder's container model. Keeping the per-version
+// shapes here confines version drift to this file.
+type containerSchema func(body []byte) ([]rancherContainer, error)
+
+// containerSchemas maps the known metadata versions to their schema.
+// Unknown versions are decoded with decodeContainers, the latest shape.
+var containerSchemas = map[string]containerSchema{
+	"2015-07-25": decodeContainers20150725,
+	"2015-12-19": decodeContainers,
+	"2016-07-29": decodeContainers,
+}
+
+// schemaFor returns the container schema of version.
+func schemaFor(version string) containerSchema {
+	if schema, ok := containerSchemas[version]; ok {
+		return schema
+	}
+	return decodeContainers
+}
+
+// decodeContainers decodes the current container shape, which carries the
+// go-rancher-metadata fields plus hostname, state and network_mode.
+func decodeContainers(body []byte) ([]rancherContainer, error) {
+	var containers []rancherContainer
+	err := json.Unmarshal(body, &containers)
+	return containers, err
+}
+
+// container20150725 is a container of the 2015-07-25 API, which predates
+// health checks and external ids. Its primary_ip may be unset while ips
+// is not.
+type container20150725 struct {
+	Name        string            `json:"name"`
+	PrimaryIp   string            `json:"primary_ip"`
+	Ips         []string          `json:"ips"`
+	Ports       []string          `json:"ports"`
+	ServiceName string            `json:"service_name"`
+	StackName   string            `json:"stack_name"`
+	Labels      map[string]string `json:"labels"`
+	CreateIndex int               `json:"create_index"`
+	HostUUID    string            `json:"host_uuid"`
+	UUID        string            `json:"uuid"`
+}
+
+func decodeContainers20150725(body []byte) ([]rancherContainer, error) {
+	var raw []container20150725
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	containers := make([]rancherContainer, len(raw))
+	for i, r := range raw {
+		c := &containers[i]
+		c.Name = r.Name
+		c.PrimaryIp = r.PrimaryIp
+		if c.PrimaryIp == "" && len(r.Ips) > 0 {
+			c.PrimaryIp = strings.TrimSpace(r.Ips[0])
+		}
+		c.Ips = r.Ips
+		c.Ports = r.Ports
+		c.ServiceName = r.ServiceName
+		c.StackName = r.StackName
+		c.Labels = r.Labels
+		c.CreateIndex = r.CreateIndex
+		c.HostUUID = r.HostUUID
+		c.UUID = r.UUID
+	}
+	return containers, nil
+}
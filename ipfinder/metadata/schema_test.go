@@ -0,0 +1,54 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContainerSchemas(t *testing.T) {
+	current := `[{"name": "web", "uuid": "uuid-web", "external_id": "ctr-web", "primary_ip": "10.42.0.5",
+		"ips": ["10.42.0.5"], "host_uuid": "host-1", "health_state": "healthy", "labels": {"app": "web"},
+		"hostname": "web-1", "state": "running", "network_mode": "managed"}]`
+	currentWant := rancherContainer{Hostname: "web-1", State: "running", NetworkMode: "managed"}
+	currentWant.Name = "web"
+	currentWant.UUID = "uuid-web"
+	currentWant.ExternalId = "ctr-web"
+	currentWant.PrimaryIp = "10.42.0.5"
+	currentWant.Ips = []string{"10.42.0.5"}
+	currentWant.HostUUID = "host-1"
+	currentWant.HealthState = "healthy"
+	currentWant.Labels = map[string]string{"app": "web"}
+
+	old := rancherContainer{}
+	old.Name = "web"
+	old.UUID = "uuid-web"
+	old.PrimaryIp = "10.42.0.5"
+	old.Ips = []string{" 10.42.0.5", "10.42.0.6"}
+	old.HostUUID = "host-1"
+	old.Labels = map[string]string{"app": "web"}
+
+	tests := []struct {
+		version string
+		body    string
+		want    rancherContainer
+	}{
+		{version: "2015-07-25", body: `[{"name": "web", "uuid": "uuid-web", "ips": [" 10.42.0.5", "10.42.0.6"],
+			"host_uuid": "host-1", "labels": {"app": "web"}, "external_id": "ignored", "state": "ignored"}]`, want: old},
+		{version: "2015-12-19", body: current, want: currentWant},
+		{version: "2016-07-29", body: current, want: currentWant},
+		{version: "2099-01-01", body: current, want: currentWant},
+	}
+	for _, tt := range tests {
+		got, err := schemaFor(tt.version)([]byte(tt.body))
+		if err != nil || len(got) != 1 {
+			t.Errorf("%s: decoded %+v, %v, want one container", tt.version, got, err)
+			continue
+		}
+		if !reflect.DeepEqual(got[0], tt.want) {
+			t.Errorf("%s: decoded %+v, want %+v", tt.version, got[0], tt.want)
+		}
+	}
+	if _, err := schemaFor("2015-07-25")([]byte(`{"name": "web"}`)); err == nil {
+		t.Errorf("2015-07-25: decoded an object as a container list")
+	}
+}
@@ -0,0 +1,136 @@
+package metadata
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// An AddressSelector picks the address a container resolves to from its
+// metadata. It returns "" if the container offers none, and may return
+// several addresses comma-separated, such as one of each family.
+type AddressSelector interface {
+	SelectAddress(container metadata.Container) string
+}
+
+// Address selector names, as accepted by NewAddressSelector.
+const (
+	SelectPrimary        = "primary"
+	SelectFirstAvailable = "first-available"
+	SelectLabel          = "label"
+	SelectFamily         = "family"
+)
+
+// NewAddressSelector returns the selector of the given name. label is the
+// container label read by SelectLabel, and family the preference of
+// SelectFamily. An empty name selects SelectPrimary.
+func NewAddressSelector(name, label, family string) (AddressSelector, error) {
+	switch name {
+	case "", SelectPrimary:
+		return PrimarySelector{}, nil
+	case SelectFirstAvailable:
+		return FirstAvailableSelector{}, nil
+	case SelectLabel:
+		if label == "" {
+			return nil, fmt.Errorf("address selector %q needs a label", name)
+		}
+		return LabelSelector{Label: label}, nil
+	case SelectFamily:
+		if err := ValidateFamilyPreference(family); err != nil {
+			return nil, err
+		}
+		return FamilySelector{Family: family}, nil
+	}
+	return nil, fmt.Errorf("unknown address selector %q", name)
+}
+
+// PrimarySelector selects the container's primary IP.
+type PrimarySelector struct{}
+
+// SelectAddress implements AddressSelector.
+func (PrimarySelector) SelectAddress(container metadata.Container) string {
+	return container.PrimaryIp
+}
+
+// FirstAvailableSelector selects the first valid address among the
+// primary IP and the container's other addresses, for containers whose
+// primary IP is unset or malformed.
+type FirstAvailableSelector struct{}
+
+// SelectAddress implements AddressSelector.
+func (FirstAvailableSelector) SelectAddress(container metadata.Container) string {
+	for _, addr := range addresses(container) {
+		if net.ParseIP(addr) != nil {
+			return addr
+		}
+	}
+	return ""
+}
+
+// LabelSelector selects the address held in a container label.
+type LabelSelector struct {
+	Label string
+}
+
+// SelectAddress implements AddressSelector.
+func (s LabelSelector) SelectAddress(container metadata.Container) string {
+	return strings.TrimSpace(container.Labels[s.Label])
+}
+
+// FamilySelector selects the first address of FamilyIPv4 or FamilyIPv6,
+// or under FamilyDual the first of each family, comma-separated. A
+// container without an address of the preferred families, like an empty
+// Family, resolves to its primary IP.
+type FamilySelector struct {
+	Family string
+}
+
+// SelectAddress implements AddressSelector.
+func (s FamilySelector) SelectAddress(container metadata.Container) string {
+	if s.Family == "" {
+		return container.PrimaryIp
+	}
+	var v4, v6 string
+	for _, addr := range addresses(container) {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil && v4 == "":
+			v4 = addr
+		case ip.To4() == nil && v6 == "":
+			v6 = addr
+		}
+	}
+	switch {
+	case s.Family == FamilyIPv4 && v4 != "":
+		return v4
+	case s.Family == FamilyIPv6 && v6 != "":
+		return v6
+	case s.Family == FamilyDual && v4 != "" && v6 != "":
+		return v4 + "," + v6
+	}
+	return container.PrimaryIp
+}
+
+// addresses lists the primary IP, which may itself be a comma-separated
+// list, followed by the container's other addresses.
+func addresses(container metadata.Container) []string {
+	var addrs []string
+	for _, addr := range append(strings.Split(container.PrimaryIp, ","), container.Ips...) {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// selector returns Config.AddressSelector or, if unset, a FamilySelector
+// for Config.FamilyPreference.
+func (c Config) selector() AddressSelector {
+	if c.AddressSelector != nil {
+		return c.AddressSelector
+	}
+	return FamilySelector{Family: c.FamilyPreference}
+}
@@ -0,0 +1,56 @@
+package metadata
+
+import (
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// ContainerSource lists the containers an IPFinderFromMetadata searches in
+// place of the metadata service, for finders backed by another Rancher
+// endpoint. The finder matches, filters and polls the listed containers
+// exactly as it does those of metadata.
+type ContainerSource interface {
+	// Containers returns the containers a lookup of cid or rancherid,
+	// either of which may be empty, can match. It may return more.
+	Containers(cid, rancherid string) ([]SourceContainer, error)
+}
+
+// SourceContainer is a container listed by a ContainerSource.
+type SourceContainer struct {
+	metadata.Container
+	// State is the lifecycle state, such as "running".
+	State string
+}
+
+// NewIPFinderFromSource returns an IPFinderFromMetadata looking containers
+// up in source under config. It does not contact the metadata service,
+// so it neither waits for it nor updates Config.ReadyFile, and the
+// settings that need the service are ignored: WatchChanges,
+// MetadataVersions, TargetedLookupThreshold, CheckHost and the rate
+// limit.
+func NewIPFinderFromSource(config Config, source ContainerSource) *IPFinderFromMetadata {
+	config.WatchChanges = false
+	config.MetadataVersions = nil
+	config.TargetedLookupThreshold = 0
+	config.CheckHost = false
+	return &IPFinderFromMetadata{config: config, source: source}
+}
+
+// NewResolverFromSource returns a Resolver whose lookups use
+// NewIPFinderFromSource. Its ServiceVIP, NodeName and SelfHost need the
+// metadata service and fail.
+func NewResolverFromSource(config Config, source ContainerSource) *Resolver {
+	return &Resolver{base: NewIPFinderFromSource(config, source)}
+}
+
+// sourceContainers lists the containers of ipf.source.
+func (ipf *IPFinderFromMetadata) sourceContainers(cid, rancherid string) ([]rancherContainer, error) {
+	listed, err := ipf.source.Containers(cid, rancherid)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]rancherContainer, len(listed))
+	for i, c := range listed {
+		containers[i] = rancherContainer{Container: c.Container, State: c.State}
+	}
+	return containers, nil
+}
@@ -0,0 +1,31 @@
+package metadata
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// httpClient returns the HTTP client for the metadata service, verifying
+// an https server against Config.CAFile if set, unless Config.Insecure.
+// Each request is bounded by Config.RequestTimeout.
+func (c Config) httpClient() (*http.Client, error) {
+	if c.CAFile == "" && !c.Insecure {
+		return &http.Client{Timeout: c.requestTimeout()}, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read metadata CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in metadata CA file %s", c.CAFile)
+		}
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	return &http.Client{Transport: transport, Timeout: c.requestTimeout()}, nil
+}
@@ -0,0 +1,63 @@
+package metadata
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	stdlog "log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPClientTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(&fakeMetadata{})
+	// The handshake failure without the CA is expected.
+	server.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "metadata-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(emptyFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		caFile        string
+		insecure      bool
+		wantConfigErr bool
+		wantErr       bool
+	}{
+		{name: "self-signed with its CA", caFile: caFile},
+		{name: "self-signed without CA", wantErr: true},
+		{name: "self-signed insecure", insecure: true},
+		{name: "missing CA file", caFile: filepath.Join(dir, "missing.pem"), wantConfigErr: true},
+		{name: "CA file without certificates", caFile: emptyFile, wantConfigErr: true},
+	}
+	for _, tt := range tests {
+		config := testConfig(server.URL)
+		config.CAFile = tt.caFile
+		config.Insecure = tt.insecure
+		httpClient, err := config.httpClient()
+		if (err != nil) != tt.wantConfigErr {
+			t.Errorf("%s: httpClient() error = %v, want error %v", tt.name, err, tt.wantConfigErr)
+		}
+		if err != nil {
+			continue
+		}
+		_, err = newClient(config.URL(), httpClient).getVersion()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: getVersion() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Environment variables enabling and sizing file logging.
+const (
+	logFileEnv     = "RANCHER_CALICO_IPAM_LOG_FILE"
+	logMaxSizeEnv  = "RANCHER_CALICO_IPAM_LOG_MAX_SIZE_MB"
+	logMaxFilesEnv = "RANCHER_CALICO_IPAM_LOG_MAX_FILES"
+
+	defaultLogMaxSizeMB = 10
+	defaultLogMaxFiles  = 3
+)
+
+// rotatingWriter appends to a log file shared by concurrent plugin
+// processes. Once the file would grow past maxSize it is renamed to
+// path.1, path.1 to path.2 and so on, keeping maxFiles rotated files.
+type rotatingWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+}
+
+// Write appends p to the log file. The size check, rotation and append
+// happen under an exclusive flock on a sibling lock file, and the log file
+// is reopened on every write so that a rotation done by another process
+// is picked up.
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	lock, err := os.OpenFile(w.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	if fi, err := os.Stat(w.path); err == nil && fi.Size() > 0 && fi.Size()+int64(len(p)) > w.maxSize {
+		w.rotate()
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Write(p)
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest.
+func (w *rotatingWriter) rotate() {
+	if w.maxFiles < 1 {
+		os.Remove(w.path)
+		return
+	}
+	for i := w.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	os.Rename(w.path, w.path+".1")
+}
+
+// configureLogFile sends the log to the file named by logFileEnv, if set,
+// instead of stderr. It must run after utils.ConfigureLogging, which
+// resets the output.
+func configureLogFile() {
+	path := os.Getenv(logFileEnv)
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Warnf("rancher-calico-ipam: cannot log to %s: %v", path, err)
+		return
+	}
+	log.SetOutput(&rotatingWriter{
+		path:     path,
+		maxSize:  int64(envInt(logMaxSizeEnv, defaultLogMaxSizeMB)) << 20,
+		maxFiles: envInt(logMaxFilesEnv, defaultLogMaxFiles),
+	})
+}
+
+// envInt returns the non-negative integer in the named environment
+// variable, or def if it is unset or invalid.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Warnf("rancher-calico-ipam: invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipam.log")
+	w := &rotatingWriter{path: path, maxSize: 10, maxFiles: 2}
+	// Each line is 10 bytes, so every write past the first rotates.
+	for i := 1; i <= 4; i++ {
+		if _, err := fmt.Fprintf(w, "line %d ..\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{
+		path:        "line 4 ..\n",
+		path + ".1": "line 3 ..\n",
+		path + ".2": "line 2 ..\n",
+	} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", filepath.Base(name), data, err, want)
+		}
+	}
+	// The oldest file, holding line 1, was dropped.
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want at most 2 rotated files", filepath.Base(path))
+	}
+}
+
+func TestEnvInt(t *testing.T) {
+	const name = "RANCHER_CALICO_IPAM_TEST_INT"
+	defer os.Unsetenv(name)
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{value: "", want: 7},
+		{value: "5", want: 5},
+		{value: "0", want: 0},
+		{value: "-1", want: 7},
+		{value: "ten", want: 7},
+		{value: "1.5", want: 7},
+	}
+	for _, tt := range tests {
+		os.Setenv(name, tt.value)
+		if got := envInt(name, 7); got != tt.want {
+			t.Errorf("envInt(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
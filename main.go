@@ -14,10 +14,10 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
+	"time"
 
 	"os"
 
@@ -28,6 +28,8 @@ import (
 	"github.com/projectcalico/calico-cni/utils"
 	"github.com/projectcalico/libcalico-go/lib/client"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
 )
 
 // VERSION is filled out during the build process (using git describe output)
@@ -40,6 +42,7 @@ func main() {
 	flagSet := flag.NewFlagSet("calico-ipam", flag.ExitOnError)
 
 	version := flagSet.Bool("v", false, "Display version")
+	printConfig := flagSet.Bool("print-config", false, "Print the effective configuration for the netconf on stdin")
 	err := flagSet.Parse(os.Args[1:])
 
 	if err != nil {
@@ -52,24 +55,84 @@ func main() {
 		os.Exit(0)
 	}
 
-	skel.PluginMain(cmdAdd, cmdDel)
+	if flagSet.Arg(0) == "release-batch" {
+		if err := runReleaseBatch(flagSet.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if flagSet.Arg(0) == "release" {
+		if err := runRelease(flagSet.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *printConfig {
+		if err := printEffectiveConfig(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if os.Getenv(validateConfigEnv) == "1" {
+		if err := runValidateConfig(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// The vendored skel predates CHECK, so it is dispatched here.
+	if os.Getenv("CNI_COMMAND") == "CHECK" {
+		if err := runCheck(); err != nil {
+			dieErr(err)
+		}
+		os.Exit(0)
+	}
+
+	skel.PluginMain(withSummary("ADD", cmdAddLocked), withSummary("DEL", cmdDel))
 }
 
 type ipamArgs struct {
 	types.CommonArgs
 	IP                   net.IP `json:"ip,omitempty"`
 	RancherContainerUUID types.UnmarshallableString
+	RancherServiceName   types.UnmarshallableString
+	K8S_POD_NAME         types.UnmarshallableString
+	K8S_POD_NAMESPACE    types.UnmarshallableString
+	// RancherDependsOn is the id of a container that must have a
+	// metadata IP before this one is resolved.
+	RancherDependsOn types.UnmarshallableString
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
-	conf := utils.NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+// cmdAdd runs an ADD for conf, the netconf parsed from args.StdinData.
+func cmdAdd(conf NetConf, args *skel.CmdArgs) error {
+	utils.ConfigureLogging(conf.LogLevel)
+	configureLogFile()
+
+	if conf.SkipNoNetns && noNetns(args.Netns) {
+		log.Infof("rancher-calico-ipam: no network namespace for %s, returning an empty result", args.ContainerID)
+		return emitResult(conf, args, &types.Result{}, nil)
 	}
 
-	utils.ConfigureLogging(conf.LogLevel)
+	if conf.Hostname == "" && conf.NodeNameFromMetadata {
+		r, err := metadata.NewResolver(conf.finderConfig())
+		if err != nil {
+			return err
+		}
+		name, err := r.NodeName(conf.SelfHostPaths)
+		if err != nil {
+			return err
+		}
+		conf.Hostname = name
+	}
 
-	calicoClient, err := utils.CreateClient(conf)
+	calicoClient, err := connectCalico(conf)
 	if err != nil {
 		return err
 	}
@@ -81,30 +144,119 @@ func cmdAdd(args *skel.CmdArgs) error {
 	logger := utils.CreateContextLogger(workloadID)
 
 	ipamArgs := ipamArgs{}
-	if err = types.LoadArgs(args.Args, &ipamArgs); err != nil {
+	if err = loadIPAMArgs(conf, args, &ipamArgs); err != nil {
 		return err
 	}
 
-	err = setIpByRancher(args, &ipamArgs)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Calico CNI IPAM has no IP in rancher metadata")
+	if err = checkArgConflict(conf, &ipamArgs, logger); err != nil {
+		return err
+	}
+	if err = validatePodArgs(&ipamArgs); err != nil {
+		return err
 	}
 
-	r := &types.Result{}
-	if ipamArgs.IP != nil {
-		fmt.Fprintf(os.Stderr, "Calico CNI IPAM request IP: %v\n", ipamArgs.IP)
+	// An explicit IP in CNI_ARGS takes precedence over the override file,
+	// which in turn takes precedence over Rancher metadata.
+	if ipamArgs.IP == nil {
+		if err = applyOverride(args, &ipamArgs, logger); err != nil {
+			return err
+		}
+	}
 
-		// The hostname will be defaulted to the actual hostname if cong.Hostname is empty
-		assignArgs := client.AssignIPArgs{IP: cnet.IP{ipamArgs.IP}, HandleID: &workloadID, Hostname: conf.Hostname}
-		logger.WithField("assignArgs", assignArgs).Info("Assigning provided IP")
-		err := calicoClient.IPAM().AssignIP(assignArgs)
+	if ipamArgs.IP == nil && conf.TrustExistingIP {
+		if r := existingResult(calicoClient, conf, args, logger); r != nil {
+			return emitResult(conf, args, r, nil)
+		}
+	}
+
+	var source *ipSource
+	if ipamArgs.IP == nil && conf.ServiceVIP && ipamArgs.RancherServiceName != "" {
+		if source, err = setIpByServiceVIP(conf, &ipamArgs); err != nil {
+			return err
+		}
+	}
+
+	var resolved []net.IPNet
+	autoAssign := false
+	if ipamArgs.IP == nil {
+		source, resolved, err = setIpByRancher(args, conf, &ipamArgs)
+		// An address of the wrong family fails the ADD rather than
+		// falling back to another one.
+		if err == nil && ipamArgs.IP != nil {
+			if err = checkFamily(conf, ipamArgs.IP); err != nil {
+				return err
+			}
+		}
+		if err == ipfinder.ErrUnmanaged {
+			logger.Info("Container is not managed by this IPAM, returning an empty result")
+			return emitResult(conf, args, &types.Result{}, nil)
+		}
+		// A container deferring to Calico is auto-assigned below,
+		// bypassing the fallbacks.
+		if failedWith(err, ipfinder.ErrAutoAssign) {
+			logger.Infof("Container sets %s=auto, assigning from Calico IPAM", conf.AutoAssignLabel)
+			autoAssign, err = true, nil
+		}
+		// A host-networked container, or a match on another host, must
+		// not get an IP from the fallbacks below either.
+		if failedWith(err, ipfinder.ErrHostNetwork) || failedWith(err, ipfinder.ErrForeignHost) {
+			return cniError(err)
+		}
+		if failedWith(err, ipfinder.ErrMetadataUnreachable) {
+			if conf.FailurePolicy != failurePolicyOpen {
+				return cniError(err)
+			}
+			logger.Errorf("Rancher metadata is unreachable, failing open: %v", err)
+			if conf.FallbackIP == "" && conf.FallbackRange == "" {
+				return emitResult(conf, args, &types.Result{}, nil)
+			}
+			err = nil
+		}
+		if err != nil && conf.StrictImmediate {
+			return cniError(err)
+		}
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "Calico CNI IPAM has no IP in rancher metadata")
+		}
+	}
+
+	var fallbackPool *cnet.IPNet
+	if ipamArgs.IP == nil && !autoAssign {
+		if fallbackPool, err = applyFallback(conf, &ipamArgs, logger); err != nil {
 			return err
 		}
+	}
+	if ipamArgs.IP == nil && fallbackPool == nil && !autoAssign && conf.DeriveFromID {
+		if err = applyDerived(conf, args.ContainerID, &ipamArgs, logger); err != nil {
+			return err
+		}
+	}
+
+	if conf.WaitForNode {
+		timeout := defaultNodeReadyTimeout
+		if conf.NodeReadyTimeoutMs > 0 {
+			timeout = time.Duration(conf.NodeReadyTimeoutMs) * time.Millisecond
+		}
+		if err = waitForNode(calicoClient.Nodes(), conf, timeout, logger); err != nil {
+			return err
+		}
+	}
 
-		ipV4Network := net.IPNet{IP: ipamArgs.IP, Mask: net.CIDRMask(32, 32)}
-		r.IP4 = &types.IPConfig{IP: ipV4Network}
-		logger.WithField("result.IP4", r.IP4).Info("Result IPv4")
+	r := &types.Result{}
+	if ipamArgs.IP != nil {
+		provided := resolved
+		if provided == nil {
+			provided = []net.IPNet{{IP: ipamArgs.IP}}
+		} else if conf.IPFamilyPreference == metadata.FamilyDual {
+			if err := checkFamilies(conf, provided, logger); err != nil {
+				return err
+			}
+		}
+		for _, ipNet := range provided {
+			if err := assignProvidedIP(calicoClient, conf, args, workloadID, ipNet, r, logger); err != nil {
+				return err
+			}
+		}
 	} else {
 		// Default to assigning an IPv4 address
 		num4 := 1
@@ -121,8 +273,17 @@ func cmdAdd(args *skel.CmdArgs) error {
 		fmt.Fprintf(os.Stderr, "Calico CNI IPAM request count IPv4=%d IPv6=%d\n", num4, num6)
 
 		assignArgs := client.AutoAssignArgs{Num4: num4, Num6: num6, HandleID: &workloadID, Hostname: conf.Hostname}
+		if fallbackPool != nil {
+			if fallbackPool.Version() == 4 {
+				assignArgs.IPv4Pools = []cnet.IPNet{*fallbackPool}
+			} else {
+				assignArgs.IPv6Pools = []cnet.IPNet{*fallbackPool}
+			}
+		}
 		logger.WithField("assignArgs", assignArgs).Info("Auto assigning IP")
+		span := commandSpan.child("calico.autoAssign")
 		assignedV4, assignedV6, err := calicoClient.IPAM().AutoAssign(assignArgs)
+		span.end(err)
 		fmt.Fprintf(os.Stderr, "Calico CNI IPAM assigned addresses IPv4=%v IPv6=%v\n", assignedV4, assignedV6)
 		if err != nil {
 			return err
@@ -132,32 +293,132 @@ func cmdAdd(args *skel.CmdArgs) error {
 			if len(assignedV4) != num4 {
 				return fmt.Errorf("Failed to request %d IPv4 addresses. IPAM allocated only %d.", num4, len(assignedV4))
 			}
-			ipV4Network := net.IPNet{IP: assignedV4[0].IP, Mask: net.CIDRMask(32, 32)}
-			r.IP4 = &types.IPConfig{IP: ipV4Network}
+			if r.IP4, err = resultConfig(calicoClient, conf, assignedV4[0].IP, logger); err != nil {
+				return err
+			}
 		}
 
 		if num6 == 1 {
 			if len(assignedV6) != num6 {
 				return fmt.Errorf("Failed to request %d IPv6 addresses. IPAM allocated only %d.", num6, len(assignedV6))
 			}
-			ipV6Network := net.IPNet{IP: assignedV6[0].IP, Mask: net.CIDRMask(128, 128)}
-			r.IP6 = &types.IPConfig{IP: ipV6Network}
+			if r.IP6, err = resultConfig(calicoClient, conf, assignedV6[0].IP, logger); err != nil {
+				return err
+			}
 		}
 		logger.WithFields(log.Fields{"result.IP4": r.IP4, "result.IP6": r.IP6}).Info("IPAM Result")
 	}
 
-	return r.Print()
+	if conf.NodeGateway && r.IP4 != nil {
+		setNodeGateway(calicoClient, conf, r, logger)
+	}
+	if conf.OnLinkRoute {
+		addOnLinkRoutes(r)
+	}
+	if conf.UsableRangeRoutes {
+		addUsableRangeRoutes(r)
+	}
+	if conf.VerifyAddress {
+		if r.IP4 != nil {
+			verifyAddress(args, r.IP4.IP.IP, logger)
+		}
+		if r.IP6 != nil {
+			verifyAddress(args, r.IP6.IP.IP, logger)
+		}
+	}
+	if conf.InterfaceAlias {
+		setInterfaceAlias(args, &ipamArgs, source, logger)
+	}
+	reportIP(conf, args, &ipamArgs, r, logger)
+	emitPodEvent(conf, &ipamArgs, r, source, logger)
+	return emitResult(conf, args, r, source)
+}
+
+// assignProvidedIP assigns ipNet.IP in Calico, unless prepareAssign says
+// otherwise, and records it in r, with the prefix length of ipNet if its
+// Mask is set. A second address of a
+// family already in r is ignored.
+func assignProvidedIP(calicoClient calicoAPI, conf NetConf, args *skel.CmdArgs, workloadID string, ipNet net.IPNet, r *types.Result, logger *log.Entry) error {
+	ip := ipNet.IP
+	if (ip.To4() != nil && r.IP4 != nil) || (ip.To4() == nil && r.IP6 != nil) {
+		logger.Warnf("Ignoring second address %s of the same family", ip.String())
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Calico CNI IPAM request IP: %v\n", ip.String())
+
+	if conf.SkipConfiguredIP && alreadyConfigured(args, ip, logger) {
+		logger.Infof("Address %s is already configured on %s, skipping assignment", ip.String(), args.IfName)
+	} else if assign, err := prepareAssign(calicoClient, conf, ip, logger); err != nil {
+		return err
+	} else if assign {
+		// The hostname will be defaulted to the actual hostname if cong.Hostname is empty
+		assignArgs := client.AssignIPArgs{IP: cnet.IP{ip}, HandleID: &workloadID, Hostname: conf.Hostname}
+		logger.WithField("assignArgs", assignArgs).Info("Assigning provided IP")
+		span := commandSpan.child("calico.assignIP")
+		err := calicoClient.IPAM().AssignIP(assignArgs)
+		span.set("ip", ip.String())
+		span.end(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	ipc, err := resultConfig(calicoClient, conf, ip, logger)
+	if err != nil {
+		return err
+	}
+	if ipNet.Mask != nil {
+		ipc.IP.Mask = ipNet.Mask
+	}
+	if ip.To4() != nil {
+		r.IP4 = ipc
+		logger.WithField("result.IP4", ipc.IP.String()).Info("Result IPv4")
+	} else {
+		r.IP6 = ipc
+		logger.WithField("result.IP6", ipc.IP.String()).Info("Result IPv6")
+	}
+	return nil
+}
+
+// existingResult returns a result holding the first routable address of
+// each family already on the container interface, or nil if there is
+// none. The addresses are reported with the prefix an ADD would use, but
+// metadata is not consulted and nothing is assigned in Calico. An address
+// that an ADD would reject is not trusted either.
+func existingResult(calicoClient calicoAPI, conf NetConf, args *skel.CmdArgs, logger *log.Entry) *types.Result {
+	var r *types.Result
+	for _, ip := range routableAddrs(args, logger) {
+		if (ip.To4() != nil && r != nil && r.IP4 != nil) || (ip.To4() == nil && r != nil && r.IP6 != nil) {
+			continue
+		}
+		ipc, err := resultConfig(calicoClient, conf, ip, logger)
+		if err != nil {
+			logger.Warnf("Not trusting existing address %s: %v", ip.String(), err)
+			return nil
+		}
+		if r == nil {
+			r = &types.Result{}
+		}
+		if ip.To4() != nil {
+			r.IP4 = ipc
+		} else {
+			r.IP6 = ipc
+		}
+		logger.Infof("Address %s is already configured on %s, trusting it without a metadata lookup", ip.String(), args.IfName)
+	}
+	return r
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	conf := utils.NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
 	}
 
 	utils.ConfigureLogging(conf.LogLevel)
+	configureLogFile()
 
-	calicoClient, err := utils.CreateClient(conf)
+	calicoClient, err := utils.CreateClient(conf.NetConf)
 	if err != nil {
 		return err
 	}
@@ -170,12 +431,18 @@ func cmdDel(args *skel.CmdArgs) error {
 
 	logger := utils.CreateContextLogger(workloadID)
 
-	logger.Info("Releasing address using workloadID")
-	if err := calicoClient.IPAM().ReleaseByHandle(workloadID); err != nil {
+	if err := releaseWorkload(calicoClient.IPAM(), workloadID, releaseReasonDel, logger); err != nil {
 		return err
 	}
-
-	logger.Info("Released address using workloadID")
+	if conf.AddLock {
+		forgetResult(args.ContainerID)
+	}
+	if conf.ConfirmRelease {
+		timeout := defaultConfirmReleaseTimeout
+		if conf.ConfirmReleaseTimeoutMs > 0 {
+			timeout = time.Duration(conf.ConfirmReleaseTimeoutMs) * time.Millisecond
+		}
+		return confirmRelease(calicoClient.IPAM(), workloadID, timeout, logger)
+	}
 	return nil
-
 }
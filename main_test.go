@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		netconf  string
+		wantCode uint
+		wantIP   string
+	}{
+		{name: "closed", netconf: `"failurePolicy": "closed"`, wantCode: errCodeTryAgainLater},
+		{name: "default", wantCode: errCodeTryAgainLater},
+		{name: "open", netconf: `"failurePolicy": "open"`},
+		{name: "open with fallback IP", netconf: `"failurePolicy": "open", "fallbackIP": "10.42.0.99"`, wantIP: "10.42.0.99"},
+	}
+	for _, tt := range tests {
+		_, ts := newFakeMetadata()
+		ts.Close()
+		ipam := &fakeIPAM{}
+		restore := useFakeCalico(&fakeCalico{ipam: ipam, pools: &fakePools{cidrs: []string{"10.42.0.0/16"}}})
+		netconf := `"connectTimeoutMs": 100`
+		if tt.netconf != "" {
+			netconf += ", " + tt.netconf
+		}
+		results, err := runAdd(ts.URL, netconf, nil)
+		restore()
+		if tt.wantCode != 0 {
+			if e, ok := err.(*types.Error); !ok || e.Code != tt.wantCode {
+				t.Errorf("%s: cmdAdd() error = %v, want code %d", tt.name, err, tt.wantCode)
+			}
+			continue
+		}
+		if err != nil || len(results) != 1 {
+			t.Errorf("%s: cmdAdd() = %v, %v, want one result", tt.name, results, err)
+			continue
+		}
+		assigned := ""
+		if ips := ipam.handles["ctr-1"]; len(ips) == 1 {
+			assigned = ips[0].String()
+		}
+		if assigned != tt.wantIP {
+			t.Errorf("%s: assigned %q, want %q", tt.name, assigned, tt.wantIP)
+		}
+		if r, ok := results[0].(*types.Result); tt.wantIP == "" && (!ok || r.IP4 != nil) {
+			t.Errorf("%s: result %v, want an empty one", tt.name, results[0])
+		}
+	}
+}
+
+func TestAutoAssignLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		label  string
+		value  string
+		want   string
+		wantIP string
+	}{
+		{name: "auto", label: "io.rancher.ipam", value: "auto", want: "10.42.0.100/32", wantIP: "10.42.0.100"},
+		{name: "other value", label: "io.rancher.ipam", value: "static", want: "10.42.0.5/32", wantIP: "10.42.0.5"},
+		{name: "label not configured", value: "auto", want: "10.42.0.5/32", wantIP: "10.42.0.5"},
+	}
+	for _, tt := range tests {
+		m, ts := newFakeMetadata(metadataContainer("ctr-1", "uuid-1", "10.42.0.5"))
+		m.labels = map[string]map[string]string{"uuid-1": {"io.rancher.ipam": tt.value}}
+		ipam := &fakeIPAM{autoIPv4: "10.42.0.100"}
+		restore := useFakeCalico(&fakeCalico{ipam: ipam, pools: &fakePools{cidrs: []string{"10.42.0.0/16"}}})
+		// The fallback IP must not be used for a container deferring to
+		// Calico IPAM.
+		results, err := runAdd(ts.URL, fmt.Sprintf(`"autoAssignLabel": %q, "fallbackIP": "10.42.0.99"`, tt.label), nil)
+		restore()
+		ts.Close()
+		if err != nil || len(results) != 1 {
+			t.Errorf("%s: cmdAdd() = %v, %v, want one result", tt.name, results, err)
+			continue
+		}
+		// Only an address from metadata is annotated with its source.
+		r, ok := results[0].(*types.Result)
+		if !ok {
+			r = results[0].(*result020).Result
+		}
+		if r.IP4 == nil || r.IP4.IP.String() != tt.want {
+			t.Errorf("%s: result %+v, want %s", tt.name, r.IP4, tt.want)
+		}
+		if ips := ipam.handles["ctr-1"]; len(ips) != 1 || ips[0].String() != tt.wantIP {
+			t.Errorf("%s: assigned %v, want %s", tt.name, ips, tt.wantIP)
+		}
+	}
+}
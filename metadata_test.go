@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+)
+
+// fakeMetadata is a Rancher metadata service serving the default version
+// from memory, for tests that run a command end to end. Its fields may be
+// changed between requests under mu.
+type fakeMetadata struct {
+	mu         sync.Mutex
+	containers []map[string]string
+	services   []map[string]string
+	// labels maps container UUIDs to the labels they are listed with.
+	labels map[string]map[string]string
+	// selfHost, if set, is served as the host record of /self/host.
+	selfHost map[string]string
+	// hold, if set, delays every container request until it is closed.
+	hold chan struct{}
+}
+
+// newFakeMetadata starts a metadata service listing containers made by
+// metadataContainer. The caller closes the returned server.
+func newFakeMetadata(containers ...map[string]string) (*fakeMetadata, *httptest.Server) {
+	m := &fakeMetadata{containers: containers}
+	return m, httptest.NewServer(m)
+}
+
+// metadataContainer returns a running container with the given ids and
+// IP.
+func metadataContainer(externalID, uuid, ip string) map[string]string {
+	return map[string]string{"external_id": externalID, "uuid": uuid, "primary_ip": ip, "state": "running"}
+}
+
+func (m *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+metadata.DefaultVersion)
+	if strings.HasPrefix(path, "/containers") {
+		m.mu.Lock()
+		hold := m.hold
+		m.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case r.URL.Path == "/":
+		json.NewEncoder(w).Encode([]string{metadata.DefaultVersion})
+	case path == "/version":
+		w.Write([]byte("1"))
+	case path == "/self/host" && m.selfHost != nil:
+		json.NewEncoder(w).Encode(m.selfHost)
+	case path == "/services":
+		json.NewEncoder(w).Encode(m.services)
+	case path == "/containers":
+		var containers []map[string]interface{}
+		for _, c := range m.containers {
+			container := map[string]interface{}{"labels": m.labels[c["uuid"]]}
+			for k, v := range c {
+				container[k] = v
+			}
+			containers = append(containers, container)
+		}
+		json.NewEncoder(w).Encode(containers)
+	case strings.HasPrefix(path, "/containers/"):
+		key := strings.TrimPrefix(path, "/containers/")
+		for _, c := range m.containers {
+			if c["uuid"] == key {
+				json.NewEncoder(w).Encode(c)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// metricsDirEnv names the node_exporter textfile collector directory.
+// When set, every metadata resolution updates the metrics file there.
+const metricsDirEnv = "CNI_METRICS_DIR"
+
+const (
+	metricsFile = "rancher_calico_ipam.prom"
+	// reservoirFile keeps the latencies of the last reservoirSize
+	// resolutions, shared by all invocations on the node.
+	reservoirFile = "rancher_calico_ipam.samples"
+	reservoirSize = 128
+)
+
+// recordResolution adds the latency of a metadata resolution to the
+// reservoir under CNI_METRICS_DIR and rewrites the metrics file with the
+// latest latency and the rolling p50 and p95. The reservoir is updated
+// under a file lock, so concurrent invocations do not lose samples.
+// Failures are logged and otherwise ignored.
+func recordResolution(latency time.Duration) {
+	dir := os.Getenv(metricsDirEnv)
+	if dir == "" {
+		return
+	}
+	if err := updateMetrics(dir, latency); err != nil {
+		log.Warnf("rancher-calico-ipam: cannot update metrics in %s: %v", dir, err)
+	}
+}
+
+func updateMetrics(dir string, latency time.Duration) error {
+	f, err := os.OpenFile(filepath.Join(dir, reservoirFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	var samples []float64
+	if data, err := ioutil.ReadAll(f); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &samples); err != nil {
+			log.Debugf("rancher-calico-ipam: discarding unreadable metrics reservoir: %v", err)
+			samples = nil
+		}
+	}
+	samples = append(samples, latency.Seconds())
+	if len(samples) > reservoirSize {
+		samples = samples[len(samples)-reservoirSize:]
+	}
+	data, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintln(&out, "# HELP rancher_calico_ipam_resolution_seconds Latency of rancher metadata resolutions.")
+	fmt.Fprintln(&out, "# TYPE rancher_calico_ipam_resolution_seconds summary")
+	for _, q := range []float64{0.5, 0.95} {
+		fmt.Fprintf(&out, "rancher_calico_ipam_resolution_seconds{quantile=\"%g\"} %g\n", q, percentile(samples, q))
+	}
+	fmt.Fprintf(&out, "rancher_calico_ipam_resolution_seconds_count %d\n", len(samples))
+	fmt.Fprintln(&out, "# HELP rancher_calico_ipam_last_resolution_seconds Latency of the latest resolution.")
+	fmt.Fprintln(&out, "# TYPE rancher_calico_ipam_last_resolution_seconds gauge")
+	fmt.Fprintf(&out, "rancher_calico_ipam_last_resolution_seconds %g\n", latency.Seconds())
+
+	// Written aside and renamed, so the collector never reads a partial
+	// file.
+	tmp := filepath.Join(dir, "."+metricsFile+".tmp")
+	if err := ioutil.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, metricsFile))
+}
+
+// percentile returns the q-th quantile of samples by the nearest-rank
+// method, or 0 for no samples.
+func percentile(samples []float64, q float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []float64
+		q       float64
+		want    float64
+	}{
+		{name: "no samples", q: 0.5, want: 0},
+		{name: "one sample", samples: []float64{3}, q: 0.95, want: 3},
+		{name: "median of odd", samples: []float64{5, 1, 3}, q: 0.5, want: 3},
+		{name: "median of even", samples: []float64{4, 1, 3, 2}, q: 0.5, want: 2},
+		{name: "p95 of ten", samples: []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, q: 0.95, want: 10},
+		{name: "p95 of twenty", samples: []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, q: 0.95, want: 19},
+		{name: "zero quantile", samples: []float64{2, 1}, q: 0, want: 1},
+	}
+	for _, tt := range tests {
+		samples := append([]float64{}, tt.samples...)
+		if got := percentile(tt.samples, tt.q); got != tt.want {
+			t.Errorf("%s: percentile(%v, %g) = %g, want %g", tt.name, tt.samples, tt.q, got, tt.want)
+		}
+		for i := range samples {
+			if samples[i] != tt.samples[i] {
+				t.Errorf("%s: percentile reordered the samples to %v", tt.name, tt.samples)
+				break
+			}
+		}
+	}
+}
+
+func readReservoir(t *testing.T, dir string) []float64 {
+	data, err := ioutil.ReadFile(filepath.Join(dir, reservoirFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples []float64
+	if err := json.Unmarshal(data, &samples); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+func TestUpdateMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, ms := range []int{400, 100, 300, 200} {
+		if err := updateMetrics(dir, time.Duration(ms)*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, metricsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`rancher_calico_ipam_resolution_seconds{quantile="0.5"} 0.2`,
+		`rancher_calico_ipam_resolution_seconds{quantile="0.95"} 0.4`,
+		`rancher_calico_ipam_resolution_seconds_count 4`,
+		`rancher_calico_ipam_last_resolution_seconds 0.2`,
+	} {
+		if !strings.Contains(string(data), line+"\n") {
+			t.Errorf("metrics file lacks %q:\n%s", line, data)
+		}
+	}
+
+	// The reservoir keeps the latest reservoirSize samples, and no
+	// concurrent update is lost.
+	var wg sync.WaitGroup
+	for i := 0; i < reservoirSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := updateMetrics(dir, time.Second); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	samples := readReservoir(t, dir)
+	if len(samples) != reservoirSize {
+		t.Fatalf("reservoir holds %d samples, want %d", len(samples), reservoirSize)
+	}
+	for _, s := range samples {
+		if s != 1 {
+			t.Fatalf("reservoir holds %v, want only the latest samples", samples)
+		}
+	}
+}
+
+func TestUpdateMetricsUnreadableReservoir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, reservoirFile), []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateMetrics(dir, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if samples := readReservoir(t, dir); len(samples) != 1 || samples[0] != 1 {
+		t.Errorf("reservoir holds %v, want [1]", samples)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// errNoInterface is returned by interfaceAddrs when the container
+// interface does not exist. That is the normal case for a plugin run
+// first: the runtime calls IPAM from the main plugin before that plugin
+// creates the interface.
+var errNoInterface = errors.New("interface does not exist yet, IPAM runs before the main plugin creates it")
+
+// interfaceAddrs returns the addresses configured on ifName inside the
+// network namespace at netnsPath.
+func interfaceAddrs(netnsPath, ifName string) ([]net.IP, error) {
+	var ips []net.IP
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		iface, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return errNoInterface
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+		return nil
+	})
+	return ips, err
+}
+
+// noNetns reports whether netnsPath is empty or a placeholder that some
+// runtimes pass for infra containers, which have no namespace to address.
+// skel refuses an ADD without CNI_NETNS, so the placeholders are what
+// reaches the plugin in practice.
+func noNetns(netnsPath string) bool {
+	switch netnsPath {
+	case "", "none", "/dev/null":
+		return true
+	}
+	return false
+}
+
+// netnsInode returns the inode of the network namespace at netnsPath,
+// which identifies the namespace however it is mounted.
+func netnsInode(netnsPath string) (uint64, error) {
+	fi, err := os.Stat(netnsPath)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("cannot stat %s", netnsPath)
+	}
+	return st.Ino, nil
+}
+
+// hasAddress reports whether ip is configured on the container interface.
+func hasAddress(args *skel.CmdArgs, ip net.IP) (bool, error) {
+	addrs, err := interfaceAddrs(args.Netns, args.IfName)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// routableAddrs returns the global unicast addresses on the container
+// interface, skipping loopback and link-local ones. Failing to look is
+// treated as having none, as is a missing interface, which is the usual
+// case before the main plugin runs.
+func routableAddrs(args *skel.CmdArgs, logger *log.Entry) []net.IP {
+	addrs, err := interfaceAddrs(args.Netns, args.IfName)
+	if err == errNoInterface {
+		logger.Debugf("No existing address to trust on %s: %v", args.IfName, err)
+		return nil
+	}
+	if err != nil {
+		logger.Debugf("Could not check for existing address on %s: %v", args.IfName, err)
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if addr.IsGlobalUnicast() {
+			ips = append(ips, addr)
+		}
+	}
+	return ips
+}
+
+// alreadyConfigured reports whether ip is on the container interface from
+// a previous ADD, which makes a retried ADD a no-op. Failing to look is
+// treated as not configured.
+func alreadyConfigured(args *skel.CmdArgs, ip net.IP, logger *log.Entry) bool {
+	ok, err := hasAddress(args, ip)
+	if err != nil {
+		logger.Debugf("Could not check for existing address on %s: %v", args.IfName, err)
+		return false
+	}
+	return ok
+}
+
+// verifyAddress checks that ip was actually applied to the container
+// interface and logs a warning if it was not. It only proves anything
+// once the interface has been wired, e.g. when this plugin runs after
+// the main plugin in a chain; a missing interface is logged at debug.
+func verifyAddress(args *skel.CmdArgs, ip net.IP, logger *log.Entry) {
+	ok, err := hasAddress(args, ip)
+	if err == errNoInterface {
+		logger.Debugf("Not verifying address %s on %s: %v", ip.String(), args.IfName, err)
+		return
+	}
+	if err != nil {
+		logger.Warnf("Could not verify address %s on %s: %v", ip.String(), args.IfName, err)
+		return
+	}
+	if ok {
+		logger.Debugf("Verified address %s on %s", ip.String(), args.IfName)
+		return
+	}
+	logger.Warnf("Address %s is not configured on %s in %s", ip.String(), args.IfName, args.Netns)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// testNetns creates a network namespace holding a veth interface named
+// ifName with the given addresses, as a main plugin run before IPAM would
+// leave it, or no interface if ifName is empty. The test is skipped where
+// namespaces cannot be created. The caller closes the namespace.
+func testNetns(t *testing.T, ifName string, addrs ...string) ns.NetNS {
+	if os.Getuid() != 0 {
+		t.Skip("creating a network namespace requires root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("the ip command is required")
+	}
+	netns, err := ns.NewNS()
+	if err != nil {
+		t.Skipf("cannot create a network namespace: %v", err)
+	}
+	if ifName == "" {
+		return netns
+	}
+	err = netns.Do(func(ns.NetNS) error {
+		cmds := [][]string{{"link", "add", ifName, "type", "veth", "peer", "name", "peer0"}}
+		for _, addr := range addrs {
+			cmds = append(cmds, []string{"addr", "add", addr, "dev", ifName})
+		}
+		cmds = append(cmds, []string{"link", "set", ifName, "up"})
+		for _, cmd := range cmds {
+			if out, err := exec.Command("ip", cmd...).CombinedOutput(); err != nil {
+				return fmt.Errorf("ip %v: %v: %s", cmd, err, out)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		netns.Close()
+		t.Fatal(err)
+	}
+	return netns
+}
+
+func TestHasAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifName  string
+		addrs   []string
+		ip      string
+		want    bool
+		wantErr error
+	}{
+		{name: "interface not created yet", ip: "10.42.0.5", wantErr: errNoInterface},
+		{name: "prepared with the address", ifName: "eth0", addrs: []string{"10.42.0.5/16"}, ip: "10.42.0.5", want: true},
+		{name: "prepared with another address", ifName: "eth0", addrs: []string{"10.42.0.6/16"}, ip: "10.42.0.5"},
+		{name: "prepared without address", ifName: "eth0", ip: "10.42.0.5"},
+	}
+	for _, tt := range tests {
+		netns := testNetns(t, tt.ifName, tt.addrs...)
+		args := &skel.CmdArgs{ContainerID: "ctr", Netns: netns.Path(), IfName: "eth0"}
+		ok, err := hasAddress(args, calicoIP(tt.ip).IP)
+		netns.Close()
+		if err != tt.wantErr {
+			t.Errorf("%s: hasAddress() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if ok != tt.want {
+			t.Errorf("%s: hasAddress() = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestAlreadyConfigured(t *testing.T) {
+	tests := []struct {
+		name   string
+		ifName string
+		addrs  []string
+		want   bool
+	}{
+		{name: "first ADD, interface not created yet"},
+		{name: "retried ADD", ifName: "eth0", addrs: []string{"10.42.0.5/16"}, want: true},
+		{name: "interface with another address", ifName: "eth0", addrs: []string{"10.42.0.6/16"}},
+	}
+	for _, tt := range tests {
+		netns := testNetns(t, tt.ifName, tt.addrs...)
+		args := &skel.CmdArgs{ContainerID: "ctr", Netns: netns.Path(), IfName: "eth0"}
+		got := alreadyConfigured(args, calicoIP("10.42.0.5").IP, testLogger())
+		netns.Close()
+		if got != tt.want {
+			t.Errorf("%s: alreadyConfigured() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoutableAddrs(t *testing.T) {
+	tests := []struct {
+		name   string
+		ifName string
+		addrs  []string
+		want   []string
+	}{
+		{name: "interface not created yet"},
+		{name: "prepared without address", ifName: "eth0"},
+		{name: "prepared with addresses", ifName: "eth0", addrs: []string{"10.42.0.5/16", "fd00::5/64"}, want: []string{"10.42.0.5", "fd00::5"}},
+		{name: "link-local only", ifName: "eth0", addrs: []string{"169.254.0.5/16"}},
+	}
+	for _, tt := range tests {
+		netns := testNetns(t, tt.ifName, tt.addrs...)
+		args := &skel.CmdArgs{ContainerID: "ctr", Netns: netns.Path(), IfName: "eth0"}
+		ips := routableAddrs(args, testLogger())
+		netns.Close()
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: routableAddrs() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSkipNoNetns(t *testing.T) {
+	tests := []struct {
+		name     string
+		skip     bool
+		netns    string
+		wantSkip bool
+	}{
+		{name: "none", skip: true, netns: "none", wantSkip: true},
+		{name: "empty", skip: true, netns: "", wantSkip: true},
+		{name: "dev null", skip: true, netns: "/dev/null", wantSkip: true},
+		{name: "netns path", skip: true, netns: "/var/run/netns/ctr-1"},
+		{name: "not skipping", netns: "none"},
+	}
+	for _, tt := range tests {
+		_, ts := newFakeMetadata(metadataContainer("ctr-1", "uuid-1", "10.42.0.5"))
+		ipam := &fakeIPAM{}
+		restore := useFakeCalico(&fakeCalico{ipam: ipam, pools: &fakePools{cidrs: []string{"10.42.0.0/16"}}})
+		args := &skel.CmdArgs{ContainerID: "ctr-1", Netns: tt.netns, IfName: "eth0"}
+		results, err := runAdd(ts.URL, fmt.Sprintf(`"skipNoNetns": %v`, tt.skip), args)
+		restore()
+		ts.Close()
+		if err != nil || len(results) != 1 {
+			t.Errorf("%s: cmdAdd() = %v, %v, want one result", tt.name, results, err)
+			continue
+		}
+		r, empty := results[0].(*types.Result)
+		if skipped := empty && r.IP4 == nil && len(ipam.handles) == 0; skipped != tt.wantSkip {
+			t.Errorf("%s: result %+v and assignments %v, want skipped %v", tt.name, results[0], ipam.handles, tt.wantSkip)
+		}
+	}
+}
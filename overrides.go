@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+)
+
+// overridesFileEnv names a JSON file pinning containers to fixed IPs, e.g.
+// {"<container id or rancher uuid>": "10.42.0.10"}.
+const overridesFileEnv = "RANCHER_IP_OVERRIDES"
+
+// loadOverrides reads and validates the override file. A missing file
+// means no overrides.
+func loadOverrides(path string) (map[string]net.IP, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]string{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	overrides := map[string]net.IP{}
+	for id, value := range raw {
+		if id == "" {
+			return nil, fmt.Errorf("empty container id mapped to %q", value)
+		}
+		ip, err := metadata.ParseIP(value)
+		if err != nil {
+			return nil, fmt.Errorf("container %s: %v", id, err)
+		}
+		overrides[id] = ip
+	}
+	return overrides, nil
+}
+
+// applyOverride sets ipamArgs.IP from the override file when it pins the
+// container ID or Rancher UUID. The file is re-read on every invocation.
+func applyOverride(args *skel.CmdArgs, ipamArgs *ipamArgs, logger *log.Entry) error {
+	path := os.Getenv(overridesFileEnv)
+	if path == "" {
+		return nil
+	}
+	overrides, err := loadOverrides(path)
+	if err != nil {
+		return fmt.Errorf("invalid %s file %s: %v", overridesFileEnv, path, err)
+	}
+	for _, id := range []string{args.ContainerID, string(ipamArgs.RancherContainerUUID)} {
+		if ip, ok := overrides[id]; ok && id != "" {
+			logger.WithField("id", id).Infof("Using IP %s from %s", ip.String(), path)
+			ipamArgs.IP = ip
+			return nil
+		}
+	}
+	return nil
+}
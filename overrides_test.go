@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestApplyOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv(overridesFileEnv)
+
+	tests := []struct {
+		name    string
+		file    string // contents of the override file; empty for none
+		uuid    string
+		wantIP  string
+		wantErr string
+	}{
+		{name: "no file", wantIP: "<nil>"},
+		{name: "by container id", file: `{"ctr": "10.42.0.10"}`, wantIP: "10.42.0.10"},
+		{name: "by rancher uuid", file: `{"uuid-web": "10.42.0.11"}`, uuid: "uuid-web", wantIP: "10.42.0.11"},
+		{name: "container id first", file: `{"ctr": "10.42.0.10", "uuid-web": "10.42.0.11"}`, uuid: "uuid-web", wantIP: "10.42.0.10"},
+		{name: "not pinned", file: `{"other": "10.42.0.10"}`, wantIP: "<nil>"},
+		{name: "IPv4 canonical", file: `{"ctr": "::ffff:10.42.0.10"}`, wantIP: "10.42.0.10"},
+		{name: "invalid IP", file: `{"ctr": "10.42.0"}`, wantErr: "container ctr"},
+		{name: "empty id", file: `{"": "10.42.0.10"}`, wantErr: "empty container id"},
+		{name: "malformed", file: `{"ctr": `, wantErr: "invalid " + overridesFileEnv},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "missing.json")
+		if tt.file != "" {
+			path = filepath.Join(dir, tt.name+".json")
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.Setenv(overridesFileEnv, path)
+		args := ipamArgs{RancherContainerUUID: types.UnmarshallableString(tt.uuid)}
+		err := applyOverride(&skel.CmdArgs{ContainerID: "ctr"}, &args, testLogger())
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: applyOverride() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: applyOverride() error = %v", tt.name, err)
+			continue
+		}
+		if got := args.IP.String(); got != tt.wantIP {
+			t.Errorf("%s: IP = %s, want %s", tt.name, got, tt.wantIP)
+		}
+	}
+}
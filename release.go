@@ -0,0 +1,269 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/calico-cni/utils"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/client"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+const (
+	// defaultConfirmReleaseTimeout bounds confirmRelease unless
+	// confirmReleaseTimeoutMs is set.
+	defaultConfirmReleaseTimeout = 2 * time.Second
+	confirmReleaseInterval       = 100 * time.Millisecond
+	// defaultEndpointListRetries and endpointListRetryWait pace
+	// listEndpoints unless endpointListRetries is set.
+	defaultEndpointListRetries = 2
+	endpointListRetryWait      = 200 * time.Millisecond
+)
+
+// runRelease implements "release [--force] <containerID>", which frees
+// the Calico allocation and workload endpoints of a container whose DEL
+// was missed. The netconf is read from stdin as for an ADD. Without
+// --force it only prints what would be released.
+func runRelease(args []string) error {
+	flagSet := flag.NewFlagSet("release", flag.ExitOnError)
+	force := flagSet.Bool("force", false, "Release without asking for confirmation")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: release [--force] <containerID>")
+	}
+
+	conf, calicoClient, err := stdinClient()
+	if err != nil {
+		return err
+	}
+	return releaseManually(calicoClient.IPAM(), calicoClient.WorkloadEndpoints(), conf, flagSet.Arg(0), *force)
+}
+
+// releaseManually prints the addresses and workload endpoints of
+// workloadID and, if force is set, releases them.
+func releaseManually(ipam client.IPAMInterface, endpoints client.WorkloadEndpointInterface, conf NetConf, workloadID string, force bool) error {
+	ips, err := ipam.IPsByHandle(workloadID)
+	if _, ok := err.(errors.ErrorResourceDoesNotExist); err != nil && !ok {
+		return err
+	}
+	listed, err := listEndpoints(endpoints, conf, workloadID)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		fmt.Printf("address %s\n", ip.String())
+	}
+	for _, ep := range listed {
+		fmt.Printf("endpoint %s/%s/%s/%s\n", ep.Metadata.Node, ep.Metadata.Orchestrator, ep.Metadata.Workload, ep.Metadata.Name)
+	}
+	if !force {
+		return fmt.Errorf("not released, rerun with --force to release the above")
+	}
+
+	logger := utils.CreateContextLogger(workloadID)
+	if err := releaseWorkload(ipam, workloadID, releaseReasonManual, logger); err != nil {
+		return err
+	}
+	for _, ep := range listed {
+		if err := endpoints.Delete(ep.Metadata); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("released %d addresses and %d endpoints\n", len(ips), len(listed))
+	return nil
+}
+
+// runReleaseBatch implements "release-batch [--force] <containerID>...",
+// release for many containers at once, as when draining a node. The
+// addresses of all containers are freed in a single ReleaseIPs call,
+// which groups the datastore writes by block. Each container's outcome
+// is printed on a line of its own.
+func runReleaseBatch(args []string) error {
+	flagSet := flag.NewFlagSet("release-batch", flag.ExitOnError)
+	force := flagSet.Bool("force", false, "Release without asking for confirmation")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() == 0 {
+		return fmt.Errorf("usage: release-batch [--force] <containerID>...")
+	}
+
+	conf, calicoClient, err := stdinClient()
+	if err != nil {
+		return err
+	}
+	return releaseBatch(calicoClient.IPAM(), calicoClient.WorkloadEndpoints(), conf, flagSet.Args(), *force)
+}
+
+// releaseBatch prints the addresses and workload endpoints of each of
+// ids and, if force is set, releases them.
+func releaseBatch(ipam client.IPAMInterface, endpoints client.WorkloadEndpointInterface, conf NetConf, ids []string, force bool) error {
+	type workload struct {
+		id        string
+		ips       []cnet.IP
+		endpoints []api.WorkloadEndpoint
+		err       error
+	}
+	var workloads []*workload
+	var ips []cnet.IP
+	for _, id := range ids {
+		w := &workload{id: id}
+		workloads = append(workloads, w)
+		w.ips, w.err = ipam.IPsByHandle(id)
+		if _, ok := w.err.(errors.ErrorResourceDoesNotExist); ok {
+			w.err = nil
+		}
+		if w.err != nil {
+			continue
+		}
+		w.endpoints, w.err = listEndpoints(endpoints, conf, id)
+		if w.err != nil {
+			continue
+		}
+		ips = append(ips, w.ips...)
+	}
+	if !force {
+		for _, w := range workloads {
+			if w.err != nil {
+				fmt.Printf("%s: error: %v\n", w.id, w.err)
+			} else {
+				fmt.Printf("%s: %d addresses, %d endpoints\n", w.id, len(w.ips), len(w.endpoints))
+			}
+		}
+		return fmt.Errorf("not released, rerun with --force to release the above")
+	}
+
+	if len(ips) > 0 {
+		if _, err := ipam.ReleaseIPs(ips); err != nil {
+			return fmt.Errorf("failed to release %d addresses: %v", len(ips), err)
+		}
+		for _, w := range workloads {
+			if len(w.ips) > 0 {
+				utils.CreateContextLogger(w.id).WithFields(log.Fields{"releaseReason": releaseReasonManual, "ips": w.ips}).Info("Released addresses")
+			}
+		}
+	}
+	failed := 0
+	for _, w := range workloads {
+		if w.err == nil {
+			for _, ep := range w.endpoints {
+				if w.err = endpoints.Delete(ep.Metadata); w.err != nil {
+					break
+				}
+			}
+		}
+		switch {
+		case w.err != nil:
+			failed++
+			fmt.Printf("%s: error: %v\n", w.id, w.err)
+		case len(w.ips) == 0 && len(w.endpoints) == 0:
+			fmt.Printf("%s: unknown, nothing to release\n", w.id)
+		default:
+			fmt.Printf("%s: released %d addresses and %d endpoints\n", w.id, len(w.ips), len(w.endpoints))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d containers not fully released", failed, len(workloads))
+	}
+	return nil
+}
+
+// stdinClient reads the netconf from stdin, as for an ADD, and returns it
+// with a Calico client for it.
+func stdinClient() (NetConf, *client.Client, error) {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return NetConf{}, nil, fmt.Errorf("error reading from stdin: %v", err)
+	}
+	conf, err := loadNetConf(data)
+	if err != nil {
+		return conf, nil, err
+	}
+	utils.ConfigureLogging(conf.LogLevel)
+	calicoClient, err := utils.CreateClient(conf.NetConf)
+	return conf, calicoClient, err
+}
+
+// listEndpoints lists the workload endpoints of workloadID, retrying a
+// failed list up to endpointListRetries times so that a datastore blip
+// does not skip the cleanup. An empty list, or a workload the datastore
+// does not know, is an answer and yields no endpoints at once.
+func listEndpoints(endpoints client.WorkloadEndpointInterface, conf NetConf, workloadID string) ([]api.WorkloadEndpoint, error) {
+	retries := conf.EndpointListRetries
+	if retries == 0 {
+		retries = defaultEndpointListRetries
+	}
+	for attempt := 0; ; attempt++ {
+		list, err := endpoints.List(api.WorkloadEndpointMetadata{Workload: workloadID})
+		if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
+			return nil, nil
+		}
+		if err == nil {
+			return list.Items, nil
+		}
+		if attempt >= retries {
+			return nil, fmt.Errorf("failed to list endpoints of %s: %v", workloadID, err)
+		}
+		log.Debugf("rancher-calico-ipam: retrying endpoint list of %s (%d/%d): %v", workloadID, attempt+1, retries, err)
+		clock.Sleep(endpointListRetryWait)
+	}
+}
+
+// Release reasons, logged as the releaseReason field of every release so
+// that audit logs tell why an address was freed.
+const (
+	releaseReasonDel    = "del"
+	releaseReasonManual = "manual"
+	releaseReasonRetry  = "retry"
+)
+
+// releaseWorkload releases the addresses assigned under workloadID for
+// reason. A workload without addresses is not an error, which keeps DEL
+// idempotent: a container that never got an IP on ADD, or was already
+// cleaned up, has no handle.
+func releaseWorkload(ipam client.IPAMInterface, workloadID, reason string, logger *log.Entry) error {
+	logger = logger.WithField("releaseReason", reason)
+	logger.Info("Releasing address using workloadID")
+	span := commandSpan.child("calico.releaseByHandle")
+	span.set("release.reason", reason)
+	err := ipam.ReleaseByHandle(workloadID)
+	span.end(err)
+	if err != nil {
+		if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
+			logger.Info("No IP to release")
+			return nil
+		}
+		return err
+	}
+	logger.Info("Released address using workloadID")
+	return nil
+}
+
+// confirmRelease polls Calico until it no longer lists an address for
+// the handle workloadID, so that a quickly following ADD does not see a
+// stale allocation. It fails once timeout has passed.
+func confirmRelease(ipam client.IPAMInterface, workloadID string, timeout time.Duration, logger *log.Entry) error {
+	deadline := clock.Now().Add(timeout)
+	for {
+		ips, err := ipam.IPsByHandle(workloadID)
+		if _, ok := err.(errors.ErrorResourceDoesNotExist); ok || (err == nil && len(ips) == 0) {
+			logger.Info("Confirmed address release")
+			return nil
+		}
+		if clock.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("cannot confirm release of %s within %v: %v", workloadID, timeout, err)
+			}
+			return fmt.Errorf("addresses %v of %s still allocated after %v", ips, workloadID, timeout)
+		}
+		clock.Sleep(confirmReleaseInterval)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/client"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// fakeIPAM is a Calico IPAM keeping the addresses of each handle in
+// memory. Methods the tests do not use panic on the nil embedded
+// interface.
+type fakeIPAM struct {
+	client.IPAMInterface
+	handles map[string][]cnet.IP
+	// releaseErr, if set, fails every ReleaseByHandle.
+	releaseErr error
+	// freeAfter, if set, frees a handle once IPsByHandle has listed its
+	// addresses that many times, as a lagging datastore would.
+	freeAfter int
+	lookups   int
+	// autoIPv4 is the address AutoAssign hands out.
+	autoIPv4 string
+}
+
+func (f *fakeIPAM) ReleaseByHandle(handleID string) error {
+	if f.releaseErr != nil {
+		return f.releaseErr
+	}
+	if _, ok := f.handles[handleID]; !ok {
+		return errors.ErrorResourceDoesNotExist{Identifier: handleID}
+	}
+	delete(f.handles, handleID)
+	return nil
+}
+
+func (f *fakeIPAM) IPsByHandle(handleID string) ([]cnet.IP, error) {
+	if f.freeAfter > 0 && f.lookups == f.freeAfter {
+		delete(f.handles, handleID)
+	}
+	f.lookups++
+	ips, ok := f.handles[handleID]
+	if !ok {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: handleID}
+	}
+	return ips, nil
+}
+
+// ReleaseIPs releases ips from every handle, dropping emptied handles,
+// and returns those that were not assigned.
+func (f *fakeIPAM) ReleaseIPs(ips []cnet.IP) ([]cnet.IP, error) {
+	var unallocated []cnet.IP
+	for _, ip := range ips {
+		found := false
+		for handle, assigned := range f.handles {
+			for i, a := range assigned {
+				if a.Equal(ip.IP) {
+					assigned = append(assigned[:i], assigned[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if len(assigned) == 0 {
+				delete(f.handles, handle)
+			} else {
+				f.handles[handle] = assigned
+			}
+		}
+		if !found {
+			unallocated = append(unallocated, ip)
+		}
+	}
+	return unallocated, nil
+}
+
+func (f *fakeIPAM) AutoAssign(args client.AutoAssignArgs) ([]cnet.IP, []cnet.IP, error) {
+	if args.Num4 != 1 || args.Num6 != 0 || f.autoIPv4 == "" {
+		return nil, nil, fmt.Errorf("cannot assign %d IPv4 and %d IPv6 addresses", args.Num4, args.Num6)
+	}
+	ip := calicoIP(f.autoIPv4)
+	if err := f.AssignIP(client.AssignIPArgs{IP: ip, HandleID: args.HandleID}); err != nil {
+		return nil, nil, err
+	}
+	return []cnet.IP{ip}, nil, nil
+}
+
+func (f *fakeIPAM) AssignIP(args client.AssignIPArgs) error {
+	if f.handles == nil {
+		f.handles = map[string][]cnet.IP{}
+	}
+	f.handles[*args.HandleID] = append(f.handles[*args.HandleID], args.IP)
+	return nil
+}
+
+// calicoIP parses s as a Calico address.
+func calicoIP(s string) cnet.IP {
+	return cnet.IP{IP: net.ParseIP(s)}
+}
+
+func testLogger() *log.Entry {
+	return log.NewEntry(log.StandardLogger())
+}
+
+func TestReleaseWorkload(t *testing.T) {
+	blip := errors.ErrorDatastoreError{Err: fmt.Errorf("etcd unavailable")}
+	tests := []struct {
+		name       string
+		handles    map[string][]cnet.IP
+		releaseErr error
+		wantErr    bool
+	}{
+		{
+			name:    "assigned container",
+			handles: map[string][]cnet.IP{"ctr": {calicoIP("10.42.0.5")}},
+		},
+		{
+			name:    "unknown container",
+			handles: map[string][]cnet.IP{},
+		},
+		{
+			name:       "datastore failure",
+			handles:    map[string][]cnet.IP{"ctr": {calicoIP("10.42.0.5")}},
+			releaseErr: blip,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		ipam := &fakeIPAM{handles: tt.handles, releaseErr: tt.releaseErr}
+		err := releaseWorkload(ipam, "ctr", releaseReasonDel, testLogger())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: releaseWorkload() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if !tt.wantErr && len(ipam.handles["ctr"]) != 0 {
+			t.Errorf("%s: handle still holds %v", tt.name, ipam.handles["ctr"])
+		}
+	}
+}
+
+func TestConfirmRelease(t *testing.T) {
+	tests := []struct {
+		name       string
+		handles    map[string][]cnet.IP
+		freeAfter  int
+		wantErr    bool
+		wantSleeps int
+	}{
+		{name: "already free", handles: map[string][]cnet.IP{}},
+		{
+			name:       "freed after one poll",
+			handles:    map[string][]cnet.IP{"ctr": {calicoIP("10.42.0.5")}},
+			freeAfter:  1,
+			wantSleeps: 1,
+		},
+		{
+			name:       "never freed",
+			handles:    map[string][]cnet.IP{"ctr": {calicoIP("10.42.0.5")}},
+			wantErr:    true,
+			wantSleeps: 11,
+		},
+	}
+	for _, tt := range tests {
+		fake, restore := useFakeClock()
+		ipam := &fakeIPAM{handles: tt.handles, freeAfter: tt.freeAfter}
+		err := confirmRelease(ipam, "ctr", time.Second, testLogger())
+		restore()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: confirmRelease() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if sleeps := len(fake.Sleeps()); sleeps != tt.wantSleeps {
+			t.Errorf("%s: polled after %d waits, want %d", tt.name, sleeps, tt.wantSleeps)
+		}
+	}
+}
+
+// fakeEndpoints holds workload endpoints in memory, failing the first
+// failures lists.
+type fakeEndpoints struct {
+	client.WorkloadEndpointInterface
+	items    []api.WorkloadEndpoint
+	failures int
+	lists    int
+}
+
+func (f *fakeEndpoints) Delete(metadata api.WorkloadEndpointMetadata) error {
+	for i, ep := range f.items {
+		if ep.Metadata.Workload == metadata.Workload && ep.Metadata.Name == metadata.Name {
+			f.items = append(f.items[:i], f.items[i+1:]...)
+			return nil
+		}
+	}
+	return errors.ErrorResourceDoesNotExist{Identifier: metadata}
+}
+
+func (f *fakeEndpoints) List(metadata api.WorkloadEndpointMetadata) (*api.WorkloadEndpointList, error) {
+	f.lists++
+	if f.lists <= f.failures {
+		return nil, errors.ErrorDatastoreError{Err: fmt.Errorf("etcd unavailable")}
+	}
+	var items []api.WorkloadEndpoint
+	for _, ep := range f.items {
+		if ep.Metadata.Workload == metadata.Workload {
+			items = append(items, ep)
+		}
+	}
+	if len(items) == 0 {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: metadata}
+	}
+	return &api.WorkloadEndpointList{Items: items}, nil
+}
+
+func TestListEndpoints(t *testing.T) {
+	ep := api.WorkloadEndpoint{Metadata: api.WorkloadEndpointMetadata{Node: "node-1", Orchestrator: "cni", Workload: "ctr", Name: "eth0"}}
+	tests := []struct {
+		name      string
+		retries   int
+		items     []api.WorkloadEndpoint
+		failures  int
+		want      int
+		wantErr   bool
+		wantLists int
+	}{
+		{name: "listed", items: []api.WorkloadEndpoint{ep}, want: 1, wantLists: 1},
+		{name: "unknown workload", wantLists: 1},
+		{name: "fails once", items: []api.WorkloadEndpoint{ep}, failures: 1, want: 1, wantLists: 2},
+		{name: "fails past the retries", items: []api.WorkloadEndpoint{ep}, failures: 3, wantErr: true, wantLists: 3},
+		{name: "retries disabled", retries: -1, items: []api.WorkloadEndpoint{ep}, failures: 1, wantErr: true, wantLists: 1},
+	}
+	for _, tt := range tests {
+		fake, restore := useFakeClock()
+		endpoints := &fakeEndpoints{items: tt.items, failures: tt.failures}
+		got, err := listEndpoints(endpoints, NetConf{EndpointListRetries: tt.retries}, "ctr")
+		restore()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: listEndpoints() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if len(got) != tt.want {
+			t.Errorf("%s: listEndpoints() = %v, want %d endpoints", tt.name, got, tt.want)
+		}
+		if endpoints.lists != tt.wantLists {
+			t.Errorf("%s: %d lists, want %d", tt.name, endpoints.lists, tt.wantLists)
+		}
+		if waits := len(fake.Sleeps()); waits != tt.wantLists-1 {
+			t.Errorf("%s: %d waits between %d lists", tt.name, waits, tt.wantLists)
+		}
+	}
+}
+
+func TestReleaseManually(t *testing.T) {
+	ep := api.WorkloadEndpoint{Metadata: api.WorkloadEndpointMetadata{Node: "node-1", Orchestrator: "cni", Workload: "ctr", Name: "eth0"}}
+	tests := []struct {
+		name         string
+		id           string
+		force        bool
+		wantErr      bool
+		wantReleased bool
+	}{
+		{name: "without force", id: "ctr", wantErr: true},
+		{name: "forced", id: "ctr", force: true, wantReleased: true},
+		{name: "unknown container", id: "other", force: true},
+	}
+	for _, tt := range tests {
+		ipam := &fakeIPAM{handles: map[string][]cnet.IP{"ctr": {calicoIP("10.42.0.5")}}}
+		endpoints := &fakeEndpoints{items: []api.WorkloadEndpoint{ep}}
+		err := releaseManually(ipam, endpoints, NetConf{}, tt.id, tt.force)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: releaseManually() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		_, allocated := ipam.handles["ctr"]
+		if released := !allocated && len(endpoints.items) == 0; released != tt.wantReleased {
+			t.Errorf("%s: addresses %v and endpoints %v left, want released %v", tt.name, ipam.handles, endpoints.items, tt.wantReleased)
+		}
+		if !tt.wantReleased && (!allocated || len(endpoints.items) != 1) {
+			t.Errorf("%s: addresses %v and endpoints %v left, want both kept", tt.name, ipam.handles, endpoints.items)
+		}
+	}
+}
+
+func TestReleaseBatch(t *testing.T) {
+	ep := api.WorkloadEndpoint{Metadata: api.WorkloadEndpointMetadata{Node: "node-1", Orchestrator: "cni", Workload: "ctr", Name: "eth0"}}
+	other := api.WorkloadEndpoint{Metadata: api.WorkloadEndpointMetadata{Node: "node-1", Orchestrator: "cni", Workload: "kept", Name: "eth0"}}
+	for _, force := range []bool{false, true} {
+		ipam := &fakeIPAM{handles: map[string][]cnet.IP{
+			"ctr":  {calicoIP("10.42.0.5"), calicoIP("fd00::5")},
+			"kept": {calicoIP("10.42.0.6")},
+		}}
+		endpoints := &fakeEndpoints{items: []api.WorkloadEndpoint{ep, other}}
+		err := releaseBatch(ipam, endpoints, NetConf{}, []string{"ctr", "unknown"}, force)
+		if (err != nil) == force {
+			t.Errorf("force %v: releaseBatch() error = %v", force, err)
+		}
+		_, allocated := ipam.handles["ctr"]
+		if allocated == force || (len(endpoints.items) == 1) != force {
+			t.Errorf("force %v: addresses %v and endpoints %v left, want ctr released %v", force, ipam.handles, endpoints.items, force)
+		}
+		if len(ipam.handles["kept"]) != 1 || endpoints.items[len(endpoints.items)-1].Metadata.Workload != "kept" {
+			t.Errorf("force %v: released %v, not in the batch", force, other.Metadata.Workload)
+		}
+	}
+}
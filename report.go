@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/rancher-cni-ipam/ipfinder/api"
+)
+
+// reportIP writes the assigned IP back to the container's reportIPLabel
+// through the Rancher API so that reconciliation tooling can see what CNI
+// committed. Failures are logged and never fail the ADD.
+func reportIP(conf NetConf, args *skel.CmdArgs, ipamArgs *ipamArgs, r *types.Result, logger *log.Entry) {
+	if conf.ReportIPLabel == "" {
+		return
+	}
+	var ip net.IP
+	if r.IP4 != nil {
+		ip = r.IP4.IP.IP
+	} else if r.IP6 != nil {
+		ip = r.IP6.IP.IP
+	} else {
+		return
+	}
+	if conf.RancherAPI.URL == "" {
+		logger.Warn("reportIPLabel is set but rancherAPI.url is not, not reporting IP")
+		return
+	}
+
+	filter := map[string]string{"externalId": args.ContainerID}
+	if ipamArgs.RancherContainerUUID != "" {
+		filter = map[string]string{"uuid": string(ipamArgs.RancherContainerUUID)}
+	}
+	c := api.NewClient(conf.RancherAPI.URL, conf.RancherAPI.AccessKey, conf.RancherAPI.SecretKey)
+	containers, err := c.FindContainers(filter)
+	if err != nil {
+		logger.Warnf("Failed to look up container in Rancher API: %v", err)
+		return
+	}
+	if len(containers) != 1 {
+		logger.Warnf("Found %d containers in Rancher API for %v, not reporting IP", len(containers), filter)
+		return
+	}
+	if err := c.SetLabel(containers[0], conf.ReportIPLabel, ip.String()); err != nil {
+		logger.Warnf("Failed to report IP to Rancher API: %v", err)
+		return
+	}
+	logger.WithField(conf.ReportIPLabel, ip.String()).Info("Reported IP to Rancher API")
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+)
+
+// The vendored CNI library only knows the 0.2.0 result layout, so the
+// 0.3.x layout is defined here and built from a types.Result on output.
+
+// result030 is a CNI 0.3.x result.
+type result030 struct {
+	CNIVersion string         `json:"cniVersion,omitempty"`
+	Interfaces []*interface03 `json:"interfaces,omitempty"`
+	IPs        []*ipConfig03  `json:"ips,omitempty"`
+	Routes     []types.Route  `json:"routes,omitempty"`
+	DNS        types.DNS      `json:"dns,omitempty"`
+	Source     *ipSource      `json:"io.rancher.calico-ipam,omitempty"`
+}
+
+// interface03 is an entry of a 0.3.x result's interfaces list.
+type interface03 struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// ipConfig03 is an entry of a 0.3.x result's ips list. Interface is an
+// index into the result's interfaces list.
+type ipConfig03 struct {
+	Version   string      `json:"version"`
+	Interface *int        `json:"interface,omitempty"`
+	Address   types.IPNet `json:"address"`
+	Gateway   net.IP      `json:"gateway,omitempty"`
+}
+
+// ipSource records which metadata endpoint resolved the container IP and
+// when. It is emitted under the "io.rancher.calico-ipam" result key, which
+// is namespaced so that it cannot clash with fields of any CNI result
+// version. Runtimes cache the result, so it remains available for
+// post-hoc debugging.
+type ipSource struct {
+	MetadataURL    string `json:"metadataURL"`
+	ResolvedAt     string `json:"resolvedAt"`
+	ResolutionTime string `json:"resolutionTime"`
+	// labels are the metadata labels of the container, kept for the
+	// result cache but not emitted.
+	labels map[string]string
+}
+
+// result020 is a 0.2.0 result annotated with its ipSource.
+type result020 struct {
+	*types.Result
+	Source *ipSource `json:"io.rancher.calico-ipam,omitempty"`
+}
+
+// printResult emits the CNI result of an ADD, stdout by default. Tests
+// replace it to capture the result in memory.
+var printResult = func(result interface{}) error {
+	data, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// emitResult writes r in the layout of the requested CNI version. When
+// the plugin is chained, the prevResult from the netconf is merged in so
+// that upstream interfaces, addresses and routes are passed on.
+func emitResult(conf NetConf, args *skel.CmdArgs, r *types.Result, source *ipSource) error {
+	recordResultIPs(r)
+	result, err := buildResult(conf, args, r, source)
+	if err != nil {
+		return err
+	}
+	if conf.AddLock {
+		var labels map[string]string
+		if conf.CacheLabels && source != nil {
+			labels = source.labels
+		}
+		saveResult(args.ContainerID, r, source, labels)
+	}
+	if conf.ResultSocket != "" {
+		sendResult(conf.ResultSocket, args, result)
+	}
+	return printResult(result)
+}
+
+// resultSocketTimeout bounds delivering a result to resultSocket.
+const resultSocketTimeout = time.Second
+
+// resultMessage is what sendResult writes to resultSocket.
+type resultMessage struct {
+	ContainerID string      `json:"containerID"`
+	Netns       string      `json:"netns"`
+	IfName      string      `json:"ifName"`
+	Result      interface{} `json:"result"`
+}
+
+// sendResult writes the result of an ADD, as one JSON line, to the Unix
+// socket of a supervising agent. The result still goes to stdout, and a
+// failure is only logged.
+func sendResult(path string, args *skel.CmdArgs, result interface{}) {
+	data, err := json.Marshal(resultMessage{args.ContainerID, args.Netns, args.IfName, result})
+	if err != nil {
+		log.Warnf("rancher-calico-ipam: cannot encode the result for %s: %v", path, err)
+		return
+	}
+	conn, err := net.DialTimeout("unix", path, resultSocketTimeout)
+	if err != nil {
+		log.Warnf("rancher-calico-ipam: cannot send the result to %s: %v", path, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(resultSocketTimeout))
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		log.Warnf("rancher-calico-ipam: cannot send the result to %s: %v", path, err)
+	}
+}
+
+// checkFamilies fails an ADD under ipFamilyPreference dual for which
+// metadata resolved only one family. With partialResults the ADD goes on
+// if the prevResult of the chain has an address of the missing family,
+// which the merged result passes on.
+func checkFamilies(conf NetConf, nets []net.IPNet, logger *log.Entry) error {
+	has4, has6 := false, false
+	for _, n := range nets {
+		if n.IP.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+	if has4 && has6 {
+		return nil
+	}
+	missing := metadata.FamilyIPv6
+	if has6 {
+		missing = metadata.FamilyIPv4
+	}
+	if conf.PartialResults && conf.PrevResult != nil {
+		prev, err := prevResultIPs(*conf.PrevResult)
+		if err != nil {
+			return err
+		}
+		for _, ip := range prev {
+			if (ip.To4() != nil) == (missing == metadata.FamilyIPv4) {
+				logger.Infof("Rancher metadata has no %s address, passing on %s from prevResult", missing, ip.String())
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("rancher metadata resolved no %s address for ipFamilyPreference dual", missing)
+}
+
+// buildResult is emitResult without the output.
+func buildResult(conf NetConf, args *skel.CmdArgs, r *types.Result, source *ipSource) (interface{}, error) {
+	if !strings.HasPrefix(conf.CNIVersion, "0.3.") {
+		if conf.PrevResult != nil {
+			prev := &types.Result{}
+			if err := json.Unmarshal(*conf.PrevResult, prev); err != nil {
+				return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+			}
+			r = mergeResult020(prev, r)
+		}
+		r = capResult020(conf, r)
+		if source != nil {
+			return &result020{r, source}, nil
+		}
+		return r, nil
+	}
+
+	result := convertResult030(conf.CNIVersion, args, r)
+	if conf.PrevResult != nil {
+		prev := &result030{}
+		if err := json.Unmarshal(*conf.PrevResult, prev); err != nil {
+			return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+		}
+		result = mergeResult030(prev, result, args.IfName)
+	}
+	capResult030(conf, result)
+	result.Source = source
+	return result, nil
+}
+
+// mergeResult020 adds r to a 0.2.0 prevResult. The 0.2.0 layout holds a
+// single address per family, so ours replaces the upstream one.
+func mergeResult020(prev, r *types.Result) *types.Result {
+	merged := *prev
+	if r.IP4 != nil {
+		merged.IP4 = r.IP4
+	}
+	if r.IP6 != nil {
+		merged.IP6 = r.IP6
+	}
+	if len(r.DNS.Nameservers) > 0 {
+		merged.DNS = r.DNS
+	}
+	return &merged
+}
+
+// mergeResult030 appends our addresses and routes to a 0.3.x prevResult.
+// The addresses are attributed to the upstream interface named ifName,
+// which is added if no upstream plugin reported it.
+func mergeResult030(prev, r *result030, ifName string) *result030 {
+	merged := &result030{
+		CNIVersion: r.CNIVersion,
+		Interfaces: append([]*interface03{}, prev.Interfaces...),
+		IPs:        append([]*ipConfig03{}, prev.IPs...),
+		Routes:     append(append([]types.Route{}, prev.Routes...), r.Routes...),
+		DNS:        prev.DNS,
+	}
+	index := -1
+	for i, iface := range prev.Interfaces {
+		if iface.Name == ifName {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		merged.Interfaces = append(merged.Interfaces, r.Interfaces...)
+		index = len(prev.Interfaces)
+	}
+	for _, ip := range r.IPs {
+		ipc := *ip
+		ipc.Interface = &index
+		merged.IPs = append(merged.IPs, &ipc)
+	}
+	if len(merged.DNS.Nameservers) == 0 {
+		merged.DNS = r.DNS
+	}
+	return merged
+}
+
+// Default caps on the result size, generous enough for any sane setup.
+const (
+	defaultMaxResultIPs    = 16
+	defaultMaxResultRoutes = 64
+)
+
+// resultCaps returns the configured caps on addresses and routes.
+func (conf NetConf) resultCaps() (maxIPs, maxRoutes int) {
+	maxIPs, maxRoutes = defaultMaxResultIPs, defaultMaxResultRoutes
+	if conf.MaxResultIPs > 0 {
+		maxIPs = conf.MaxResultIPs
+	}
+	if conf.MaxResultRoutes > 0 {
+		maxRoutes = conf.MaxResultRoutes
+	}
+	return maxIPs, maxRoutes
+}
+
+// capResult030 truncates the addresses and routes of result to the
+// configured caps, as some runtimes choke on oversized results.
+func capResult030(conf NetConf, result *result030) {
+	maxIPs, maxRoutes := conf.resultCaps()
+	if len(result.IPs) > maxIPs {
+		log.Warnf("rancher-calico-ipam: result has %d addresses, keeping the first %d", len(result.IPs), maxIPs)
+		result.IPs = result.IPs[:maxIPs]
+	}
+	if len(result.Routes) > maxRoutes {
+		log.Warnf("rancher-calico-ipam: result has %d routes, keeping the first %d", len(result.Routes), maxRoutes)
+		result.Routes = result.Routes[:maxRoutes]
+	}
+}
+
+// capResult020 is capResult030 for a 0.2.0 result, which holds at most
+// two addresses, so only the routes are capped. r is not modified.
+func capResult020(conf NetConf, r *types.Result) *types.Result {
+	_, maxRoutes := conf.resultCaps()
+	capped := *r
+	for _, ipc := range []**types.IPConfig{&capped.IP4, &capped.IP6} {
+		if *ipc == nil {
+			continue
+		}
+		if len((*ipc).Routes) > maxRoutes {
+			log.Warnf("rancher-calico-ipam: result has %d routes, keeping the first %d", len((*ipc).Routes), maxRoutes)
+			c := **ipc
+			c.Routes = c.Routes[:maxRoutes]
+			*ipc = &c
+		}
+		maxRoutes -= len((*ipc).Routes)
+	}
+	return &capped
+}
+
+// addOnLinkRoutes adds a route without gateway to the subnet of each
+// address in r, so that traffic to the subnet stays on the interface.
+func addOnLinkRoutes(r *types.Result) {
+	for _, ipc := range []*types.IPConfig{r.IP4, r.IP6} {
+		if ipc == nil {
+			continue
+		}
+		subnet := net.IPNet{IP: ipc.IP.IP.Mask(ipc.IP.Mask), Mask: ipc.IP.Mask}
+		ipc.Routes = append(ipc.Routes, types.Route{Dst: subnet})
+	}
+}
+
+// addUsableRangeRoutes adds on-link routes covering the usable addresses
+// of the subnet of each address in r whose prefix is known, that is
+// shorter than a host route. For IPv4 the network and broadcast addresses
+// are left out, which takes several routes; /31 and /32 subnets have no
+// such addresses to spare and get none. IPv6 has no broadcast, so its
+// subnet is routed as a whole.
+func addUsableRangeRoutes(r *types.Result) {
+	for _, ipc := range []*types.IPConfig{r.IP4, r.IP6} {
+		if ipc == nil {
+			continue
+		}
+		ones, bits := ipc.IP.Mask.Size()
+		if ones >= bits {
+			continue
+		}
+		network := ipc.IP.IP.Mask(ipc.IP.Mask)
+		if bits != 32 {
+			ipc.Routes = append(ipc.Routes, types.Route{Dst: net.IPNet{IP: network, Mask: ipc.IP.Mask}})
+			continue
+		}
+		if ones > 30 {
+			continue
+		}
+		first := binary.BigEndian.Uint32(network.To4()) + 1
+		last := first + uint32(1)<<uint(32-ones) - 3
+		for _, dst := range rangeCIDRs(first, last) {
+			ipc.Routes = append(ipc.Routes, types.Route{Dst: dst})
+		}
+	}
+}
+
+// rangeCIDRs returns the fewest IPv4 CIDRs exactly covering the addresses
+// first to last.
+func rangeCIDRs(first, last uint32) []net.IPNet {
+	var cidrs []net.IPNet
+	for start := uint64(first); start <= uint64(last); {
+		size := uint(0)
+		// Grow the block while it stays aligned and within the range.
+		for size < 32 && start%(uint64(1)<<(size+1)) == 0 && start+(uint64(1)<<(size+1))-1 <= uint64(last) {
+			size++
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(start))
+		cidrs = append(cidrs, net.IPNet{IP: ip, Mask: net.CIDRMask(32-int(size), 32)})
+		start += uint64(1) << size
+	}
+	return cidrs
+}
+
+// convertResult030 builds a 0.3.x result from r. The IPAM address is
+// attributed to args.IfName inside the container sandbox.
+func convertResult030(cniVersion string, args *skel.CmdArgs, r *types.Result) *result030 {
+	result := &result030{
+		CNIVersion: cniVersion,
+		Interfaces: []*interface03{{Name: args.IfName, Sandbox: args.Netns}},
+		DNS:        r.DNS,
+	}
+	index := 0
+	for _, ipc := range []struct {
+		version string
+		config  *types.IPConfig
+	}{{"4", r.IP4}, {"6", r.IP6}} {
+		if ipc.config == nil {
+			continue
+		}
+		result.IPs = append(result.IPs, &ipConfig03{
+			Version:   ipc.version,
+			Interface: &index,
+			Address:   types.IPNet(ipc.config.IP),
+			Gateway:   ipc.config.Gateway,
+		})
+		result.Routes = append(result.Routes, ipc.config.Routes...)
+	}
+	return result
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// captureResults makes printResult collect the results of the test in
+// memory rather than print them, until the returned function is called.
+// Results may be printed concurrently, as by ADDs serialized only by the
+// file lock, which the race detector cannot see.
+func captureResults() (*[]interface{}, func()) {
+	var mu sync.Mutex
+	var results []interface{}
+	saved := printResult
+	printResult = func(result interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, result)
+		return nil
+	}
+	return &results, func() { printResult = saved }
+}
+
+// testResult returns a 0.2.0 result holding ip with a host prefix.
+func testResult(ip string) *types.Result {
+	return &types.Result{IP4: &types.IPConfig{IP: net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)}}}
+}
+
+func rawJSON(s string) *json.RawMessage {
+	raw := json.RawMessage(s)
+	return &raw
+}
+
+func TestEmitResult(t *testing.T) {
+	args := &skel.CmdArgs{ContainerID: "ctr", Netns: "/var/run/netns/ctr", IfName: "eth0"}
+	source := &ipSource{MetadataURL: "http://169.254.169.250/2015-12-19"}
+	tests := []struct {
+		name   string
+		conf   NetConf
+		source *ipSource
+		check  func(t *testing.T, result interface{})
+	}{
+		{
+			name: "0.2.0",
+			conf: NetConf{CNIVersion: "0.2.0"},
+			check: func(t *testing.T, result interface{}) {
+				r, ok := result.(*types.Result)
+				if !ok || r.IP4 == nil || r.IP4.IP.String() != "10.42.0.5/32" {
+					t.Errorf("result = %#v, want IP4 10.42.0.5/32", result)
+				}
+			},
+		},
+		{
+			name:   "0.2.0 with source",
+			conf:   NetConf{CNIVersion: "0.2.0"},
+			source: source,
+			check: func(t *testing.T, result interface{}) {
+				r, ok := result.(*result020)
+				if !ok || r.Source != source || r.IP4.IP.String() != "10.42.0.5/32" {
+					t.Errorf("result = %#v, want IP4 10.42.0.5/32 with source", result)
+				}
+			},
+		},
+		{
+			name:   "0.3.0",
+			conf:   NetConf{CNIVersion: "0.3.0"},
+			source: source,
+			check: func(t *testing.T, result interface{}) {
+				r, ok := result.(*result030)
+				if !ok || len(r.IPs) != 1 || len(r.Interfaces) != 1 {
+					t.Fatalf("result = %#v, want one address on one interface", result)
+				}
+				if ip := r.IPs[0]; ip.Version != "4" || *ip.Interface != 0 || ip.Address.IP.String() != "10.42.0.5" {
+					t.Errorf("address = %#v, want 10.42.0.5 on interface 0", ip)
+				}
+				if iface := r.Interfaces[0]; iface.Name != "eth0" || iface.Sandbox != args.Netns {
+					t.Errorf("interface = %#v, want eth0 in %s", iface, args.Netns)
+				}
+				if r.Source != source {
+					t.Errorf("source = %v, want %v", r.Source, source)
+				}
+			},
+		},
+		{
+			name: "0.3.0 chained",
+			conf: NetConf{CNIVersion: "0.3.0", PrevResult: rawJSON(`{
+				"cniVersion": "0.3.0",
+				"interfaces": [{"name": "cali0"}, {"name": "eth0", "sandbox": "/var/run/netns/ctr"}],
+				"ips": [{"version": "6", "interface": 1, "address": "fd00::5/128"}]
+			}`)},
+			check: func(t *testing.T, result interface{}) {
+				r := result.(*result030)
+				if len(r.Interfaces) != 2 || len(r.IPs) != 2 {
+					t.Fatalf("result = %#v, want the upstream interfaces and both addresses", r)
+				}
+				if ip := r.IPs[1]; ip.Address.IP.String() != "10.42.0.5" || *ip.Interface != 1 {
+					t.Errorf("address = %#v, want 10.42.0.5 on the upstream eth0", ip)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		results, restore := captureResults()
+		err := emitResult(tt.conf, args, testResult("10.42.0.5"), tt.source)
+		restore()
+		if err != nil {
+			t.Errorf("%s: emitResult() error = %v", tt.name, err)
+			continue
+		}
+		if len(*results) != 1 {
+			t.Errorf("%s: %d results printed, want 1", tt.name, len(*results))
+			continue
+		}
+		t.Run(tt.name, func(t *testing.T) { tt.check(t, (*results)[0]) })
+	}
+}
+
+func TestResultSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "result-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listening := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", listening)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadBytes('\n')
+		lines <- line
+	}()
+
+	args := &skel.CmdArgs{ContainerID: "ctr", Netns: "/var/run/netns/ctr", IfName: "eth0"}
+	tests := []struct {
+		name     string
+		socket   string
+		wantSent bool
+	}{
+		{name: "listening agent", socket: listening, wantSent: true},
+		{name: "no agent", socket: filepath.Join(dir, "none.sock")},
+	}
+	for _, tt := range tests {
+		results, restore := captureResults()
+		err := emitResult(NetConf{ResultSocket: tt.socket}, args, testResult("10.42.0.5"), nil)
+		restore()
+		if err != nil {
+			t.Errorf("%s: emitResult() error = %v", tt.name, err)
+			continue
+		}
+		if len(*results) != 1 {
+			t.Errorf("%s: %d results printed, want 1", tt.name, len(*results))
+			continue
+		}
+		if !tt.wantSent {
+			continue
+		}
+		printed, err := json.Marshal((*results)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg struct {
+			ContainerID string          `json:"containerID"`
+			Netns       string          `json:"netns"`
+			IfName      string          `json:"ifName"`
+			Result      json.RawMessage `json:"result"`
+		}
+		if err := json.Unmarshal(<-lines, &msg); err != nil {
+			t.Errorf("%s: cannot decode the message: %v", tt.name, err)
+			continue
+		}
+		if msg.ContainerID != "ctr" || msg.Netns != args.Netns || msg.IfName != "eth0" {
+			t.Errorf("%s: message for %s %s %s, want %s %s %s", tt.name, msg.ContainerID, msg.Netns, msg.IfName, args.ContainerID, args.Netns, args.IfName)
+		}
+		if string(msg.Result) != string(printed) {
+			t.Errorf("%s: sent result %s, printed %s", tt.name, msg.Result, printed)
+		}
+	}
+}
+
+// testRoutes returns n distinct host routes.
+func testRoutes(n int) []types.Route {
+	routes := make([]types.Route, n)
+	for i := range routes {
+		routes[i].Dst = net.IPNet{IP: net.IPv4(10, 43, 0, byte(i)).To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	return routes
+}
+
+func TestCapResult030(t *testing.T) {
+	tests := []struct {
+		name       string
+		conf       NetConf
+		ips        int
+		routes     int
+		wantIPs    int
+		wantRoutes int
+	}{
+		{name: "under the defaults", ips: 2, routes: 3, wantIPs: 2, wantRoutes: 3},
+		{name: "over the defaults", ips: 20, routes: 70, wantIPs: defaultMaxResultIPs, wantRoutes: defaultMaxResultRoutes},
+		{name: "configured caps", conf: NetConf{MaxResultIPs: 1, MaxResultRoutes: 2}, ips: 3, routes: 3, wantIPs: 1, wantRoutes: 2},
+		{name: "at the caps", conf: NetConf{MaxResultIPs: 3, MaxResultRoutes: 3}, ips: 3, routes: 3, wantIPs: 3, wantRoutes: 3},
+	}
+	for _, tt := range tests {
+		result := &result030{IPs: make([]*ipConfig03, tt.ips), Routes: testRoutes(tt.routes)}
+		capResult030(tt.conf, result)
+		if len(result.IPs) != tt.wantIPs || len(result.Routes) != tt.wantRoutes {
+			t.Errorf("%s: %d addresses and %d routes, want %d and %d", tt.name, len(result.IPs), len(result.Routes), tt.wantIPs, tt.wantRoutes)
+		}
+	}
+}
+
+func TestCapResult020(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRoutes    int
+		routes4      int
+		routes6      int
+		want4, want6 int
+	}{
+		{name: "under the cap", maxRoutes: 4, routes4: 2, routes6: 2, want4: 2, want6: 2},
+		{name: "IPv4 over the cap", maxRoutes: 2, routes4: 3, routes6: 1, want4: 2, want6: 0},
+		{name: "shared cap", maxRoutes: 3, routes4: 2, routes6: 2, want4: 2, want6: 1},
+	}
+	for _, tt := range tests {
+		r := &types.Result{
+			IP4: &types.IPConfig{Routes: testRoutes(tt.routes4)},
+			IP6: &types.IPConfig{Routes: testRoutes(tt.routes6)},
+		}
+		capped := capResult020(NetConf{MaxResultRoutes: tt.maxRoutes}, r)
+		if len(capped.IP4.Routes) != tt.want4 || len(capped.IP6.Routes) != tt.want6 {
+			t.Errorf("%s: %d and %d routes, want %d and %d", tt.name, len(capped.IP4.Routes), len(capped.IP6.Routes), tt.want4, tt.want6)
+		}
+		if len(r.IP4.Routes) != tt.routes4 || len(r.IP6.Routes) != tt.routes6 {
+			t.Errorf("%s: capResult020 modified its argument", tt.name)
+		}
+	}
+}
+
+// routeDsts returns the destinations of the routes of each address in r.
+func routeDsts(r *types.Result) []string {
+	var dsts []string
+	for _, ipc := range []*types.IPConfig{r.IP4, r.IP6} {
+		if ipc == nil {
+			continue
+		}
+		for _, route := range ipc.Routes {
+			dsts = append(dsts, route.Dst.String())
+		}
+	}
+	return dsts
+}
+
+func TestAddOnLinkRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		ip4  string
+		ip6  string
+		want []string
+	}{
+		{name: "IPv4", ip4: "10.42.0.5/16", want: []string{"10.42.0.0/16"}},
+		{name: "IPv6", ip6: "fd00::5/64", want: []string{"fd00::/64"}},
+		{name: "dual stack", ip4: "10.42.0.5/24", ip6: "fd00::5/64", want: []string{"10.42.0.0/24", "fd00::/64"}},
+		{name: "host prefix", ip4: "10.42.0.5/32", want: []string{"10.42.0.5/32"}},
+	}
+	for _, tt := range tests {
+		r := &types.Result{}
+		if tt.ip4 != "" {
+			ip, subnet, _ := net.ParseCIDR(tt.ip4)
+			r.IP4 = &types.IPConfig{IP: net.IPNet{IP: ip.To4(), Mask: subnet.Mask}}
+		}
+		if tt.ip6 != "" {
+			ip, subnet, _ := net.ParseCIDR(tt.ip6)
+			r.IP6 = &types.IPConfig{IP: net.IPNet{IP: ip, Mask: subnet.Mask}}
+		}
+		addOnLinkRoutes(r)
+		if got := routeDsts(r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: routes to %v, want %v", tt.name, got, tt.want)
+		}
+		for _, ipc := range []*types.IPConfig{r.IP4, r.IP6} {
+			if ipc != nil && ipc.Routes[0].GW != nil {
+				t.Errorf("%s: on-link route has gateway %s", tt.name, ipc.Routes[0].GW)
+			}
+		}
+	}
+}
+
+func TestAddUsableRangeRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want []string
+	}{
+		{name: "/24", ip: "10.42.0.5/24", want: []string{
+			"10.42.0.1/32", "10.42.0.2/31", "10.42.0.4/30", "10.42.0.8/29", "10.42.0.16/28",
+			"10.42.0.32/27", "10.42.0.64/26", "10.42.0.128/26", "10.42.0.192/27", "10.42.0.224/28",
+			"10.42.0.240/29", "10.42.0.248/30", "10.42.0.252/31", "10.42.0.254/32",
+		}},
+		{name: "/28", ip: "10.42.0.37/28", want: []string{
+			"10.42.0.33/32", "10.42.0.34/31", "10.42.0.36/30", "10.42.0.40/30", "10.42.0.44/31", "10.42.0.46/32",
+		}},
+		{name: "/30", ip: "10.42.0.5/30", want: []string{"10.42.0.5/32", "10.42.0.6/32"}},
+		{name: "/31", ip: "10.42.0.5/31"},
+		{name: "host prefix", ip: "10.42.0.5/32"},
+		{name: "IPv6", ip: "fd00::5/64", want: []string{"fd00::/64"}},
+	}
+	for _, tt := range tests {
+		ip, subnet, _ := net.ParseCIDR(tt.ip)
+		r := &types.Result{}
+		if ip.To4() != nil {
+			r.IP4 = &types.IPConfig{IP: net.IPNet{IP: ip.To4(), Mask: subnet.Mask}}
+		} else {
+			r.IP6 = &types.IPConfig{IP: net.IPNet{IP: ip, Mask: subnet.Mask}}
+		}
+		addUsableRangeRoutes(r)
+		if got := routeDsts(r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: routes to %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	tests := []struct {
+		name       string
+		ip         string
+		netconf    string
+		wantErr    bool
+		want4      string
+		want6      string
+		wantAssign int
+	}{
+		{name: "IPv6 from prevResult", ip: "10.42.0.5", netconf: `"partialResults": true, "prevResult": {"ip6": {"ip": "fd00::9/64"}}`,
+			want4: "10.42.0.5/32", want6: "fd00::9/64", wantAssign: 1},
+		{name: "IPv4 from prevResult", ip: "fd00::5", netconf: `"partialResults": true, "prevResult": {"ip4": {"ip": "10.42.0.9/24"}}`,
+			want4: "10.42.0.9/24", want6: "fd00::5/128", wantAssign: 1},
+		{name: "prevResult of the same family", ip: "10.42.0.5", netconf: `"partialResults": true, "prevResult": {"ip4": {"ip": "10.42.0.9/24"}}`, wantErr: true},
+		{name: "no prevResult", ip: "10.42.0.5", netconf: `"partialResults": true`, wantErr: true},
+		{name: "not partial", ip: "10.42.0.5", netconf: `"prevResult": {"ip6": {"ip": "fd00::9/64"}}`, wantErr: true},
+		{name: "both families", ip: "10.42.0.5,fd00::5", netconf: `"partialResults": true`, want4: "10.42.0.5/32", want6: "fd00::5/128", wantAssign: 2},
+	}
+	for _, tt := range tests {
+		_, ts := newFakeMetadata(metadataContainer("ctr-1", "uuid-1", tt.ip))
+		ipam := &fakeIPAM{}
+		restore := useFakeCalico(&fakeCalico{ipam: ipam, pools: &fakePools{cidrs: []string{"10.42.0.0/16", "fd00::/64"}}})
+		results, err := runAdd(ts.URL, `"ipFamilyPreference": "dual", `+tt.netconf, nil)
+		restore()
+		ts.Close()
+		if tt.wantErr {
+			if err == nil || len(ipam.handles) != 0 {
+				t.Errorf("%s: cmdAdd() error = %v, assigned %v, want an error", tt.name, err, ipam.handles)
+			}
+			continue
+		}
+		if err != nil || len(results) != 1 {
+			t.Errorf("%s: cmdAdd() = %v, %v, want one result", tt.name, results, err)
+			continue
+		}
+		r := results[0].(*result020)
+		if r.IP4 == nil || r.IP6 == nil || r.IP4.IP.String() != tt.want4 || r.IP6.IP.String() != tt.want6 {
+			t.Errorf("%s: result %+v %+v, want %s and %s", tt.name, r.IP4, r.IP6, tt.want4, tt.want6)
+		}
+		if n := len(ipam.handles["ctr-1"]); n != tt.wantAssign {
+			t.Errorf("%s: assigned %d addresses, want %d", tt.name, n, tt.wantAssign)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/projectcalico/calico-cni/utils"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+// addRetryDelay is the wait before the first retry of a failed ADD; it
+// doubles with every further retry.
+const addRetryDelay = time.Second
+
+// cmdAddWithRetry runs cmdAdd, retrying it up to addRetries times with
+// backoff while it fails with a transient error.
+func cmdAddWithRetry(conf NetConf, args *skel.CmdArgs) error {
+	return retryAdd(conf, args, cmdAdd, releaseAttempt)
+}
+
+// retryAdd runs add as cmdAddWithRetry does. A failed attempt may have
+// assigned addresses before failing, as AutoAssign can, so release frees
+// them by handle before the next attempt; if that fails the ADD fails
+// rather than risk leaking them.
+func retryAdd(conf NetConf, args *skel.CmdArgs, add, release func(NetConf, *skel.CmdArgs) error) error {
+	delay := addRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := add(conf, args)
+		if err == nil || attempt > conf.AddRetries || !isTransient(err) {
+			return err
+		}
+		if rerr := release(conf, args); rerr != nil {
+			log.Warnf("rancher-calico-ipam: ADD failed and its addresses cannot be released, not retrying: %v", rerr)
+			return err
+		}
+		log.Warnf("rancher-calico-ipam: ADD failed, retrying in %v (%d/%d): %v", delay, attempt, conf.AddRetries, err)
+		clock.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// releaseAttempt releases the addresses assigned to the container of args
+// by a failed ADD attempt.
+func releaseAttempt(conf NetConf, args *skel.CmdArgs) error {
+	calicoClient, err := utils.CreateClient(conf.NetConf)
+	if err != nil {
+		return err
+	}
+	workloadID, _, err := utils.GetIdentifiers(args)
+	if err != nil {
+		return err
+	}
+	return releaseWorkload(calicoClient.IPAM(), workloadID, releaseReasonRetry, utils.CreateContextLogger(workloadID))
+}
+
+// isTransient reports whether an ADD that failed with err may succeed if
+// run again: the Calico datastore was unavailable or raced, or a metadata
+// lookup failed with the CNI "try again later" code.
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case errors.ErrorDatastoreError, errors.ErrorResourceUpdateConflict:
+		return true
+	case *types.Error:
+		return e.Code == errCodeTryAgainLater
+	}
+	return false
+}
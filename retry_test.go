@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+func TestRetryAdd(t *testing.T) {
+	blip := errors.ErrorDatastoreError{Err: fmt.Errorf("etcd unavailable")}
+	tests := []struct {
+		name         string
+		retries      int
+		errs         []error
+		releaseErr   error
+		wantErr      bool
+		wantAdds     int
+		wantReleases int
+		wantSleeps   []time.Duration
+	}{
+		{
+			name:         "fails twice, then succeeds",
+			retries:      3,
+			errs:         []error{blip, &types.Error{Code: errCodeTryAgainLater}, nil},
+			wantAdds:     3,
+			wantReleases: 2,
+			wantSleeps:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:         "retries exhausted",
+			retries:      1,
+			errs:         []error{blip, blip},
+			wantErr:      true,
+			wantAdds:     2,
+			wantReleases: 1,
+			wantSleeps:   []time.Duration{time.Second},
+		},
+		{
+			name:     "not transient",
+			retries:  3,
+			errs:     []error{fmt.Errorf("invalid netconf")},
+			wantErr:  true,
+			wantAdds: 1,
+		},
+		{
+			name:         "release fails",
+			retries:      3,
+			errs:         []error{blip, nil},
+			releaseErr:   blip,
+			wantErr:      true,
+			wantAdds:     1,
+			wantReleases: 1,
+		},
+	}
+	for _, tt := range tests {
+		fake, restore := useFakeClock()
+		adds, releases := 0, 0
+		add := func(NetConf, *skel.CmdArgs) error {
+			err := tt.errs[adds]
+			adds++
+			return err
+		}
+		release := func(NetConf, *skel.CmdArgs) error {
+			releases++
+			return tt.releaseErr
+		}
+		err := retryAdd(NetConf{AddRetries: tt.retries}, &skel.CmdArgs{ContainerID: "ctr"}, add, release)
+		restore()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: retryAdd() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if adds != tt.wantAdds || releases != tt.wantReleases {
+			t.Errorf("%s: %d attempts and %d releases, want %d and %d", tt.name, adds, releases, tt.wantAdds, tt.wantReleases)
+		}
+		if sleeps := fake.Sleeps(); !reflect.DeepEqual(sleeps, tt.wantSleeps) {
+			t.Errorf("%s: backoff = %v, want %v", tt.name, sleeps, tt.wantSleeps)
+		}
+	}
+}
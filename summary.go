@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// summaryMarker starts the summary line on stderr, so that wrappers can
+// grep for it whatever else was logged.
+const summaryMarker = "rancher-calico-ipam-summary:"
+
+// summaryOutput receives the summary lines, stderr outside tests.
+var summaryOutput io.Writer = os.Stderr
+
+// summary describes the outcome of one CNI command.
+type summary struct {
+	Command     string   `json:"command"`
+	ContainerID string   `json:"containerID"`
+	Outcome     string   `json:"outcome"`
+	IPs         []string `json:"ips,omitempty"`
+	Duration    string   `json:"duration"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// resultIPs holds the addresses of the result emitted by the current
+// command, for its summary.
+var resultIPs []string
+
+// withSummary wraps cmd to write a summary line to stderr once it has
+// finished. The command is also traced, if tracing is configured.
+func withSummary(command string, cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		start := time.Now()
+		resultIPs = nil
+		commandTracer = newTracer()
+		commandSpan = commandTracer.start(command, nil)
+		commandSpan.set("cni.container_id", args.ContainerID)
+		err := cmd(args)
+		commandSpan.set("cni.ips", strings.Join(resultIPs, ","))
+		commandSpan.end(err)
+		commandTracer.export()
+		s := summary{
+			Command:     command,
+			ContainerID: args.ContainerID,
+			Outcome:     "success",
+			IPs:         resultIPs,
+			Duration:    time.Since(start).String(),
+		}
+		if err != nil {
+			s.Outcome = "failure"
+			s.Error = err.Error()
+		}
+		if data, jsonErr := json.Marshal(s); jsonErr == nil {
+			fmt.Fprintf(summaryOutput, "%s %s\n", summaryMarker, data)
+		}
+		return err
+	}
+}
+
+// recordResultIPs keeps the addresses of r for the summary.
+func recordResultIPs(r *types.Result) {
+	if r.IP4 != nil {
+		resultIPs = append(resultIPs, r.IP4.IP.String())
+	}
+	if r.IP6 != nil {
+		resultIPs = append(resultIPs, r.IP6.IP.String())
+	}
+}
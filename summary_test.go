@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestWithSummary(t *testing.T) {
+	ip4 := &types.IPConfig{IP: net.IPNet{IP: net.ParseIP("10.42.0.5").To4(), Mask: net.CIDRMask(32, 32)}}
+	tests := []struct {
+		name    string
+		cmd     func(*skel.CmdArgs) error
+		want    summary
+		wantErr bool
+	}{
+		{
+			name: "success",
+			cmd: func(*skel.CmdArgs) error {
+				recordResultIPs(&types.Result{IP4: ip4})
+				return nil
+			},
+			want: summary{Command: "ADD", ContainerID: "ctr", Outcome: "success", IPs: []string{"10.42.0.5/32"}},
+		},
+		{
+			name:    "failure",
+			cmd:     func(*skel.CmdArgs) error { return fmt.Errorf("no IP") },
+			want:    summary{Command: "ADD", ContainerID: "ctr", Outcome: "failure", Error: "no IP"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		saved := summaryOutput
+		summaryOutput = &buf
+		err := withSummary("ADD", tt.cmd)(&skel.CmdArgs{ContainerID: "ctr"})
+		summaryOutput = saved
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+
+		line := buf.String()
+		if !strings.HasPrefix(line, summaryMarker+" ") || strings.Count(line, "\n") != 1 {
+			t.Errorf("%s: summary line %q", tt.name, line)
+			continue
+		}
+		var got summary
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, summaryMarker)), &got); err != nil {
+			t.Errorf("%s: summary %q: %v", tt.name, line, err)
+			continue
+		}
+		if got.Duration == "" {
+			t.Errorf("%s: summary has no duration", tt.name)
+		}
+		got.Duration = ""
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: summary = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
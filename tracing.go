@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The standard OpenTelemetry variables locating an OTLP/HTTP collector.
+// Tracing is off unless one of them is set.
+const (
+	otlpEndpointEnv       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otlpTracesEndpointEnv = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+)
+
+// traceExportTimeout bounds how long the plugin waits on the collector
+// before exiting. It is kept well below the latency of a command, so a
+// slow collector loses the trace rather than delaying the runtime.
+const traceExportTimeout = 100 * time.Millisecond
+
+// traceClient posts the traces, giving up after traceExportTimeout.
+var traceClient = &http.Client{Timeout: traceExportTimeout}
+
+// tracer collects the spans of one command and exports them as
+// OTLP/HTTP JSON. A nil *tracer, as when tracing is off, records and
+// exports nothing, and so do the spans it hands out.
+type tracer struct {
+	endpoint string
+	traceID  string
+	spans    []otlpSpan
+}
+
+// span is an open span of a tracer.
+type span struct {
+	t      *tracer
+	data   otlpSpan
+	parent *span
+}
+
+// commandTracer traces the running command, and commandSpan is its root
+// span. Both are nil when tracing is off.
+var (
+	commandTracer *tracer
+	commandSpan   *span
+)
+
+// newTracer returns a tracer for the collector named in the environment,
+// or nil if none is.
+func newTracer() *tracer {
+	endpoint := os.Getenv(otlpTracesEndpointEnv)
+	if endpoint == "" {
+		if base := os.Getenv(otlpEndpointEnv); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+	return &tracer{endpoint: endpoint, traceID: randomID(16)}
+}
+
+// start opens a span named name under parent, or a root span if parent is
+// nil.
+func (t *tracer) start(name string, parent *span) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{t: t, parent: parent, data: otlpSpan{
+		TraceID:           t.traceID,
+		SpanID:            randomID(8),
+		Name:              name,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+	}}
+	if parent != nil {
+		s.data.ParentSpanID = parent.data.SpanID
+	}
+	return s
+}
+
+// child opens a span under s.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	return s.t.start(name, s)
+}
+
+// set adds an attribute to s.
+func (s *span) set(key, value string) {
+	if s == nil {
+		return
+	}
+	s.data.Attributes = append(s.data.Attributes, otlpAttribute{key, otlpValue{value}})
+}
+
+// end closes s, marking it failed if err is set.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.data.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err != nil {
+		s.data.Status = &otlpStatus{Code: 2, Message: err.Error()}
+	}
+	s.t.spans = append(s.t.spans, s.data)
+}
+
+// export sends the ended spans to the collector, waiting at most
+// traceExportTimeout. The export is abandoned, not retried, past it.
+// Failures are logged at debug level only, as tracing
+// must never fail a command.
+func (t *tracer) export() {
+	if t == nil || len(t.spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{{"service.name", otlpValue{"rancher-calico-ipam"}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "rancher-calico-ipam"},
+			Spans: t.spans,
+		}},
+	}}})
+	if err != nil {
+		log.Debugf("rancher-calico-ipam: cannot encode trace: %v", err)
+		return
+	}
+	resp, err := traceClient.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Debugf("rancher-calico-ipam: cannot export trace to %s: %v", t.endpoint, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// randomID returns n random bytes, hex encoded, as OTLP ids are.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The subset of the OTLP/HTTP JSON trace encoding the tracer emits.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
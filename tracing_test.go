@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// setTraceEndpoint sets the OTLP traces endpoint until the returned
+// function is called.
+func setTraceEndpoint(endpoint string) func() {
+	saved, had := os.LookupEnv(otlpTracesEndpointEnv)
+	os.Setenv(otlpTracesEndpointEnv, endpoint)
+	return func() {
+		if had {
+			os.Setenv(otlpTracesEndpointEnv, saved)
+		} else {
+			os.Unsetenv(otlpTracesEndpointEnv)
+		}
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	defer setTraceEndpoint("")()
+	tr := newTracer()
+	if tr != nil {
+		t.Fatalf("newTracer() = %v without an endpoint, want nil", tr)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		root := tr.start("ADD", nil)
+		root.set("cni.container_id", "ctr")
+		root.child("lookup").end(nil)
+		root.end(nil)
+		tr.export()
+	})
+	if allocs != 0 {
+		t.Errorf("tracing off allocates %v times per command, want 0", allocs)
+	}
+}
+
+func TestTraceExport(t *testing.T) {
+	tests := []struct {
+		name      string
+		slow      bool
+		wantSpans int
+	}{
+		{name: "collector", wantSpans: 2},
+		{name: "slow collector", slow: true},
+	}
+	for _, tt := range tests {
+		hold := make(chan struct{})
+		var got otlpRequest
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.slow {
+				<-hold
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&got)
+		}))
+		restore := setTraceEndpoint(ts.URL + "/v1/traces")
+
+		tr := newTracer()
+		root := tr.start("ADD", nil)
+		root.child("lookup").end(nil)
+		root.end(nil)
+		start := time.Now()
+		tr.export()
+		elapsed := time.Since(start)
+
+		restore()
+		close(hold)
+		ts.Close()
+		if elapsed > 10*traceExportTimeout {
+			t.Errorf("%s: export took %v, want about %v at most", tt.name, elapsed, traceExportTimeout)
+		}
+		spans := 0
+		for _, rs := range got.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans += len(ss.Spans)
+			}
+		}
+		if spans != tt.wantSpans {
+			t.Errorf("%s: collector got %d spans, want %d", tt.name, spans, tt.wantSpans)
+		}
+	}
+}
@@ -3,25 +3,278 @@ package main
 import (
 	"fmt"
 	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+	"github.com/rancher/rancher-cni-ipam/ipfinder/api"
 	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
 )
 
-func setIpByRancher(args *skel.CmdArgs, ipamArgs *ipamArgs) error {
-	ipf, err := metadata.NewIPFinderFromMetadata()
-	if err != nil {
+// checkArgConflict handles CNI_ARGS carrying both an explicit IP and a
+// RancherContainerUUID. The explicit IP wins and a warning is logged,
+// unless strictArgs is set in which case the ADD is rejected.
+func checkArgConflict(conf NetConf, ipamArgs *ipamArgs, logger *logrus.Entry) error {
+	if ipamArgs.IP == nil || ipamArgs.RancherContainerUUID == "" {
+		return nil
+	}
+	if conf.StrictArgs {
+		return fmt.Errorf("CNI_ARGS sets both IP and RancherContainerUUID")
+	}
+	logger.Warnf("CNI_ARGS sets both IP and RancherContainerUUID, using IP %v", ipamArgs.IP)
+	return nil
+}
+
+// podArgPattern is the DNS-1123 subdomain format of Kubernetes pod names
+// and namespaces.
+var podArgPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// validatePodArgs rejects malformed K8S_POD_NAME and K8S_POD_NAMESPACE
+// values, and a namespace without a pod name.
+func validatePodArgs(ipamArgs *ipamArgs) error {
+	name, namespace := string(ipamArgs.K8S_POD_NAME), string(ipamArgs.K8S_POD_NAMESPACE)
+	if name == "" && namespace != "" {
+		return fmt.Errorf("CNI_ARGS sets K8S_POD_NAMESPACE without K8S_POD_NAME")
+	}
+	if name != "" && !podArgPattern.MatchString(name) {
+		return fmt.Errorf("invalid K8S_POD_NAME %q", name)
+	}
+	if namespace != "" && !podArgPattern.MatchString(namespace) {
+		return fmt.Errorf("invalid K8S_POD_NAMESPACE %q", namespace)
+	}
+	return nil
+}
+
+// canonicalArgKeys rewrites the keys of a CNI_ARGS string to the case of
+// the matching field of the struct container points to. Some runtimes
+// change the case of keys, while types.LoadArgs matches them exactly.
+// Unknown keys are left as they are. Empty pairs, as left by a trailing
+// ";", are dropped, so that blank CNI_ARGS parse as no arguments.
+func canonicalArgKeys(args string, container interface{}) string {
+	names := map[string]string{}
+	collectArgNames(reflect.TypeOf(container).Elem(), names)
+	var pairs []string
+	for _, pair := range strings.Split(args, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if name, ok := names[strings.ToLower(kv[0])]; ok {
+			kv[0] = name
+			pair = strings.Join(kv, "=")
+		}
+		pairs = append(pairs, pair)
+	}
+	return strings.Join(pairs, ";")
+}
+
+// loadIPAMArgs parses CNI_ARGS, or conf.DefaultArgs when the runtime
+// passed none. Without either, ipamArgs stays empty and the container is
+// resolved by its container id alone.
+func loadIPAMArgs(conf NetConf, args *skel.CmdArgs, ipamArgs *ipamArgs) error {
+	cniArgs := canonicalArgKeys(args.Args, ipamArgs)
+	if cniArgs == "" {
+		cniArgs = canonicalArgKeys(conf.DefaultArgs, ipamArgs)
+		if cniArgs == "" {
+			logrus.Debugf("rancher-calico-ipam: no CNI_ARGS, resolving container %s by its id", args.ContainerID)
+		}
+	}
+	return types.LoadArgs(cniArgs, ipamArgs)
+}
+
+// collectArgNames maps the lower-cased field names of t, including those
+// promoted from embedded structs, to the names themselves.
+func collectArgNames(t reflect.Type, names map[string]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			collectArgNames(field.Type, names)
+			continue
+		}
+		names[strings.ToLower(field.Name)] = field.Name
+	}
+}
+
+// CNI error codes reported for failed metadata lookups. Codes from 100
+// are plugin specific, and 100 itself is the generic plugin error.
+const (
+	errCodeUnknownContainer = 3
+	errCodeTryAgainLater    = 11
+	errCodeHostNetwork      = 101
+	errCodeForeignHost      = 102
+)
+
+// cniError maps an ipfinder error to a CNI error with a matching code:
+// an unreachable metadata service or a pending IP may resolve on retry,
+// an unknown, host-networked or foreign container will not.
+func cniError(err error) error {
+	e, ok := err.(*ipfinder.Error)
+	if !ok {
 		return err
 	}
-	ipString := ipf.GetIP(args.ContainerID, string(ipamArgs.RancherContainerUUID))
-	if len(ipString) > 0 {
-		logrus.Debugf("rancher-calico-ipam: %s", fmt.Sprintf("ip: %#v", ipString))
-		ip, _, err := net.ParseCIDR(ipString + "/32")
+	code := uint(errCodeTryAgainLater)
+	switch e.Kind {
+	case ipfinder.ErrContainerNotFound:
+		code = errCodeUnknownContainer
+	case ipfinder.ErrHostNetwork:
+		code = errCodeHostNetwork
+	case ipfinder.ErrForeignHost:
+		code = errCodeForeignHost
+	}
+	return &types.Error{Code: code, Msg: e.Error()}
+}
+
+// failedWith reports whether err is an ipfinder error of the given kind.
+func failedWith(err, kind error) bool {
+	e, ok := err.(*ipfinder.Error)
+	return ok && e.Kind == kind
+}
+
+// readyFileEnv names the file touched once metadata is reachable, so
+// that readiness probes can check for its existence.
+const readyFileEnv = "CNI_READY_FILE"
+
+// setIpByRancher looks the container up in Rancher metadata and stores its
+// IP in ipamArgs. On success it also reports where the IP came from and
+// returns the resolved addresses: the same IP, with the prefix length
+// from prefixField if configured, and under ipFamilyPreference dual the
+// address of the other family.
+func setIpByRancher(args *skel.CmdArgs, conf NetConf, ipamArgs *ipamArgs) (*ipSource, []net.IPNet, error) {
+	start := time.Now()
+	config := conf.finderConfig()
+	config.PodName = string(ipamArgs.K8S_POD_NAME)
+	config.PodNamespace = string(ipamArgs.K8S_POD_NAMESPACE)
+	if conf.NetnsInodeLabel != "" {
+		if inode, err := netnsInode(args.Netns); err == nil {
+			config.NetnsInode = strconv.FormatUint(inode, 10)
+			config.NetnsInodeLabel = conf.NetnsInodeLabel
+		} else {
+			logrus.Warnf("rancher-calico-ipam: cannot match by netns inode: %v", err)
+		}
+	}
+	sourceURL := config.URL()
+	spanName := "metadata.resolve"
+	if conf.Finder == finderAPI {
+		sourceURL, spanName = conf.RancherAPI.URL, "api.resolve"
+	}
+	span := commandSpan.child(spanName)
+	nets, labels, err := resolveContainer(conf, config, string(ipamArgs.RancherDependsOn), args.ContainerID, string(ipamArgs.RancherContainerUUID), conf.StrictImmediate)
+	span.end(err)
+	recordResolution(time.Since(start))
+	if e, ok := err.(*ipfinder.Error); ok {
+		if e.Kind == ipfinder.ErrUnmanaged {
+			return nil, nil, e.Kind
+		}
+		return nil, nil, err
+	}
+	if err != nil || len(nets) == 0 {
+		return nil, nil, err
+	}
+	if conf.IPFamilyPreference != metadata.FamilyDual && len(nets) > 1 {
+		logrus.Warnf("rancher-calico-ipam: rancher metadata lists %d addresses, using %s", len(nets), nets[0].IP.String())
+		nets = nets[:1]
+	}
+	ip := nets[0].IP
+	logrus.Debugf("rancher-calico-ipam: %s", fmt.Sprintf("ip: %#v", ip.String()))
+	ipamArgs.IP = ip
+	return &ipSource{
+		MetadataURL:    sourceURL,
+		ResolvedAt:     time.Now().UTC().Format(time.RFC3339),
+		ResolutionTime: time.Since(start).String(),
+		labels:         labels,
+	}, nets, nil
+}
+
+// resolveContainer is metadata.ResolveContainer over the finder of conf,
+// waiting first for the container depID, if set, to have an IP.
+func resolveContainer(conf NetConf, config metadata.Config, depID, cid, rancherid string, immediate bool) ([]net.IPNet, map[string]string, error) {
+	r, err := newResolver(conf, config)
+	if err != nil {
+		return nil, nil, &ipfinder.Error{Kind: ipfinder.ErrMetadataUnreachable, CID: cid, RancherID: rancherid, Err: err}
+	}
+	if depID == "" {
+		return r.ResolveContainer(cid, rancherid, immediate)
+	}
+	return r.ResolveContainerAfter(depID, cid, rancherid, immediate)
+}
+
+// newResolver returns a resolver for the finder selected by conf. The
+// api finder lists containers from the Rancher API rather than from
+// metadata, but polls and matches them under the same config, and does
+// not touch the ready file, which tracks the metadata service.
+func newResolver(conf NetConf, config metadata.Config) (*metadata.Resolver, error) {
+	if conf.Finder == finderAPI {
+		return metadata.NewResolverFromSource(config, api.NewSource(conf.RancherAPI.URL, conf.RancherAPI.AccessKey, conf.RancherAPI.SecretKey)), nil
+	}
+	return metadata.NewResolver(config)
+}
+
+// setIpByServiceVIP stores the VIP of the Rancher service named in
+// CNI_ARGS in ipamArgs.
+func setIpByServiceVIP(conf NetConf, ipamArgs *ipamArgs) (*ipSource, error) {
+	start := time.Now()
+	config := conf.finderConfig()
+	r, err := metadata.NewResolver(config)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := r.ServiceVIP(string(ipamArgs.RancherServiceName))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFamily(conf, ip); err != nil {
+		return nil, err
+	}
+	logrus.Debugf("rancher-calico-ipam: service vip: %s", ip.String())
+	ipamArgs.IP = ip
+	return &ipSource{
+		MetadataURL:    config.URL(),
+		ResolvedAt:     time.Now().UTC().Format(time.RFC3339),
+		ResolutionTime: time.Since(start).String(),
+	}, nil
+}
+
+// checkFamily rejects a metadata address whose family differs from the
+// configured expectedFamily.
+func checkFamily(conf NetConf, ip net.IP) error {
+	family := metadata.FamilyIPv6
+	if ip.To4() != nil {
+		family = metadata.FamilyIPv4
+	}
+	if conf.ExpectedFamily != "" && family != conf.ExpectedFamily {
+		return fmt.Errorf("rancher metadata address %s is %s, but the network expects %s", ip.String(), family, conf.ExpectedFamily)
+	}
+	return nil
+}
+
+// applyFallback is called when metadata resolved no IP for the container.
+// A static fallbackIP is stored in ipamArgs; a fallbackRange is returned as
+// the Calico pool to allocate from. Neither is used unless configured, and
+// using either is logged loudly so a metadata outage is not masked.
+func applyFallback(conf NetConf, ipamArgs *ipamArgs, logger *logrus.Entry) (*cnet.IPNet, error) {
+	if conf.FallbackIP != "" {
+		ip, err := metadata.ParseIP(conf.FallbackIP)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("invalid fallbackIP: %v", err)
 		}
+		logger.Warnf("No IP resolved from rancher metadata, using fallback IP %s", ip.String())
 		ipamArgs.IP = ip
+		return nil, nil
 	}
-	return nil
+	if conf.FallbackRange != "" {
+		_, pool, err := cnet.ParseCIDR(conf.FallbackRange)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallbackRange %q: %v", conf.FallbackRange, err)
+		}
+		logger.Warnf("No IP resolved from rancher metadata, allocating fallback IP from %s", pool.String())
+		return pool, nil
+	}
+	return nil, nil
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/rancher/rancher-cni-ipam/ipfinder"
+)
+
+func TestLoadIPAMArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        string
+		defaultArgs string
+		wantIP      string
+		wantService string
+		wantErr     bool
+	}{
+		{name: "absent"},
+		{name: "blank", args: " "},
+		{name: "separators only", args: ";;"},
+		{name: "trailing separator", args: "IP=10.42.0.5;", wantIP: "10.42.0.5"},
+		{name: "key case", args: "ip=10.42.0.5", wantIP: "10.42.0.5"},
+		{name: "reversed mixed case", args: "rancherSERVICEname=web;Ip=10.42.0.5", wantIP: "10.42.0.5", wantService: "web"},
+		{name: "embedded key case", args: "Foo=bar;ignoreunknown=1;IP=10.42.0.5", wantIP: "10.42.0.5"},
+		{name: "defaultArgs", defaultArgs: "IgnoreUnknown=1;RancherServiceName=web", wantService: "web"},
+		{name: "CNI_ARGS over defaultArgs", args: "IP=10.42.0.5", defaultArgs: "RancherServiceName=web", wantIP: "10.42.0.5"},
+		{name: "unknown key", args: "Foo=bar", wantErr: true},
+	}
+	for _, tt := range tests {
+		got := ipamArgs{}
+		err := loadIPAMArgs(NetConf{DefaultArgs: tt.defaultArgs}, &skel.CmdArgs{ContainerID: "ctr", Args: tt.args}, &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: loadIPAMArgs() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		ip := ""
+		if got.IP != nil {
+			ip = got.IP.String()
+		}
+		if ip != tt.wantIP || string(got.RancherServiceName) != tt.wantService {
+			t.Errorf("%s: got IP %q and service %q, want %q and %q", tt.name, ip, got.RancherServiceName, tt.wantIP, tt.wantService)
+		}
+	}
+}
+
+func TestCanonicalArgKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		args string
+		want string
+	}{
+		{name: "canonical", args: "IgnoreUnknown=1;IP=10.42.0.5", want: "IgnoreUnknown=1;IP=10.42.0.5"},
+		{name: "reversed mixed case", args: "k8s_pod_NAME=web-0;ip=10.42.0.5;IGNOREUNKNOWN=1", want: "K8S_POD_NAME=web-0;IP=10.42.0.5;IgnoreUnknown=1"},
+		{name: "padded pairs", args: " ip=10.42.0.5 ; rancherdependson=ctr-0 ", want: "IP=10.42.0.5;RancherDependsOn=ctr-0"},
+		{name: "unknown key kept", args: "foo=bar;ip=10.42.0.5", want: "foo=bar;IP=10.42.0.5"},
+		{name: "value case kept", args: "RANCHERSERVICENAME=Web", want: "RancherServiceName=Web"},
+	}
+	for _, tt := range tests {
+		if got := canonicalArgKeys(tt.args, &ipamArgs{}); got != tt.want {
+			t.Errorf("%s: canonicalArgKeys(%q) = %q, want %q", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCheckArgConflict(t *testing.T) {
+	tests := []struct {
+		name     string
+		strict   bool
+		uuid     string
+		wantErr  bool
+		wantWarn bool
+	}{
+		{name: "IP alone", strict: true},
+		{name: "strict conflict", strict: true, uuid: "uuid-web", wantErr: true},
+		{name: "lenient conflict", uuid: "uuid-web", wantWarn: true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		logger := log.New()
+		logger.Out = &buf
+		args := ipamArgs{IP: net.ParseIP("10.42.0.5"), RancherContainerUUID: types.UnmarshallableString(tt.uuid)}
+		err := checkArgConflict(NetConf{StrictArgs: tt.strict}, &args, log.NewEntry(logger))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkArgConflict() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if warned := strings.Contains(buf.String(), "using IP 10.42.0.5"); warned != tt.wantWarn {
+			t.Errorf("%s: warned %v, want %v: %s", tt.name, warned, tt.wantWarn, buf.String())
+		}
+		if args.IP.String() != "10.42.0.5" {
+			t.Errorf("%s: IP = %v, want it kept", tt.name, args.IP)
+		}
+	}
+}
+
+func TestExpectedFamily(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		expected string
+		wantErr  bool
+	}{
+		{name: "IPv4 expected", ip: "10.42.0.5", expected: "ipv4"},
+		{name: "IPv6 expected", ip: "fd00::5", expected: "ipv6"},
+		{name: "IPv4 for IPv6", ip: "10.42.0.5", expected: "ipv6", wantErr: true},
+		{name: "IPv6 for IPv4", ip: "fd00::5", expected: "ipv4", wantErr: true},
+		{name: "no expectation", ip: "fd00::5"},
+	}
+	for _, tt := range tests {
+		_, ts := newFakeMetadata(metadataContainer("ctr-1", "uuid-1", tt.ip))
+		ipam := &fakeIPAM{}
+		restore := useFakeCalico(&fakeCalico{ipam: ipam, pools: &fakePools{cidrs: []string{"10.42.0.0/16", "fd00::/64"}}})
+		_, err := runAdd(ts.URL, fmt.Sprintf(`"expectedFamily": %q`, tt.expected), nil)
+		restore()
+		ts.Close()
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "but the network expects "+tt.expected) {
+				t.Errorf("%s: cmdAdd() error = %v, want the address rejected", tt.name, err)
+			}
+			if len(ipam.handles) != 0 {
+				t.Errorf("%s: assigned %v in Calico IPAM, want nothing", tt.name, ipam.handles)
+			}
+			continue
+		}
+		if err != nil || len(ipam.handles["ctr-1"]) != 1 {
+			t.Errorf("%s: cmdAdd() error = %v, assigned %v, want %s assigned", tt.name, err, ipam.handles, tt.ip)
+		}
+	}
+}
+
+func TestServiceVIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		serviceIP bool
+		service   string
+		want      string
+		wantErr   bool
+	}{
+		{name: "service VIP", serviceIP: true, service: "app/web", want: "10.43.0.10"},
+		{name: "disabled", service: "app/web", want: "10.42.0.5"},
+		{name: "no service", serviceIP: true, want: "10.42.0.5"},
+		{name: "unknown service", serviceIP: true, service: "app/db", wantErr: true},
+	}
+	for _, tt := range tests {
+		m, ts := newFakeMetadata(metadataContainer("ctr-1", "uuid-1", "10.42.0.5"))
+		m.services = []map[string]string{{"uuid": "uuid-web", "name": "web", "stack_name": "app", "vip": "10.43.0.10"}}
+		ipam := &fakeIPAM{}
+		restore := useFakeCalico(&fakeCalico{ipam: ipam, pools: &fakePools{cidrs: []string{"10.42.0.0/16", "10.43.0.0/16"}}})
+		args := &skel.CmdArgs{ContainerID: "ctr-1", Netns: "/var/run/netns/ctr-1", IfName: "eth0"}
+		if tt.service != "" {
+			args.Args = "IgnoreUnknown=1;RancherServiceName=" + tt.service
+		}
+		_, err := runAdd(ts.URL, fmt.Sprintf(`"serviceVIP": %v`, tt.serviceIP), args)
+		restore()
+		ts.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: cmdAdd() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if ips := ipam.handles["ctr-1"]; len(ips) != 1 || ips[0].String() != tt.want {
+			t.Errorf("%s: assigned %v, want %s", tt.name, ips, tt.want)
+		}
+	}
+}
+
+func TestCniError(t *testing.T) {
+	plain := fmt.Errorf("malformed address")
+	tests := []struct {
+		name     string
+		err      error
+		wantCode uint
+	}{
+		{name: "container not found", err: &ipfinder.Error{Kind: ipfinder.ErrContainerNotFound, CID: "ctr"}, wantCode: 3},
+		{name: "IP pending", err: &ipfinder.Error{Kind: ipfinder.ErrIPPending, CID: "ctr"}, wantCode: 11},
+		{name: "metadata unreachable", err: &ipfinder.Error{Kind: ipfinder.ErrMetadataUnreachable, CID: "ctr"}, wantCode: 11},
+		{name: "unmanaged", err: &ipfinder.Error{Kind: ipfinder.ErrUnmanaged, CID: "ctr"}, wantCode: 11},
+		{name: "auto assign", err: &ipfinder.Error{Kind: ipfinder.ErrAutoAssign, CID: "ctr"}, wantCode: 11},
+		{name: "host network", err: &ipfinder.Error{Kind: ipfinder.ErrHostNetwork, CID: "ctr"}, wantCode: 101},
+		{name: "foreign host", err: &ipfinder.Error{Kind: ipfinder.ErrForeignHost, CID: "ctr"}, wantCode: 102},
+	}
+	for _, tt := range tests {
+		e, ok := cniError(tt.err).(*types.Error)
+		if !ok || e.Code != tt.wantCode || e.Msg != tt.err.Error() {
+			t.Errorf("%s: cniError() = %v, want code %d", tt.name, cniError(tt.err), tt.wantCode)
+		}
+	}
+	if err := cniError(plain); err != plain {
+		t.Errorf("cniError() of a plain error = %v, want it unchanged", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/rancher/rancher-cni-ipam/ipfinder/metadata"
+)
+
+// validateConfigEnv, set to 1, makes the plugin only lint the netconf on
+// stdin: no datastore or metadata is contacted and no address assigned.
+const validateConfigEnv = "CNI_VALIDATE_CONFIG"
+
+// runValidateConfig reports every problem of the netconf on stdin, one
+// per line on stdout, and fails if there is any.
+func runValidateConfig() error {
+	return validateConfig(os.Stdin, os.Stdout)
+}
+
+// validateConfig is runValidateConfig reading from in and writing to out.
+func validateConfig(in io.Reader, out io.Writer) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+	conf, err := decodeNetConf(data)
+	if err != nil {
+		return err
+	}
+	problems := append(conf.problems(), conf.lintProblems()...)
+	if len(problems) == 0 {
+		fmt.Fprintln(out, "netconf is valid")
+		return nil
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(out, "invalid netconf: %v\n", problem)
+	}
+	return fmt.Errorf("netconf has %d problems", len(problems))
+}
+
+// lintProblems returns the problems of conf that an ADD only runs into
+// once it needs the setting, such as a malformed poolCIDR, so that
+// validate lets them pass.
+func (conf NetConf) lintProblems() []error {
+	var problems []error
+	if conf.Name == "" {
+		problems = append(problems, fmt.Errorf("name is required"))
+	}
+	if conf.Type == "" {
+		problems = append(problems, fmt.Errorf("type is required"))
+	}
+	if conf.PoolCIDR != "" {
+		if _, _, err := net.ParseCIDR(conf.PoolCIDR); err != nil {
+			problems = append(problems, fmt.Errorf("invalid poolCIDR %q: %v", conf.PoolCIDR, err))
+		}
+	}
+	if conf.DeriveRange != "" && !conf.DeriveFromID {
+		problems = append(problems, fmt.Errorf("deriveRange is set but deriveFromID is not"))
+	}
+	if conf.CacheLabels && !conf.AddLock {
+		problems = append(problems, fmt.Errorf("cacheLabels requires addLock"))
+	}
+	if conf.PartialResults && conf.IPFamilyPreference != metadata.FamilyDual {
+		problems = append(problems, fmt.Errorf("partialResults requires ipFamilyPreference dual"))
+	}
+	for _, setting := range []struct {
+		name string
+		ms   int
+	}{
+		{"addLockTimeoutMs", conf.AddLockTimeoutMs},
+		{"connectTimeoutMs", conf.ConnectTimeoutMs},
+		{"metadataRequestTimeoutMs", conf.MetadataRequestTimeoutMs},
+		{"pollIntervalMs", conf.PollIntervalMs},
+		{"maxPollIntervalMs", conf.MaxPollIntervalMs},
+		{"nodeReadyTimeoutMs", conf.NodeReadyTimeoutMs},
+		{"checkTimeoutMs", conf.CheckTimeoutMs},
+		{"confirmReleaseTimeoutMs", conf.ConfirmReleaseTimeoutMs},
+		{"metadataMaxStalenessMs", conf.MetadataMaxStalenessMs},
+	} {
+		if setting.ms < 0 {
+			problems = append(problems, fmt.Errorf("%s must not be negative, got %d", setting.name, setting.ms))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		netconf  string
+		wantErr  bool
+		wantOut  []string
+		wantNone []string
+	}{
+		{
+			name:    "valid",
+			netconf: `{"name": "rancher", "type": "rancher-calico-ipam", "metadataURL": "` + server.URL + `", "poolCIDR": "10.42.0.0/16"}`,
+			wantOut: []string{"netconf is valid"},
+		},
+		{
+			name:    "missing fields",
+			netconf: `{"metadataURL": "` + server.URL + `"}`,
+			wantErr: true,
+			wantOut: []string{"invalid netconf: name is required", "invalid netconf: type is required"},
+		},
+		{
+			name: "bad formats",
+			netconf: `{"name": "rancher", "type": "rancher-calico-ipam", "poolCIDR": "10.42.0.0",
+				"fallbackIP": "10.42.0", "metadataURL": "ftp://metadata", "pollIntervalMs": -1}`,
+			wantErr: true,
+			wantOut: []string{
+				`invalid netconf: invalid poolCIDR "10.42.0.0"`,
+				`invalid netconf: invalid fallbackIP "10.42.0"`,
+				`invalid netconf: invalid metadataURL "ftp://metadata"`,
+				"invalid netconf: pollIntervalMs must not be negative, got -1",
+			},
+			wantNone: []string{"netconf is valid", "name is required"},
+		},
+		{
+			name:    "conflicting flags",
+			netconf: `{"name": "rancher", "type": "rancher-calico-ipam", "cacheLabels": true, "deriveRange": "10.42.0.0/16"}`,
+			wantErr: true,
+			wantOut: []string{
+				"invalid netconf: cacheLabels requires addLock",
+				"invalid netconf: deriveRange is set but deriveFromID is not",
+			},
+		},
+		{
+			name:    "malformed",
+			netconf: `{"name": `,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := validateConfig(strings.NewReader(tt.netconf), &out)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateConfig() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		for _, line := range tt.wantOut {
+			if !strings.Contains(out.String(), line) {
+				t.Errorf("%s: output lacks %q:\n%s", tt.name, line, out.String())
+			}
+		}
+		for _, line := range tt.wantNone {
+			if strings.Contains(out.String(), line) {
+				t.Errorf("%s: output has %q:\n%s", tt.name, line, out.String())
+			}
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("validateConfig() made %d metadata requests, want none", n)
+	}
+}